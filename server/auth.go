@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// ─────────────────────────────────────────
+// 数据结构
+// ─────────────────────────────────────────
+
+// User 用户账号（多个家庭共用一个部署时按用户隔离数据）
+type User struct {
+	ID        string `json:"id"`
+	Username  string `json:"username"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// authRequest 注册/登录请求
+type authRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// 会话有效期
+const sessionTTL = 30 * 24 * time.Hour
+
+// gin.Context 中保存当前用户ID的键
+const ctxUserID = "userID"
+
+// ─────────────────────────────────────────
+// 中间件
+// ─────────────────────────────────────────
+
+// authRequired 校验 Authorization: Bearer <token>（会话令牌或设备令牌），并将用户ID写入上下文
+func authRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+			return
+		}
+
+		var userID string
+		var expiresAt int64
+		err := db.QueryRow(`SELECT user_id, expires_at FROM sessions WHERE token_hash = ?`, hashToken(token)).
+			Scan(&userID, &expiresAt)
+		if err == nil && expiresAt >= time.Now().Unix() {
+			c.Set(ctxUserID, userID)
+			c.Next()
+			return
+		}
+
+		// 不是会话令牌时再按设备令牌校验（已吊销的设备会在这里被拒绝）
+		if userID, deviceID, ok := lookupDeviceToken(token, c.ClientIP()); ok {
+			c.Set(ctxUserID, userID)
+			c.Set(ctxDeviceID, deviceID)
+			c.Next()
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "登录已失效，请重新登录"})
+	}
+}
+
+// currentUserID 获取当前请求的用户ID（须在 authRequired 之后调用）
+func currentUserID(c *gin.Context) string {
+	return c.GetString(ctxUserID)
+}
+
+func bearerToken(c *gin.Context) string {
+	h := c.GetHeader("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：/api/v1/auth/*
+// ─────────────────────────────────────────
+
+func handleRegister(c *gin.Context) {
+	var req authRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" || len(req.Password) < 8 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "用户名不能为空，密码至少8位"})
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	user := User{
+		ID:        uuid.New().String(),
+		Username:  req.Username,
+		CreatedAt: time.Now().Unix(),
+	}
+	_, err = db.Exec(`INSERT INTO users (id, username, password_hash, created_at) VALUES (?, ?, ?, ?)`,
+		user.ID, user.Username, string(hash), user.CreatedAt)
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "用户名已存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	claimOrphanRows(user.ID)
+
+	token, err := createSession(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"data": gin.H{
+			"user":  user,
+			"token": token,
+		},
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleLogin(c *gin.Context) {
+	var req authRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user User
+	var hash string
+	err := db.QueryRow(`SELECT id, username, password_hash, created_at FROM users WHERE username = ?`,
+		strings.TrimSpace(req.Username)).Scan(&user.ID, &user.Username, &hash, &user.CreatedAt)
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password))
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户名或密码错误"})
+		return
+	}
+
+	token, err := createSession(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"user":  user,
+			"token": token,
+		},
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleLogout(c *gin.Context) {
+	_, err := db.Exec(`DELETE FROM sessions WHERE token_hash = ?`, hashToken(bearerToken(c)))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "timestamp": time.Now().Unix()})
+}
+
+// handleLogoutAll 让该账号的所有登录会话（包括当前会话）失效，设备令牌不受影响，需在设备管理中单独吊销
+func handleLogoutAll(c *gin.Context) {
+	if !requireSession(c) {
+		return
+	}
+	res, err := db.Exec(`DELETE FROM sessions WHERE user_id = ?`, currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	n, _ := res.RowsAffected()
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      gin.H{"sessions": n},
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleGetMe(c *gin.Context) {
+	var user User
+	err := db.QueryRow(`SELECT id, username, created_at FROM users WHERE id = ?`, currentUserID(c)).
+		Scan(&user.ID, &user.Username, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": user, "timestamp": time.Now().Unix()})
+}
+
+// ─────────────────────────────────────────
+// 辅助函数
+// ─────────────────────────────────────────
+
+// createSession 生成随机令牌，数据库中只保存其 SHA-256 摘要
+func createSession(userID string) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	_, err = db.Exec(`INSERT INTO sessions (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		hashToken(token), userID, now.Unix(), now.Add(sessionTTL).Unix())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// isUniqueViolation 是否为违反唯一约束的写入错误
+func isUniqueViolation(err error) bool {
+	var se *sqlite.Error
+	return errors.As(err, &se) && se.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// orphanTables 升级前的数据（含迁移时从这些数据派生的行）所在的表，user_id 为空
+var orphanTables = []string{
+	"cards", "email_config", "bill_statements", "blobs",
+	"bill_bodies", "bill_transactions", "bill_amounts", "bill_overrides", "bill_payments",
+}
+
+// claimOrphanRows 升级前的单用户数据没有 user_id，由第一个注册的用户在一个事务中全部认领
+func claimOrphanRows(userID string) {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count); err != nil || count != 1 {
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("[auth] 认领旧数据失败: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	for _, table := range orphanTables {
+		if _, err := tx.Exec(`UPDATE `+table+` SET user_id = ? WHERE user_id = ''`, userID); err != nil {
+			log.Printf("[auth] 认领旧数据失败(%s): %v", table, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[auth] 认领旧数据失败: %v", err)
+	}
+}
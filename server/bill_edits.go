@@ -0,0 +1,518 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────
+// 手工录入与修改账单
+//
+// 账单来源（source）有三种：email 由 IMAP 拉取写入；manual 为用户手工录入（不发电子账单的银行）；
+// import 为客户端批量导入，与 manual 一样没有邮件 UID，不参与邮件去重。
+// 修改邮件账单的字段时在 bill_overrides 中记下该字段，之后重新拉取同一封邮件只更新其余字段，
+// 被覆盖字段的最新解析结果写入 parsed_value 便于对照。
+// ─────────────────────────────────────────
+
+const (
+	billSourceEmail  = "email"
+	billSourceManual = "manual"
+	billSourceImport = "import"
+)
+
+// BillOverride 账单中一个被手工修改的字段
+type BillOverride struct {
+	Field       string `json:"field"`       // 字段名（与 BillStatement 的 JSON 字段名一致）
+	ParsedValue string `json:"parsedValue"` // 邮件解析出的值（最近一次拉取）
+	Value       string `json:"value"`       // 手工填写的值
+	UpdatedAt   int64  `json:"updatedAt"`
+}
+
+// billEditableFields 可手工修改的字段，name 为 JSON 字段名
+var billEditableFields = []struct {
+	name, column string
+	get          func(bs BillStatement) any
+}{
+	{"cardSyncId", "card_sync_id", func(bs BillStatement) any { return bs.CardSyncID }},
+	{"bank", "bank", func(bs BillStatement) any { return bs.Bank }},
+	{"amount", "amount", func(bs BillStatement) any { return bs.Amount }},
+	{"currency", "currency", func(bs BillStatement) any { return bs.Currency }},
+	{"billDate", "bill_date", func(bs BillStatement) any { return bs.BillDate }},
+	{"dueDate", "due_date", func(bs BillStatement) any { return bs.DueDate }},
+	{"minPayment", "min_payment", func(bs BillStatement) any { return bs.MinPayment }},
+}
+
+// 影响 bill_amounts 的字段
+var billAmountFields = map[string]bool{"amount": true, "currency": true, "minPayment": true}
+
+// billColumns 与 scanBill 对应；早期结构中这些列可以为 NULL
+const billColumns = `id, card_sync_id, email_config_id, mailbox, email_uid, COALESCE(bank, ''), COALESCE(amount, 0),
+		       COALESCE(currency, 'CNY'), COALESCE(bill_date, ''), COALESCE(due_date, ''), COALESCE(min_payment, 0),
+		       COALESCE(statement_type, ''), COALESCE(matched_by, ''), COALESCE(match_confidence, ''),
+		       COALESCE(fetched_at, 0), COALESCE(email_from, ''), COALESCE(email_subject, ''), source`
+
+func scanBill(r rowScanner) (BillStatement, error) {
+	var bs BillStatement
+	err := r.Scan(
+		&bs.ID, &bs.CardSyncID, &bs.EmailConfigID, &bs.Mailbox, &bs.EmailUID, &bs.Bank, &bs.Amount,
+		&bs.Currency, &bs.BillDate, &bs.DueDate, &bs.MinPayment,
+		&bs.StatementType, &bs.MatchedBy, &bs.MatchConfidence, &bs.FetchedAt,
+		&bs.EmailFrom, &bs.EmailSubject, &bs.Source,
+	)
+	return bs, err
+}
+
+func loadBill(userID string, id int64) (BillStatement, error) {
+	bs, err := scanBill(db.QueryRow(`SELECT `+billColumns+` FROM bill_statements WHERE id = ? AND user_id = ?`, id, userID))
+	bs.UserID = userID
+	return bs, err
+}
+
+// billFromParam 读取路径参数 :id 对应的账单，不存在时已写好 404 响应
+func billFromParam(c *gin.Context) (BillStatement, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "账单不存在"})
+		return BillStatement{}, false
+	}
+	bs, err := loadBill(currentUserID(c), id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "账单不存在"})
+		return bs, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return bs, false
+	}
+	return bs, true
+}
+
+// attachBillDetails 为账单附上各币种金额、还款状态和手工修改过的字段
+func attachBillDetails(userID string, bills []BillStatement) error {
+	if err := attachBillAmounts(userID, bills); err != nil {
+		return err
+	}
+	if err := attachBillPayments(userID, bills); err != nil {
+		return err
+	}
+	return attachBillOverrides(userID, bills)
+}
+
+// attachBillOverrides 为账单附上手工修改过的字段
+func attachBillOverrides(userID string, bills []BillStatement) error {
+	if len(bills) == 0 {
+		return nil
+	}
+	args := []any{userID}
+	index := map[int64]int{}
+	for i, bs := range bills {
+		args = append(args, bs.ID)
+		index[bs.ID] = i
+	}
+	rows, err := db.Query(`
+		SELECT bill_id, field, parsed_value, value, updated_at FROM bill_overrides
+		WHERE user_id = ? AND bill_id IN (?`+strings.Repeat(",?", len(bills)-1)+`)
+		ORDER BY bill_id, field
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var o BillOverride
+		if err := rows.Scan(&id, &o.Field, &o.ParsedValue, &o.Value, &o.UpdatedAt); err != nil {
+			return err
+		}
+		bs := &bills[index[id]]
+		bs.Overrides = append(bs.Overrides, o)
+	}
+	return rows.Err()
+}
+
+// refreshBillStatement 用重新解析的结果更新已入库的邮件账单，跳过手工修改过的字段。
+// 金额、币种、最低还款都未修改时才重写各币种金额；交易明细总是按本次解析重写。
+func refreshBillStatement(tx *sql.Tx, billID int64, bs BillStatement, txns []BillTransaction) error {
+	overridden := map[string]bool{}
+	rows, err := tx.Query(`SELECT field FROM bill_overrides WHERE bill_id = ?`, billID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var field string
+		if err := rows.Scan(&field); err != nil {
+			rows.Close()
+			return err
+		}
+		overridden[field] = true
+	}
+	rows.Close()
+
+	sets := []string{"statement_type = ?", "raw_content = ?", "email_from = ?", "email_subject = ?"}
+	args := []any{bs.StatementType, bs.RawContent, bs.EmailFrom, bs.EmailSubject}
+	if !overridden["cardSyncId"] {
+		sets = append(sets, "matched_by = ?", "match_confidence = ?")
+		args = append(args, bs.MatchedBy, bs.MatchConfidence)
+	}
+	keepAmounts := false
+	for _, f := range billEditableFields {
+		if !overridden[f.name] {
+			sets = append(sets, f.column+" = ?")
+			args = append(args, f.get(bs))
+			continue
+		}
+		keepAmounts = keepAmounts || billAmountFields[f.name]
+		_, err := tx.Exec(`UPDATE bill_overrides SET parsed_value = ? WHERE bill_id = ? AND field = ?`,
+			fmt.Sprint(f.get(bs)), billID, f.name)
+		if err != nil {
+			return err
+		}
+	}
+	args = append(args, billID)
+	if _, err := tx.Exec(`UPDATE bill_statements SET `+strings.Join(sets, ", ")+` WHERE id = ?`, args...); err != nil {
+		return err
+	}
+
+	if !keepAmounts {
+		if _, err := tx.Exec(`DELETE FROM bill_amounts WHERE bill_id = ?`, billID); err != nil {
+			return err
+		}
+		if err := saveBillAmounts(tx, bs.UserID, billID, bs.Amounts); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM bill_transactions WHERE bill_id = ?`, billID); err != nil {
+		return err
+	}
+	return saveBillTransactions(tx, bs.UserID, billID, txns)
+}
+
+// ─────────────────────────────────────────
+// 校验
+// ─────────────────────────────────────────
+
+// billRequest 新建/修改账单的请求体，修改时未提供的字段保持不变
+type billRequest struct {
+	CardSyncID *string  `json:"cardSyncId"`
+	Bank       *string  `json:"bank"`
+	Amount     *float64 `json:"amount"`
+	Currency   *string  `json:"currency"`
+	BillDate   *string  `json:"billDate"`
+	DueDate    *string  `json:"dueDate"`
+	MinPayment *float64 `json:"minPayment"`
+	Source     string   `json:"source"` // 仅新建时有效：manual（默认）/import
+}
+
+var reCurrencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// applyBillRequest 把请求中的字段写入 bs 并校验整张账单
+func applyBillRequest(bs BillStatement, req billRequest) (BillStatement, error) {
+	if req.CardSyncID != nil {
+		bs.CardSyncID = strings.TrimSpace(*req.CardSyncID)
+	}
+	if req.Bank != nil {
+		bs.Bank = strings.TrimSpace(*req.Bank)
+	}
+	if req.Amount != nil {
+		bs.Amount = *req.Amount
+	}
+	if req.Currency != nil {
+		bs.Currency = strings.ToUpper(strings.TrimSpace(*req.Currency))
+	}
+	if req.BillDate != nil {
+		bs.BillDate = strings.TrimSpace(*req.BillDate)
+	}
+	if req.DueDate != nil {
+		bs.DueDate = strings.TrimSpace(*req.DueDate)
+	}
+	if req.MinPayment != nil {
+		bs.MinPayment = *req.MinPayment
+	}
+
+	if bs.CardSyncID == "" {
+		return bs, fmt.Errorf("缺少 cardSyncId")
+	}
+	var cardBank string
+	err := db.QueryRow(`SELECT bank FROM cards WHERE sync_id = ? AND user_id = ? AND is_deleted = 0`,
+		bs.CardSyncID, bs.UserID).Scan(&cardBank)
+	if err == sql.ErrNoRows {
+		return bs, fmt.Errorf("卡片不存在: %s", bs.CardSyncID)
+	}
+	if err != nil {
+		return bs, err
+	}
+	if bs.Bank == "" {
+		bs.Bank = cardBank
+	}
+
+	if code, ok := currencyWords[bs.Currency]; ok {
+		bs.Currency = code
+	}
+	if bs.Currency == "" {
+		bs.Currency = "CNY"
+	}
+	if !reCurrencyCode.MatchString(bs.Currency) {
+		return bs, fmt.Errorf("币种应为三位代码，如 CNY、USD")
+	}
+
+	if _, err := time.Parse("2006-01-02", bs.BillDate); err != nil {
+		return bs, fmt.Errorf("billDate 格式应为 YYYY-MM-DD")
+	}
+	if bs.DueDate != "" {
+		if _, err := time.Parse("2006-01-02", bs.DueDate); err != nil {
+			return bs, fmt.Errorf("dueDate 格式应为 YYYY-MM-DD")
+		}
+		if bs.DueDate < bs.BillDate {
+			return bs, fmt.Errorf("还款日不能早于账单日")
+		}
+	}
+
+	if math.IsNaN(bs.Amount) || math.IsInf(bs.Amount, 0) || math.IsNaN(bs.MinPayment) {
+		return bs, fmt.Errorf("金额无效")
+	}
+	bs.Amount, bs.MinPayment = roundCents(bs.Amount), roundCents(bs.MinPayment)
+	// 溢缴款的账单金额为负，此时最低还款只能为 0
+	if bs.MinPayment < 0 || bs.MinPayment > math.Max(bs.Amount, 0) {
+		return bs, fmt.Errorf("最低还款额应在 0 与账单金额之间")
+	}
+	return bs, nil
+}
+
+// duplicateBill 返回同一张卡同一账单日的其他账单 id，没有时返回 0
+func duplicateBill(bs BillStatement) (int64, error) {
+	var id int64
+	err := db.QueryRow(`SELECT id FROM bill_statements WHERE user_id = ? AND card_sync_id = ? AND bill_date = ? AND id != ? LIMIT 1`,
+		bs.UserID, bs.CardSyncID, bs.BillDate, bs.ID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：POST/PUT/DELETE /api/v1/bills
+// ─────────────────────────────────────────
+
+func handleCreateBill(c *gin.Context) {
+	var req billRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	source := req.Source
+	if source == "" {
+		source = billSourceManual
+	}
+	if source != billSourceManual && source != billSourceImport {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "source 应为 manual 或 import"})
+		return
+	}
+	if req.BillDate == nil || req.Amount == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少 billDate 或 amount"})
+		return
+	}
+
+	bs, err := applyBillRequest(BillStatement{UserID: currentUserID(c)}, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if dup, err := duplicateBill(bs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	} else if dup != 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "该卡片在此账单日已有账单", "billId": dup})
+		return
+	}
+
+	bs.Source = source
+	bs.MatchedBy = source
+	bs.MatchConfidence = "high"
+	bs.FetchedAt = time.Now().Unix()
+	bs.Amounts = []BillAmount{{Currency: bs.Currency, Amount: bs.Amount, MinPayment: bs.MinPayment}}
+	if bs.ID, err = insertManualBill(bs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	bills := []BillStatement{bs}
+	if err := attachBillDetails(bs.UserID, bills); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success":   true,
+		"data":      bills[0],
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// insertManualBill 写入没有来源邮件的账单，返回新账单 id
+func insertManualBill(bs BillStatement) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO bill_statements
+		(user_id, card_sync_id, email_uid, bank, amount, currency, bill_date, due_date, min_payment,
+		 statement_type, matched_by, match_confidence, fetched_at, source)
+		VALUES (?, ?, 0, ?, ?, ?, ?, ?, ?, '', ?, ?, ?, ?)`,
+		bs.UserID, bs.CardSyncID, bs.Bank, bs.Amount, bs.Currency, bs.BillDate, bs.DueDate, bs.MinPayment,
+		bs.MatchedBy, bs.MatchConfidence, bs.FetchedAt, bs.Source)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := saveBillAmounts(tx, bs.UserID, id, bs.Amounts); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// handleUpdateBill PUT /api/v1/bills/:id
+// 只修改请求中出现的字段；邮件账单被修改的字段记入 bill_overrides，重新拉取时不会被覆盖。
+func handleUpdateBill(c *gin.Context) {
+	old, ok := billFromParam(c)
+	if !ok {
+		return
+	}
+	var req billRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	bs, err := applyBillRequest(old, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if bs.CardSyncID != old.CardSyncID || bs.BillDate != old.BillDate {
+		if dup, err := duplicateBill(bs); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		} else if dup != 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "该卡片在此账单日已有账单", "billId": dup})
+			return
+		}
+	}
+
+	if err := saveBillEdit(old, bs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	bills := []BillStatement{bs}
+	if err := attachBillDetails(bs.UserID, bills); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      bills[0],
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// saveBillEdit 写入修改后的账单，并同步主币种金额和覆盖记录
+func saveBillEdit(old, bs BillStatement) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE bill_statements SET card_sync_id = ?, bank = ?, amount = ?, currency = ?, bill_date = ?, due_date = ?, min_payment = ?
+		WHERE id = ? AND user_id = ?`,
+		bs.CardSyncID, bs.Bank, bs.Amount, bs.Currency, bs.BillDate, bs.DueDate, bs.MinPayment, bs.ID, bs.UserID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	amountsChanged := false
+	for _, f := range billEditableFields {
+		before, after := fmt.Sprint(f.get(old)), fmt.Sprint(f.get(bs))
+		if before == after {
+			continue
+		}
+		amountsChanged = amountsChanged || billAmountFields[f.name]
+		if bs.Source != billSourceEmail {
+			continue
+		}
+		// 首次覆盖时记下原解析值，之后只更新手工值
+		_, err := tx.Exec(`
+			INSERT INTO bill_overrides (bill_id, user_id, field, parsed_value, value, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(bill_id, field) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+			bs.ID, bs.UserID, f.name, before, after, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	if amountsChanged {
+		if bs.Currency != old.Currency {
+			if _, err := tx.Exec(`DELETE FROM bill_amounts WHERE bill_id = ? AND currency = ?`, bs.ID, old.Currency); err != nil {
+				return err
+			}
+		}
+		err := saveBillAmounts(tx, bs.UserID, bs.ID, []BillAmount{{Currency: bs.Currency, Amount: bs.Amount, MinPayment: bs.MinPayment}})
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// handleDeleteBill DELETE /api/v1/bills/:id
+// 删除邮件账单后，重新扫描整个文件夹（backfill）时会再次入库。
+func handleDeleteBill(c *gin.Context) {
+	bs, ok := billFromParam(c)
+	if !ok {
+		return
+	}
+
+	if err := deleteBill(bs.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "timestamp": time.Now().Unix()})
+}
+
+// deleteBill 删除账单及其明细、各币种金额、覆盖记录、还款记录和邮件原文
+func deleteBill(billID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		`DELETE FROM bill_transactions WHERE bill_id = ?`,
+		`DELETE FROM bill_amounts WHERE bill_id = ?`,
+		`DELETE FROM bill_overrides WHERE bill_id = ?`,
+		`DELETE FROM bill_payments WHERE bill_id = ?`,
+		`DELETE FROM bill_bodies WHERE bill_id = ?`,
+		`DELETE FROM bill_statements WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(q, billID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
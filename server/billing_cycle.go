@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"card-server/billingcycle"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────
+// 账期计算
+//
+// 推算规则在 billingcycle 包中（账单日当天的消费计入当天出账的账期，月末截断，
+// 每月固定还款日或账单日后 N 天还款）。这里负责读取卡片的规则和对外的 HTTP 接口，
+// 提醒、日历、账单日后的补拉都经由 cardCycleRule 使用同一套规则。
+// ─────────────────────────────────────────
+
+// BillingPeriod 一个账期
+type BillingPeriod struct {
+	Start   string `json:"start"`   // 账期第一天
+	End     string `json:"end"`     // 账单日（账期最后一天）
+	DueDate string `json:"dueDate"` // 本期还款日
+}
+
+func billingPeriodJSON(p billingcycle.Period) *BillingPeriod {
+	return &BillingPeriod{
+		Start:   p.Start.Format("2006-01-02"),
+		End:     p.End.Format("2006-01-02"),
+		DueDate: p.Due.Format("2006-01-02"),
+	}
+}
+
+// ─────────────────────────────────────────
+// 卡片的账期规则
+// ─────────────────────────────────────────
+
+// loadDueAfterDays 用户各卡片的“账单日后 N 天还款”设置：cardSyncId → N
+func loadDueAfterDays(userID string) (map[string]int, error) {
+	rows, err := db.Query(`SELECT card_sync_id, due_after_days FROM card_cycle_rules WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string]int{}
+	for rows.Next() {
+		var syncID string
+		var n int
+		if err := rows.Scan(&syncID, &n); err != nil {
+			return nil, err
+		}
+		out[syncID] = n
+	}
+	return out, rows.Err()
+}
+
+// cardCycleRule 卡片的账期规则，dueAfter 为 loadDueAfterDays 的结果
+func cardCycleRule(card Card, dueAfter map[string]int) billingcycle.Rule {
+	return billingcycle.Rule{BillingDay: card.BillingDay, PaymentDueDay: card.PaymentDueDay, DueAfterDays: dueAfter[card.SyncID]}
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：/api/v1/cards/:id/cycle
+// ─────────────────────────────────────────
+
+// CardCycle 卡片在某一天的账期信息
+type CardCycle struct {
+	CardSyncID    string `json:"cardSyncId"`
+	BillingDay    int    `json:"billingDay"`
+	PaymentDueDay int    `json:"paymentDueDay"`
+	DueAfterDays  int    `json:"dueAfterDays"` // 0 表示按 paymentDueDay
+	Date          string `json:"date"`         // 计算基准日
+
+	CurrentPeriod      *BillingPeriod `json:"currentPeriod"` // 当天消费所属账期
+	LastPeriod         *BillingPeriod `json:"lastPeriod"`    // 上一个已出账的账期
+	NextStatementDate  string         `json:"nextStatementDate"`
+	DaysUntilStatement int            `json:"daysUntilStatement"`
+	NextDueDate        string         `json:"nextDueDate"`
+	DaysUntilDue       int            `json:"daysUntilDue"`
+	// 当天消费的免息天数（到所属账期的还款日），以及账期第一天消费的最长免息天数
+	InterestFreeDays    int `json:"interestFreeDays"`
+	MaxInterestFreeDays int `json:"maxInterestFreeDays"`
+}
+
+// computeCardCycle 计算卡片在 day 的账期信息，缺少账单日或还款日时返回 false
+func computeCardCycle(syncID string, r billingcycle.Rule, day time.Time) (CardCycle, bool) {
+	day = billingcycle.DateOnly(day)
+	cc := CardCycle{
+		CardSyncID:    syncID,
+		BillingDay:    r.BillingDay,
+		PaymentDueDay: r.PaymentDueDay,
+		DueAfterDays:  r.DueAfterDays,
+		Date:          day.Format("2006-01-02"),
+	}
+	due, ok := r.NextDueDate(day)
+	if !ok || !r.HasStatement() {
+		return cc, false
+	}
+
+	// 账单日当天：当前账期就是今天出账的这一期，距出账 0 天
+	cur := r.PeriodContaining(day)
+	last := r.PeriodContaining(cur.Start.AddDate(0, 0, -1))
+	cc.CurrentPeriod = billingPeriodJSON(cur)
+	cc.LastPeriod = billingPeriodJSON(last)
+	cc.NextStatementDate = cur.End.Format("2006-01-02")
+	cc.DaysUntilStatement = daysBetween(cc.Date, cc.NextStatementDate)
+	cc.NextDueDate = due.Format("2006-01-02")
+	cc.DaysUntilDue = daysBetween(cc.Date, cc.NextDueDate)
+	cc.InterestFreeDays = daysBetween(cc.Date, cur.Due.Format("2006-01-02"))
+	cc.MaxInterestFreeDays = daysBetween(cur.Start.Format("2006-01-02"), cur.Due.Format("2006-01-02"))
+	return cc, true
+}
+
+// cardFromParam 按 :id（数据库ID 或 syncId）取当前用户未删除的卡片
+func cardFromParam(c *gin.Context) (Card, bool) {
+	var card Card
+	id := c.Param("id")
+	err := db.QueryRow(`SELECT sync_id, COALESCE(billing_day, 0), COALESCE(payment_due_day, 0) FROM cards
+		WHERE (id = ? OR sync_id = ?) AND user_id = ? AND is_deleted = 0`, id, id, currentUserID(c)).
+		Scan(&card.SyncID, &card.BillingDay, &card.PaymentDueDay)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "卡片不存在"})
+		return card, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return card, false
+	}
+	return card, true
+}
+
+// respondCardCycle 计算并返回卡片的账期信息
+func respondCardCycle(c *gin.Context, card Card, day time.Time) {
+	dueAfter, err := loadDueAfterDays(currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	cc, ok := computeCardCycle(card.SyncID, cardCycleRule(card, dueAfter), day)
+	if !ok {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "卡片未设置账单日或还款日", "data": cc})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      cc,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleGetCardCycle GET /api/v1/cards/:id/cycle?date=YYYY-MM-DD（默认今天）
+func handleGetCardCycle(c *gin.Context) {
+	day := time.Now()
+	if s := c.Query("date"); s != "" {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "date 格式应为 YYYY-MM-DD"})
+			return
+		}
+		day = d
+	}
+	card, ok := cardFromParam(c)
+	if !ok {
+		return
+	}
+	respondCardCycle(c, card, day)
+}
+
+// handleSetCardCycle PUT /api/v1/cards/:id/cycle
+// 请求体 {"dueAfterDays":18} 设置为账单日后 N 天还款，0 恢复按 paymentDueDay。
+func handleSetCardCycle(c *gin.Context) {
+	var req struct {
+		DueAfterDays int `json:"dueAfterDays"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.DueAfterDays < 0 || req.DueAfterDays > billingcycle.MaxDueAfterDays {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("dueAfterDays 应在 0-%d 之间", billingcycle.MaxDueAfterDays)})
+		return
+	}
+	card, ok := cardFromParam(c)
+	if !ok {
+		return
+	}
+
+	userID := currentUserID(c)
+	var err error
+	if req.DueAfterDays == 0 {
+		_, err = db.Exec(`DELETE FROM card_cycle_rules WHERE user_id = ? AND card_sync_id = ?`, userID, card.SyncID)
+	} else {
+		_, err = db.Exec(`
+			INSERT INTO card_cycle_rules (user_id, card_sync_id, due_after_days, updated_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(user_id, card_sync_id) DO UPDATE SET
+				due_after_days = excluded.due_after_days, updated_at = excluded.updated_at
+		`, userID, card.SyncID, req.DueAfterDays, time.Now().Unix())
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respondCardCycle(c, card, time.Now())
+}
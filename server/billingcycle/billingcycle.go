@@ -0,0 +1,129 @@
+// Package billingcycle 按卡片的账单日、还款日推算账期和还款日，不依赖数据库和 HTTP。
+//
+// 账期以账单日为界：上一个账单日的次日到本期账单日为一个账期，账单日当天出账，
+// 当天的消费计入当天出账的这一期。因此在账单日当天，PeriodContaining 返回以今天结束的账期
+// （距出账 0 天），而不是下一期。
+//
+// 账单日大于当月天数时按月末计算（31 号在 2 月为 28/29 号）。还款日有两种算法：
+//   - 每月固定日期（PaymentDueDay）：还款日大于账单日时在出账当月，否则在次月，同样按月末截断
+//   - 账单日后 N 天（如招商银行账单日后 18 天）：DueAfterDays 大于 0，忽略 PaymentDueDay
+//
+// 所有日期都是不带时区的自然日（time.Time 取 UTC 零点）。
+//
+// 前端 src/utils/billing.ts 的 getNextDateForDay 在账单日当天就跳到下个月，也不按月末截断
+// （2 月的 31 号会顺延到 3 月）；两者在这些日子的结果不同，服务端的提醒、日历和补拉以本包为准。
+package billingcycle
+
+import "time"
+
+// MaxDueAfterDays 账单日后 N 天还款的上限
+const MaxDueAfterDays = 60
+
+// Rule 一张卡片的账期规则
+type Rule struct {
+	BillingDay    int // 账单日，0 表示未设置
+	PaymentDueDay int // 每月固定还款日，0 表示未设置
+	DueAfterDays  int // 大于 0 时还款日为账单日后 N 天，忽略 PaymentDueDay
+}
+
+// Period 一个账期
+type Period struct {
+	Start time.Time // 账期第一天
+	End   time.Time // 账单日（账期最后一天）
+	Due   time.Time // 本期还款日
+}
+
+// ClampDay 账单日超过当月天数时按月末计算（如 31 号在 2 月为 28/29 号）
+func ClampDay(year int, month time.Month, day int) int {
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	if day > last {
+		return last
+	}
+	return day
+}
+
+// DayInMonth 某年某月的“每月 day 号”（当月没有该日时取月末）
+func DayInMonth(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, ClampDay(year, month, day), 0, 0, 0, 0, time.UTC)
+}
+
+// DateOnly 取 t 在其时区下的日期
+func DateOnly(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// HasStatement 能否推算账单日
+func (r Rule) HasStatement() bool {
+	return r.BillingDay > 0
+}
+
+// HasDue 能否推算还款日
+func (r Rule) HasDue() bool {
+	return r.PaymentDueDay > 0 || (r.DueAfterDays > 0 && r.BillingDay > 0)
+}
+
+// IsStatementDate day 是否为账单日
+func (r Rule) IsStatementDate(day time.Time) bool {
+	if !r.HasStatement() {
+		return false
+	}
+	y, m, d := day.Date()
+	return ClampDay(y, m, r.BillingDay) == d
+}
+
+// DueFor 账单日为 statement 的那一期的还款日
+func (r Rule) DueFor(statement time.Time) time.Time {
+	if r.DueAfterDays > 0 {
+		return statement.AddDate(0, 0, r.DueAfterDays)
+	}
+	month := time.Date(statement.Year(), statement.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if r.PaymentDueDay <= r.BillingDay {
+		month = month.AddDate(0, 1, 0)
+	}
+	return DayInMonth(month.Year(), month.Month(), r.PaymentDueDay)
+}
+
+// Period 在 year 年 month 月出账的账期
+func (r Rule) Period(year int, month time.Month) Period {
+	end := DayInMonth(year, month, r.BillingDay)
+	prev := time.Date(year, month-1, 1, 0, 0, 0, 0, time.UTC)
+	start := DayInMonth(prev.Year(), prev.Month(), r.BillingDay).AddDate(0, 0, 1)
+	return Period{Start: start, End: end, Due: r.DueFor(end)}
+}
+
+// PeriodContaining day 的消费所属的账期（账单日当天属于当天出账的账期）
+func (r Rule) PeriodContaining(day time.Time) Period {
+	day = DateOnly(day)
+	p := r.Period(day.Year(), day.Month())
+	if day.After(p.End) {
+		next := time.Date(day.Year(), day.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		p = r.Period(next.Year(), next.Month())
+	}
+	return p
+}
+
+// NextDueDate today 或之后的第一个还款日（上一期未到还款日时就是上一期的还款日，还款日当天返回当天）
+func (r Rule) NextDueDate(today time.Time) (time.Time, bool) {
+	today = DateOnly(today)
+	if !r.HasDue() {
+		return time.Time{}, false
+	}
+	if !r.HasStatement() {
+		// 没有账单日时只能按每月固定还款日推算
+		d := DayInMonth(today.Year(), today.Month(), r.PaymentDueDay)
+		if d.Before(today) {
+			next := time.Date(today.Year(), today.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			d = DayInMonth(next.Year(), next.Month(), r.PaymentDueDay)
+		}
+		return d, true
+	}
+	// 从三个月前出账的账期往后找，还款日最晚也在出账后 MaxDueAfterDays 天
+	start := time.Date(today.Year(), today.Month()-3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; ; i++ {
+		m := start.AddDate(0, i, 0)
+		if p := r.Period(m.Year(), m.Month()); !p.Due.Before(today) {
+			return p.Due, true
+		}
+	}
+}
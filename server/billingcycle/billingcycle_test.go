@@ -0,0 +1,119 @@
+package billingcycle
+
+import (
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func fmtDate(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+func TestPeriodContaining(t *testing.T) {
+	cases := []struct {
+		name            string
+		rule            Rule
+		day             string
+		start, end, due string
+	}{
+		// 账单日 31 号：2 月按月末出账，3 月的账期从 3 月 1 日开始
+		{"31号在平年2月", Rule{BillingDay: 31, PaymentDueDay: 20}, "2025-02-10", "2025-02-01", "2025-02-28", "2025-03-20"},
+		{"31号在闰年2月", Rule{BillingDay: 31, PaymentDueDay: 20}, "2024-02-29", "2024-02-01", "2024-02-29", "2024-03-20"},
+		{"31号在2月之后", Rule{BillingDay: 31, PaymentDueDay: 20}, "2025-03-01", "2025-03-01", "2025-03-31", "2025-04-20"},
+		{"30号跨过2月", Rule{BillingDay: 30, PaymentDueDay: 20}, "2025-03-05", "2025-03-01", "2025-03-30", "2025-04-20"},
+
+		// 还款日不大于账单日时在次月
+		{"还款日等于账单日", Rule{BillingDay: 5, PaymentDueDay: 5}, "2025-06-10", "2025-06-06", "2025-07-05", "2025-08-05"},
+		{"还款日小于账单日跨年", Rule{BillingDay: 20, PaymentDueDay: 8}, "2025-12-25", "2025-12-21", "2026-01-20", "2026-02-08"},
+		{"还款日大于账单日在当月", Rule{BillingDay: 5, PaymentDueDay: 25}, "2025-06-03", "2025-05-06", "2025-06-05", "2025-06-25"},
+		{"还款日31号在2月取月末", Rule{BillingDay: 10, PaymentDueDay: 31}, "2025-02-01", "2025-01-11", "2025-02-10", "2025-02-28"},
+
+		// 账单日后 N 天还款，忽略每月固定还款日
+		{"账单日后18天", Rule{BillingDay: 7, PaymentDueDay: 25, DueAfterDays: 18}, "2025-06-10", "2025-06-08", "2025-07-07", "2025-07-25"},
+		{"账单日后18天跨月", Rule{BillingDay: 28, DueAfterDays: 18}, "2025-01-20", "2024-12-29", "2025-01-28", "2025-02-15"},
+		{"账单日后18天且账单日按月末", Rule{BillingDay: 31, DueAfterDays: 18}, "2025-02-15", "2025-02-01", "2025-02-28", "2025-03-18"},
+
+		// 账单日当天的消费计入当天出账的账期，次日进入下一期
+		{"账单日当天", Rule{BillingDay: 15, PaymentDueDay: 5}, "2025-06-15", "2025-05-16", "2025-06-15", "2025-07-05"},
+		{"账单日次日", Rule{BillingDay: 15, PaymentDueDay: 5}, "2025-06-16", "2025-06-16", "2025-07-15", "2025-08-05"},
+		{"账单日当天且按月末", Rule{BillingDay: 31, PaymentDueDay: 20}, "2025-04-30", "2025-04-01", "2025-04-30", "2025-05-20"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := tc.rule.PeriodContaining(date(tc.day))
+			if got := fmtDate(p.Start); got != tc.start {
+				t.Errorf("Start = %s, want %s", got, tc.start)
+			}
+			if got := fmtDate(p.End); got != tc.end {
+				t.Errorf("End = %s, want %s", got, tc.end)
+			}
+			if got := fmtDate(p.Due); got != tc.due {
+				t.Errorf("Due = %s, want %s", got, tc.due)
+			}
+		})
+	}
+}
+
+func TestNextDueDate(t *testing.T) {
+	cases := []struct {
+		name  string
+		rule  Rule
+		today string
+		want  string // 为空表示无法推算
+	}{
+		{"账单日当天上期已过还款日", Rule{BillingDay: 15, PaymentDueDay: 5}, "2025-06-15", "2025-07-05"},
+		{"上期还款日未到", Rule{BillingDay: 15, PaymentDueDay: 5}, "2025-06-03", "2025-06-05"},
+		{"还款日当天", Rule{BillingDay: 15, PaymentDueDay: 5}, "2025-07-05", "2025-07-05"},
+		{"还款日次日", Rule{BillingDay: 15, PaymentDueDay: 5}, "2025-07-06", "2025-08-05"},
+		{"账单日后18天", Rule{BillingDay: 7, DueAfterDays: 18}, "2025-07-20", "2025-07-25"},
+		{"账单日后18天已过", Rule{BillingDay: 7, DueAfterDays: 18}, "2025-07-26", "2025-08-25"},
+		{"账单日31号还款日为账单日后20天", Rule{BillingDay: 31, DueAfterDays: 20}, "2025-03-10", "2025-03-20"},
+		{"只有还款日31号在2月", Rule{PaymentDueDay: 31}, "2025-02-10", "2025-02-28"},
+		{"只有还款日已过", Rule{PaymentDueDay: 31}, "2025-03-01", "2025-03-31"},
+		{"没有账单日不能按N天推算", Rule{DueAfterDays: 18}, "2025-03-01", ""},
+		{"未设置", Rule{}, "2025-03-01", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			due, ok := tc.rule.NextDueDate(date(tc.today))
+			if tc.want == "" {
+				if ok {
+					t.Errorf("NextDueDate = %s, want 无法推算", fmtDate(due))
+				}
+				return
+			}
+			if !ok || fmtDate(due) != tc.want {
+				t.Errorf("NextDueDate = %s (%v), want %s", fmtDate(due), ok, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsStatementDate(t *testing.T) {
+	cases := []struct {
+		rule Rule
+		day  string
+		want bool
+	}{
+		{Rule{BillingDay: 31}, "2025-02-28", true},
+		{Rule{BillingDay: 31}, "2024-02-28", false},
+		{Rule{BillingDay: 31}, "2024-02-29", true},
+		{Rule{BillingDay: 31}, "2025-04-30", true},
+		{Rule{BillingDay: 31}, "2025-03-30", false},
+		{Rule{BillingDay: 15}, "2025-03-15", true},
+		{Rule{}, "2025-03-15", false},
+	}
+	for _, tc := range cases {
+		if got := tc.rule.IsStatementDate(date(tc.day)); got != tc.want {
+			t.Errorf("Rule{BillingDay: %d}.IsStatementDate(%s) = %v, want %v", tc.rule.BillingDay, tc.day, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────
+// 卡面图片 Blob 存储
+//
+// 图片由客户端加密后上传，服务器按内容的 SHA-256 存放在 DATA_DIR/blobs/ab/abcdef... ，
+// 不解密也不改写。卡片只保存图片哈希，同步时客户端按需下载自己没有的 blob。
+// blobs 表记录每个 blob 属于哪些用户，下载时据此校验权限。
+// ─────────────────────────────────────────
+
+// 单个 blob 最大 20MB
+const maxBlobSize = 20 << 20
+
+var blobRoot string
+
+func initBlobStore() {
+	blobRoot = filepath.Join(dataDir, "blobs")
+	if err := os.MkdirAll(blobRoot, 0755); err != nil {
+		log.Fatal("创建blob目录失败:", err)
+	}
+}
+
+// migrateInlineImages 把旧版本直接存在 cards 表里的图片搬到 blob 存储（由迁移调用）
+func migrateInlineImages(tx *sql.Tx) error {
+	type inlineRow struct {
+		syncID, userID, front, back string
+	}
+	rows, err := tx.Query(`
+		SELECT sync_id, user_id, COALESCE(card_front_image, ''), COALESCE(card_back_image, '')
+		FROM cards WHERE COALESCE(card_front_image, '') != '' OR COALESCE(card_back_image, '') != ''`)
+	if err != nil {
+		return err
+	}
+	var pending []inlineRow
+	for rows.Next() {
+		var r inlineRow
+		if err := rows.Scan(&r.syncID, &r.userID, &r.front, &r.back); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, r)
+	}
+	rows.Close()
+
+	for _, r := range pending {
+		card := Card{SyncID: r.syncID, CardFrontImage: r.front, CardBackImage: r.back}
+		if err := storeInlineImages(tx, r.userID, &card); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			UPDATE cards SET card_front_image_hash = ?, card_back_image_hash = ?,
+				card_front_image = '', card_back_image = ''
+			WHERE sync_id = ? AND user_id = ?`, card.CardFrontImageHash, card.CardBackImageHash, r.syncID, r.userID)
+		if err != nil {
+			return err
+		}
+	}
+	if len(pending) > 0 {
+		log.Printf("[blobs] 已迁移 %d 张卡片的图片到blob存储", len(pending))
+	}
+	return nil
+}
+
+// ─────────────────────────────────────────
+// 存取
+// ─────────────────────────────────────────
+
+// errInvalidBlobRef 卡片引用的图片哈希格式不对，或不是该用户上传的 blob
+var errInvalidBlobRef = errors.New("卡片引用的图片不存在")
+
+// blobPath blob 在磁盘上的位置，哈希不合法时返回 false（哈希来自客户端，不能直接拼进路径）
+func blobPath(hash string) (string, bool) {
+	if !isValidBlobHash(hash) {
+		return "", false
+	}
+	return filepath.Join(blobRoot, hash[:2], hash), true
+}
+
+func isValidBlobHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// putBlob 保存 blob 并登记归属，返回内容哈希
+func putBlob(ex execer, userID string, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	path, _ := blobPath(hash)
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return "", err
+		}
+		// 先写临时文件再改名，避免并发读取到半个文件
+		tmp, err := os.CreateTemp(filepath.Dir(path), hash+".tmp*")
+		if err != nil {
+			return "", err
+		}
+		if _, err := tmp.Write(data); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return "", err
+		}
+		if err := tmp.Close(); err != nil {
+			os.Remove(tmp.Name())
+			return "", err
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			os.Remove(tmp.Name())
+			return "", err
+		}
+	}
+
+	_, err := ex.Exec(`INSERT OR IGNORE INTO blobs (hash, user_id, size, created_at) VALUES (?, ?, ?, ?)`,
+		hash, userID, len(data), time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+func userHasBlob(userID, hash string) bool {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM blobs WHERE hash = ? AND user_id = ?`, hash, userID).Scan(&n)
+	return err == nil && n > 0
+}
+
+// checkCardBlobs 卡片只能引用自己上传过的 blob，否则同步一个别人的哈希就能下载到别人的图片
+func checkCardBlobs(userID string, card *Card) error {
+	for _, hash := range []string{card.CardFrontImageHash, card.CardBackImageHash} {
+		if hash == "" {
+			continue
+		}
+		if !isValidBlobHash(hash) || !userHasBlob(userID, hash) {
+			return fmt.Errorf("%w: %s", errInvalidBlobRef, truncate(hash, 64))
+		}
+	}
+	return nil
+}
+
+// storeInlineImages 旧客户端直接在卡片里提交图片内容，转存为 blob 后只保留哈希
+func storeInlineImages(ex execer, userID string, card *Card) error {
+	if card.CardFrontImage != "" {
+		hash, err := putBlob(ex, userID, []byte(card.CardFrontImage))
+		if err != nil {
+			return err
+		}
+		card.CardFrontImageHash = hash
+		card.CardFrontImage = ""
+	}
+	if card.CardBackImage != "" {
+		hash, err := putBlob(ex, userID, []byte(card.CardBackImage))
+		if err != nil {
+			return err
+		}
+		card.CardBackImageHash = hash
+		card.CardBackImage = ""
+	}
+	return nil
+}
+
+// inlineCardImages 为不支持 blob 的客户端把图片内容填回卡片
+func inlineCardImages(cards []Card) {
+	read := func(hash string) string {
+		if hash == "" {
+			return ""
+		}
+		path, ok := blobPath(hash)
+		if !ok {
+			log.Printf("[blobs] 忽略无效的blob哈希: %q", truncate(hash, 64))
+			return ""
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("[blobs] 读取blob(%s)失败: %v", hash, err)
+			return ""
+		}
+		return string(data)
+	}
+	for i := range cards {
+		cards[i].CardFrontImage = read(cards[i].CardFrontImageHash)
+		cards[i].CardBackImage = read(cards[i].CardBackImageHash)
+	}
+}
+
+// missingBlobs 返回卡片引用、但客户端声明自己没有的 blob 哈希
+func missingBlobs(cards []Card, known []string) []string {
+	have := make(map[string]bool, len(known))
+	for _, h := range known {
+		have[h] = true
+	}
+	missing := []string{}
+	for _, card := range cards {
+		for _, h := range []string{card.CardFrontImageHash, card.CardBackImageHash} {
+			if h != "" && !have[h] {
+				have[h] = true
+				missing = append(missing, h)
+			}
+		}
+	}
+	return missing
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：/api/v1/blobs
+// ─────────────────────────────────────────
+
+// handleUploadBlob 上传加密后的图片（请求体为原始字节），返回内容哈希
+func handleUploadBlob(c *gin.Context) {
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxBlobSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(data) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "内容为空"})
+		return
+	}
+	if len(data) > maxBlobSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("文件不能超过 %dMB", maxBlobSize>>20)})
+		return
+	}
+
+	hash, err := putBlob(db, currentUserID(c), data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"hash": hash,
+			"size": len(data),
+		},
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleDownloadBlob 下载 blob，支持 Range 断点续传
+func handleDownloadBlob(c *gin.Context) {
+	hash := c.Param("hash")
+	path, ok := blobPath(hash)
+	if !ok || !userHasBlob(currentUserID(c), hash) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在"})
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在"})
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 内容寻址，内容永不改变
+	c.Header("ETag", `"`+hash+`"`)
+	c.Header("Cache-Control", "private, max-age=31536000, immutable")
+	c.Header("Content-Type", "application/octet-stream")
+	http.ServeContent(c.Writer, c.Request, "", info.ModTime(), f)
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"card-server/billingcycle"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────
+// 日历订阅（iCalendar，RFC 5545）
+//
+// GET /api/v1/calendar.ics?token=... 输出用户的账单日和还款日，供手机日历订阅：
+//   - 每张卡片的账单日、还款日各是一个每月重复的全天事件。日期大于 28 时用
+//     BYMONTHDAY=28,...,N;BYSETPOS=-1，即“当月有 N 号取 N 号，否则取月末”
+//   - 还款日为账单日后 N 天的卡片（见 billingcycle 包）无法用 RRULE 表达，
+//     改为输出前后一年每一期的单独事件
+//   - 已入库账单的还款日是单独的事件，描述里写明应还金额和还款状态；
+//     同一张卡当月的卡片还款日用 EXDATE 去掉（或不输出），避免出现两次
+// 日历应用无法携带登录令牌，订阅地址里带一个每个用户独立的密钥，服务器只存哈希，
+// 地址只在生成时返回一次；重新生成即作废旧地址。请求日志会隐去密钥（见 requestLogFormatter）。
+// ─────────────────────────────────────────
+
+// CalendarFeed 日历订阅状态
+type CalendarFeed struct {
+	Enabled      bool   `json:"enabled"`
+	CreatedAt    int64  `json:"createdAt,omitempty"`
+	LastAccessAt int64  `json:"lastAccessAt,omitempty"` // 日历应用最近一次拉取
+	URL          string `json:"url,omitempty"`          // 仅在生成时返回
+}
+
+const (
+	calendarPath = "/api/v1/calendar.ics"
+	// 建议日历应用的刷新间隔
+	calendarRefresh = "PT6H"
+	// 输出多久以前到期的账单
+	calendarBillMonths = 12
+	// 账单日后 N 天还款的卡片，输出未来多少期
+	calendarFutureCycles = 12
+)
+
+// billStatusText 账单状态的中文说明
+var billStatusText = map[string]string{
+	billStatusUnpaid:        "未还款",
+	billStatusPartiallyPaid: "部分还款",
+	billStatusPaid:          "已还清",
+	billStatusOverdue:       "已逾期",
+}
+
+// ─────────────────────────────────────────
+// 生成
+// ─────────────────────────────────────────
+
+// icsWriter 按 RFC 5545 输出内容行：CRLF 换行，每行不超过 75 字节（不拆开 UTF-8 字符）
+type icsWriter struct {
+	b strings.Builder
+}
+
+func (w *icsWriter) line(s string) {
+	limit := 75
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && s[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		w.b.WriteString(s[:cut] + "\r\n ")
+		s = s[cut:]
+		limit = 74 // 续行开头的空格占一个字节
+	}
+	w.b.WriteString(s + "\r\n")
+}
+
+// prop 输出 TEXT 类型的属性
+func (w *icsWriter) prop(name, text string) {
+	w.line(name + ":" + icsEscape(text))
+}
+
+// icsEscape 转义 TEXT 值中的反斜杠、分号、逗号和换行
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+func icsDate(t time.Time) string {
+	return t.Format("20060102")
+}
+
+// monthlyRule 每月 day 号重复的 RRULE，当月没有该日时落在月末
+func monthlyRule(day int) string {
+	if day <= 28 {
+		return fmt.Sprintf("FREQ=MONTHLY;BYMONTHDAY=%d", day)
+	}
+	days := make([]string, 0, 4)
+	for d := 28; d <= day; d++ {
+		days = append(days, fmt.Sprint(d))
+	}
+	return "FREQ=MONTHLY;BYMONTHDAY=" + strings.Join(days, ",") + ";BYSETPOS=-1"
+}
+
+// cardSeriesStart 卡片重复事件的起始月份：卡片创建的月份，最早不超过一年前
+func cardSeriesStart(card Card, now time.Time) (int, time.Month) {
+	earliest := time.Date(now.Year()-1, now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	created := card.CreatedAt
+	if created > 1e11 { // 客户端同步上来的毫秒时间戳
+		created /= 1000
+	}
+	start := time.Unix(created, 0).UTC()
+	if created <= 0 || start.Before(earliest) || start.After(now) {
+		start = earliest
+	}
+	return start.Year(), start.Month()
+}
+
+// buildCalendar 生成用户的日历
+func buildCalendar(userID string, now time.Time) (string, error) {
+	cardList := getCardsAll(userID)
+	sort.Slice(cardList, func(i, j int) bool { return cardList[i].SyncID < cardList[j].SyncID })
+	cards := map[string]Card{}
+	for _, card := range cardList {
+		cards[card.SyncID] = card
+	}
+
+	rows, err := db.Query(`SELECT `+billColumns+` FROM bill_statements
+		WHERE user_id = ? AND due_date != '' AND due_date >= ? ORDER BY due_date, id`,
+		userID, now.AddDate(0, -calendarBillMonths, 0).Format("2006-01-02"))
+	if err != nil {
+		return "", err
+	}
+	var bills []BillStatement
+	for rows.Next() {
+		bs, err := scanBill(rows)
+		if err != nil {
+			rows.Close()
+			return "", err
+		}
+		bills = append(bills, bs)
+	}
+	rows.Close()
+	if err := attachBillDetails(userID, bills); err != nil {
+		return "", err
+	}
+	dueAfter, err := loadDueAfterDays(userID)
+	if err != nil {
+		return "", err
+	}
+
+	stamp := now.UTC().Format("20060102T150405Z")
+	var w icsWriter
+	w.line("BEGIN:VCALENDAR")
+	w.line("VERSION:2.0")
+	w.line("PRODID:-//creditCardManage//card-server//ZH")
+	w.line("CALSCALE:GREGORIAN")
+	w.line("METHOD:PUBLISH")
+	w.prop("X-WR-CALNAME", "信用卡账单与还款")
+	w.line("REFRESH-INTERVAL;VALUE=DURATION:" + calendarRefresh)
+	w.line("X-PUBLISHED-TTL:" + calendarRefresh)
+
+	// 已有账单的还款日，对应月份的卡片还款日要排除
+	billedDues := map[string][]string{}
+	billedMonths := map[string]bool{} // cardSyncId + YYYY-MM
+	for _, bs := range bills {
+		due, err := time.Parse("2006-01-02", bs.DueDate)
+		if err != nil {
+			continue
+		}
+		billedMonths[bs.CardSyncID+bs.DueDate[:7]] = true
+		label := bs.Bank
+		if card, ok := cards[bs.CardSyncID]; ok {
+			label = cardLabel(card)
+			if card.PaymentDueDay > 0 {
+				ex := billingcycle.DayInMonth(due.Year(), due.Month(), card.PaymentDueDay)
+				billedDues[card.SyncID] = append(billedDues[card.SyncID], icsDate(ex))
+			}
+		}
+
+		summary := fmt.Sprintf("%s 还款 %.2f %s", label, bs.Amount, bs.Currency)
+		if bs.Status == billStatusPaid {
+			summary += "（已还清）"
+		}
+		w.line("BEGIN:VEVENT")
+		w.line(fmt.Sprintf("UID:bill-%d@card-server", bs.ID))
+		w.line("DTSTAMP:" + stamp)
+		w.line("DTSTART;VALUE=DATE:" + icsDate(due))
+		w.line("DTEND;VALUE=DATE:" + icsDate(due.AddDate(0, 0, 1)))
+		w.prop("SUMMARY", summary)
+		w.prop("DESCRIPTION", billDescription(bs))
+		w.line("TRANSP:TRANSPARENT")
+		w.line("END:VEVENT")
+	}
+
+	for _, card := range cardList {
+		label := cardLabel(card)
+		year, month := cardSeriesStart(card, now)
+		if card.BillingDay > 0 {
+			start := billingcycle.DayInMonth(year, month, card.BillingDay)
+			w.line("BEGIN:VEVENT")
+			w.line("UID:card-" + card.SyncID + "-billing@card-server")
+			w.line("DTSTAMP:" + stamp)
+			w.line("DTSTART;VALUE=DATE:" + icsDate(start))
+			w.line("DTEND;VALUE=DATE:" + icsDate(start.AddDate(0, 0, 1)))
+			w.line("RRULE:" + monthlyRule(card.BillingDay))
+			w.prop("SUMMARY", label+" 账单日")
+			w.prop("DESCRIPTION", fmt.Sprintf("每月 %d 号出账（当月没有该日时为月末）", card.BillingDay))
+			w.line("TRANSP:TRANSPARENT")
+			w.line("END:VEVENT")
+		}
+		rule := cardCycleRule(card, dueAfter)
+		if rule.DueAfterDays > 0 && rule.HasStatement() {
+			last := billingcycle.DateOnly(now).AddDate(0, calendarFutureCycles, 0)
+			for m := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC); !m.After(last); m = m.AddDate(0, 1, 0) {
+				due := rule.Period(m.Year(), m.Month()).Due
+				if billedMonths[card.SyncID+due.Format("2006-01")] {
+					continue
+				}
+				w.line("BEGIN:VEVENT")
+				w.line("UID:card-" + card.SyncID + "-due-" + m.Format("200601") + "@card-server")
+				w.line("DTSTAMP:" + stamp)
+				w.line("DTSTART;VALUE=DATE:" + icsDate(due))
+				w.line("DTEND;VALUE=DATE:" + icsDate(due.AddDate(0, 0, 1)))
+				w.prop("SUMMARY", label+" 还款日")
+				w.prop("DESCRIPTION", fmt.Sprintf("账单日后 %d 天还款。本期账单尚未获取，请留意应还金额。", rule.DueAfterDays))
+				w.line("TRANSP:TRANSPARENT")
+				w.line("END:VEVENT")
+			}
+		} else if card.PaymentDueDay > 0 {
+			start := billingcycle.DayInMonth(year, month, card.PaymentDueDay)
+			w.line("BEGIN:VEVENT")
+			w.line("UID:card-" + card.SyncID + "-due@card-server")
+			w.line("DTSTAMP:" + stamp)
+			w.line("DTSTART;VALUE=DATE:" + icsDate(start))
+			w.line("DTEND;VALUE=DATE:" + icsDate(start.AddDate(0, 0, 1)))
+			w.line("RRULE:" + monthlyRule(card.PaymentDueDay))
+			for _, ex := range billedDues[card.SyncID] {
+				w.line("EXDATE;VALUE=DATE:" + ex)
+			}
+			w.prop("SUMMARY", label+" 还款日")
+			w.prop("DESCRIPTION", fmt.Sprintf("每月 %d 号还款（当月没有该日时为月末）。本期账单尚未获取，请留意应还金额。", card.PaymentDueDay))
+			w.line("TRANSP:TRANSPARENT")
+			w.line("END:VEVENT")
+		}
+	}
+
+	w.line("END:VCALENDAR")
+	return w.b.String(), nil
+}
+
+// billDescription 账单还款事件的描述
+func billDescription(bs BillStatement) string {
+	lines := []string{}
+	if bs.BillDate != "" {
+		lines = append(lines, "账单日："+bs.BillDate)
+	}
+	lines = append(lines, "还款日："+bs.DueDate)
+	for _, a := range bs.Amounts {
+		s := fmt.Sprintf("应还：%.2f %s", a.Amount, a.Currency)
+		if a.MinPayment > 0 {
+			s += fmt.Sprintf("（最低还款 %.2f）", a.MinPayment)
+		}
+		lines = append(lines, s)
+	}
+	if bs.CNYTotal != nil && len(bs.Amounts) > 1 {
+		lines = append(lines, fmt.Sprintf("折合人民币：%.2f CNY", *bs.CNYTotal))
+	}
+	if bs.PaidAmount > 0 {
+		lines = append(lines, fmt.Sprintf("已还：%.2f %s", bs.PaidAmount, bs.Currency))
+	}
+	if s, ok := billStatusText[bs.Status]; ok {
+		lines = append(lines, "状态："+s)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler
+// ─────────────────────────────────────────
+
+// handleCalendarFeed GET /api/v1/calendar.ics?token=...（无需登录，凭订阅密钥访问）
+func handleCalendarFeed(c *gin.Context) {
+	token := c.Query("token")
+	var userID string
+	err := db.QueryRow(`SELECT user_id FROM calendar_feeds WHERE token_hash = ?`, hashToken(token)).Scan(&userID)
+	if token == "" || err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "订阅地址无效或已重新生成"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	ics, err := buildCalendar(userID, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := db.Exec(`UPDATE calendar_feeds SET last_access_at = ? WHERE user_id = ?`, now.Unix(), userID); err != nil {
+		log.Printf("[calendar] 更新访问时间失败: %v", err)
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(ics))
+}
+
+// handleGetCalendarFeed GET /api/v1/calendar/feed
+func handleGetCalendarFeed(c *gin.Context) {
+	var feed CalendarFeed
+	err := db.QueryRow(`SELECT COALESCE(created_at, 0), last_access_at FROM calendar_feeds WHERE user_id = ?`, currentUserID(c)).
+		Scan(&feed.CreatedAt, &feed.LastAccessAt)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	feed.Enabled = err == nil
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      feed,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleCreateCalendarFeed POST /api/v1/calendar/feed
+// 生成新的订阅地址（已有时作废旧地址），地址只在此处返回一次。
+func handleCreateCalendarFeed(c *gin.Context) {
+	token, err := randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	feed := CalendarFeed{Enabled: true, CreatedAt: time.Now().Unix()}
+	_, err = db.Exec(`
+		INSERT INTO calendar_feeds (user_id, token_hash, created_at, last_access_at) VALUES (?, ?, ?, 0)
+		ON CONFLICT(user_id) DO UPDATE SET
+			token_hash = excluded.token_hash, created_at = excluded.created_at, last_access_at = 0
+	`, currentUserID(c), hashToken(token), feed.CreatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	feed.URL = requestBaseURL(c) + calendarPath + "?token=" + token
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      feed,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleDeleteCalendarFeed DELETE /api/v1/calendar/feed 停用订阅
+func handleDeleteCalendarFeed(c *gin.Context) {
+	res, err := db.Exec(`DELETE FROM calendar_feeds WHERE user_id = ?`, currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "未开启日历订阅"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "timestamp": time.Now().Unix()})
+}
+
+// requestBaseURL 客户端访问服务器使用的地址（经反向代理时取 X-Forwarded-Proto/Host）
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if p := c.GetHeader("X-Forwarded-Proto"); p == "http" || p == "https" {
+		scheme = p
+	}
+	host := c.Request.Host
+	if h := c.GetHeader("X-Forwarded-Host"); h != "" {
+		host = strings.TrimSpace(strings.Split(h, ",")[0])
+	}
+	return scheme + "://" + host
+}
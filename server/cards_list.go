@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────
+// GET /api/v1/cards 分页、筛选、排序
+//
+// 查询参数：
+//   limit           每页条数（不传则返回全部，兼容旧客户端的"恢复"功能）
+//   cursor          上一页返回的 nextCursor
+//   bank, owner     精确匹配
+//   billingDayFrom / billingDayTo, dueDayFrom / dueDayTo   日期范围（含边界）
+//   sort            updatedAt(默认) / createdAt / name / bank / billingDay / paymentDueDay
+//   order           desc(默认) / asc
+//   includeImages   false 时只返回图片哈希，不内嵌图片内容
+// ─────────────────────────────────────────
+
+const maxCardPageSize = 200
+
+// cardSortKey 允许排序的字段
+type cardSortKey struct {
+	column string
+	value  func(card Card) any
+}
+
+var cardSortKeys = map[string]cardSortKey{
+	"updatedAt":     {"updated_at", func(card Card) any { return card.UpdatedAt }},
+	"createdAt":     {"created_at", func(card Card) any { return card.CreatedAt }},
+	"name":          {"name", func(card Card) any { return card.Name }},
+	"bank":          {"bank", func(card Card) any { return card.Bank }},
+	"billingDay":    {"billing_day", func(card Card) any { return card.BillingDay }},
+	"paymentDueDay": {"payment_due_day", func(card Card) any { return card.PaymentDueDay }},
+}
+
+// cardListQuery 解析后的列表查询参数
+type cardListQuery struct {
+	limit         int
+	after         *cardPageCursor
+	bank          string
+	owner         string
+	billingFrom   int
+	billingTo     int
+	dueFrom       int
+	dueTo         int
+	sort          string
+	desc          bool
+	includeImages bool
+}
+
+// cardPageCursor 键集分页游标：上一页最后一条的排序值 + sync_id（保证排序稳定）
+type cardPageCursor struct {
+	Value  any    `json:"v"`
+	SyncID string `json:"id"`
+}
+
+func parseCardListQuery(c *gin.Context) (cardListQuery, error) {
+	q := cardListQuery{
+		bank:          c.Query("bank"),
+		owner:         c.Query("owner"),
+		sort:          c.DefaultQuery("sort", "updatedAt"),
+		desc:          c.DefaultQuery("order", "desc") != "asc",
+		includeImages: c.Query("includeImages") != "false",
+	}
+	if _, ok := cardSortKeys[q.sort]; !ok {
+		return q, fmt.Errorf("不支持的排序字段: %s", q.sort)
+	}
+
+	var err error
+	if q.limit, err = queryInt(c, "limit", 0, maxCardPageSize); err != nil {
+		return q, err
+	}
+	if q.billingFrom, err = queryInt(c, "billingDayFrom", 1, 31); err != nil {
+		return q, err
+	}
+	if q.billingTo, err = queryInt(c, "billingDayTo", 1, 31); err != nil {
+		return q, err
+	}
+	if q.dueFrom, err = queryInt(c, "dueDayFrom", 1, 31); err != nil {
+		return q, err
+	}
+	if q.dueTo, err = queryInt(c, "dueDayTo", 1, 31); err != nil {
+		return q, err
+	}
+
+	if raw := c.Query("cursor"); raw != "" {
+		data, err := base64.RawURLEncoding.DecodeString(raw)
+		var cur cardPageCursor
+		if err == nil {
+			err = json.Unmarshal(data, &cur)
+		}
+		if err != nil {
+			return q, fmt.Errorf("无效的分页游标")
+		}
+		q.after = &cur
+	}
+	return q, nil
+}
+
+// queryInt 读取整数参数，未传时返回 0
+func queryInt(c *gin.Context, name string, min, max int) (int, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("参数 %s 应为 %d-%d 之间的整数", name, min, max)
+	}
+	return n, nil
+}
+
+// sql 生成查询语句；多取一条用于判断是否还有下一页
+func (q cardListQuery) sql(userID string) (string, []any) {
+	where := []string{"is_deleted = 0", "user_id = ?"}
+	args := []any{userID}
+	addFilter := func(cond string, v any) {
+		where = append(where, cond)
+		args = append(args, v)
+	}
+	if q.bank != "" {
+		addFilter("bank = ?", q.bank)
+	}
+	if q.owner != "" {
+		addFilter("owner = ?", q.owner)
+	}
+	if q.billingFrom > 0 {
+		addFilter("billing_day >= ?", q.billingFrom)
+	}
+	if q.billingTo > 0 {
+		addFilter("billing_day <= ?", q.billingTo)
+	}
+	if q.dueFrom > 0 {
+		addFilter("payment_due_day >= ?", q.dueFrom)
+	}
+	if q.dueTo > 0 {
+		addFilter("payment_due_day <= ?", q.dueTo)
+	}
+
+	col := cardSortKeys[q.sort].column
+	dir, cmp := "ASC", ">"
+	if q.desc {
+		dir, cmp = "DESC", "<"
+	}
+	if q.after != nil {
+		where = append(where, fmt.Sprintf("(%s %s ? OR (%s = ? AND sync_id %s ?))", col, cmp, col, cmp))
+		args = append(args, q.after.Value, q.after.Value, q.after.SyncID)
+	}
+
+	query := `
+		SELECT id, sync_id, name, bank, card_number, cvv, expiry_date,
+		       cardholder_name, credit_limit, billing_day, payment_due_day,
+		       color, card_front_image_hash, card_back_image_hash, notes, iv, owner, last_four,
+		       is_deleted, created_at, updated_at, version
+		FROM cards WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY ` + col + ` ` + dir + `, sync_id ` + dir
+	if q.limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.limit+1)
+	}
+	return query, args
+}
+
+// nextCursor 根据本页最后一条生成下一页游标
+func (q cardListQuery) nextCursor(last Card) string {
+	data, _ := json.Marshal(cardPageCursor{Value: cardSortKeys[q.sort].value(last), SyncID: last.SyncID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────
+// 消费分类
+//
+// 交易按商户名归类，优先级依次为：
+//  1. 用户对某个商户手动指定的分类（merchant_categories，改一笔即记住该商户）
+//  2. 用户自己的规则（category_rules 中 user_id 为本人）
+//  3. 内置规则（category_rules 中 user_id 为空，由迁移写入）
+//
+// 同一层内按 priority 从高到低、关键词从长到短匹配，都不命中时归为 other。
+// 关键词规则不区分大小写做子串匹配，正则规则同样不区分大小写。
+// 分类在读取时计算，修改规则后历史交易的分类随之变化。
+// ─────────────────────────────────────────
+
+// spendingCategories 分类代码 → 名称（按展示顺序）
+var spendingCategories = []struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+}{
+	{"dining", "餐饮"},
+	{"groceries", "生鲜超市"},
+	{"shopping", "购物"},
+	{"travel", "旅行"},
+	{"transport", "交通出行"},
+	{"utilities", "生活缴费"},
+	{"entertainment", "休闲娱乐"},
+	{"health", "医疗健康"},
+	{"education", "教育"},
+	{"fee", "利息费用"},
+	{"repayment", "还款"},
+	{"other", "其他"},
+}
+
+const categoryOther = "other"
+
+// categoryRepayment 还款不是消费，不计入消费汇总
+const categoryRepayment = "repayment"
+
+func categoryName(code string) string {
+	for _, c := range spendingCategories {
+		if c.Code == code {
+			return c.Name
+		}
+	}
+	return ""
+}
+
+// CategoryRule 商户分类规则
+type CategoryRule struct {
+	ID        int64  `json:"id"`
+	Pattern   string `json:"pattern"` // 关键词或正则
+	IsRegex   bool   `json:"isRegex"`
+	Category  string `json:"category"` // 分类代码
+	Priority  int    `json:"priority"`
+	Builtin   bool   `json:"builtin"` // 内置规则只读
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// MerchantCategory 用户为某个商户指定的分类
+type MerchantCategory struct {
+	ID        int64  `json:"id"`
+	Merchant  string `json:"merchant"`
+	Category  string `json:"category"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+// merchantKey 商户名比较用的键：合并空白、统一大小写
+func merchantKey(merchant string) string {
+	return strings.ToUpper(collapseSpaces(merchant))
+}
+
+// ─────────────────────────────────────────
+// 分类器
+// ─────────────────────────────────────────
+
+type compiledCategoryRule struct {
+	CategoryRule
+	keyword string // 关键词规则：已转大写
+	re      *regexp.Regexp
+}
+
+func (r compiledCategoryRule) matches(key string) bool {
+	if r.re != nil {
+		return r.re.MatchString(key)
+	}
+	return strings.Contains(key, r.keyword)
+}
+
+// categorizer 一个用户的分类规则
+type categorizer struct {
+	overrides map[string]string // merchantKey → 分类
+	user      []compiledCategoryRule
+	builtin   []compiledCategoryRule
+}
+
+func (c *categorizer) classify(merchant string) string {
+	key := merchantKey(merchant)
+	if cat, ok := c.overrides[key]; ok {
+		return cat
+	}
+	for _, rules := range [][]compiledCategoryRule{c.user, c.builtin} {
+		for _, r := range rules {
+			if r.matches(key) {
+				return r.Category
+			}
+		}
+	}
+	return categoryOther
+}
+
+// compileCategoryRule 校验并编译规则
+func compileCategoryRule(rule CategoryRule) (compiledCategoryRule, error) {
+	cr := compiledCategoryRule{CategoryRule: rule}
+	if strings.TrimSpace(rule.Pattern) == "" {
+		return cr, fmt.Errorf("关键词不能为空")
+	}
+	if categoryName(rule.Category) == "" {
+		return cr, fmt.Errorf("未知分类: %s", rule.Category)
+	}
+	if rule.IsRegex {
+		re, err := regexp.Compile("(?i)" + rule.Pattern)
+		if err != nil {
+			return cr, fmt.Errorf("正则无效: %w", err)
+		}
+		cr.re = re
+	} else {
+		cr.keyword = merchantKey(rule.Pattern)
+	}
+	return cr, nil
+}
+
+// loadCategorizer 读取用户的商户分类和规则（含内置规则）
+func loadCategorizer(userID string) (*categorizer, error) {
+	c := &categorizer{overrides: map[string]string{}}
+
+	rows, err := db.Query(`SELECT merchant_key, category FROM merchant_categories WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var key, cat string
+		if err := rows.Scan(&key, &cat); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		c.overrides[key] = cat
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rules, err := loadCategoryRules(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		cr, err := compileCategoryRule(rule)
+		if err != nil {
+			log.Printf("[spending] 分类规则(%d)无效，已跳过: %v", rule.ID, err)
+			continue
+		}
+		if rule.Builtin {
+			c.builtin = append(c.builtin, cr)
+		} else {
+			c.user = append(c.user, cr)
+		}
+	}
+	for _, rules := range [][]compiledCategoryRule{c.user, c.builtin} {
+		sort.SliceStable(rules, func(i, j int) bool {
+			if rules[i].Priority != rules[j].Priority {
+				return rules[i].Priority > rules[j].Priority
+			}
+			return len(rules[i].Pattern) > len(rules[j].Pattern)
+		})
+	}
+	return c, nil
+}
+
+// ─────────────────────────────────────────
+// 读写
+// ─────────────────────────────────────────
+
+// loadCategoryRules 读取用户规则和内置规则
+func loadCategoryRules(userID string) ([]CategoryRule, error) {
+	rows, err := db.Query(`
+		SELECT id, pattern, is_regex, category, priority, user_id = '', created_at
+		FROM category_rules
+		WHERE user_id = ? OR user_id = ''
+		ORDER BY user_id = '', id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []CategoryRule
+	for rows.Next() {
+		var r CategoryRule
+		var isRegex, builtin int
+		if err := rows.Scan(&r.ID, &r.Pattern, &isRegex, &r.Category, &r.Priority, &builtin, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		r.IsRegex, r.Builtin = isRegex != 0, builtin != 0
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// bindCategoryRule 读取请求体中的规则并校验
+func bindCategoryRule(c *gin.Context) (CategoryRule, bool) {
+	var req struct {
+		Pattern  string `json:"pattern"`
+		IsRegex  bool   `json:"isRegex"`
+		Category string `json:"category"`
+		Priority int    `json:"priority"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return CategoryRule{}, false
+	}
+	rule := CategoryRule{
+		Pattern:  strings.TrimSpace(req.Pattern),
+		IsRegex:  req.IsRegex,
+		Category: req.Category,
+		Priority: req.Priority,
+	}
+	if _, err := compileCategoryRule(rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return rule, false
+	}
+	return rule, true
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：/api/v1/spending/categories、/api/v1/category-rules
+// ─────────────────────────────────────────
+
+func handleListSpendingCategories(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      spendingCategories,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleListCategoryRules(c *gin.Context) {
+	rules, err := loadCategoryRules(currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rules == nil {
+		rules = []CategoryRule{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      rules,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleCreateCategoryRule(c *gin.Context) {
+	rule, ok := bindCategoryRule(c)
+	if !ok {
+		return
+	}
+
+	rule.CreatedAt = time.Now().Unix()
+	res, err := db.Exec(`INSERT INTO category_rules (user_id, pattern, is_regex, category, priority, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		currentUserID(c), rule.Pattern, boolToInt(rule.IsRegex), rule.Category, rule.Priority, rule.CreatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	rule.ID, _ = res.LastInsertId()
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success":   true,
+		"data":      rule,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleUpdateCategoryRule 修改用户自己的规则（内置规则不可修改，可用更高优先级的个人规则覆盖）
+func handleUpdateCategoryRule(c *gin.Context) {
+	rule, ok := bindCategoryRule(c)
+	if !ok {
+		return
+	}
+
+	err := db.QueryRow(`SELECT id, created_at FROM category_rules WHERE id = ? AND user_id = ?`,
+		c.Param("id"), currentUserID(c)).Scan(&rule.ID, &rule.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "规则不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = db.Exec(`UPDATE category_rules SET pattern = ?, is_regex = ?, category = ?, priority = ? WHERE id = ?`,
+		rule.Pattern, boolToInt(rule.IsRegex), rule.Category, rule.Priority, rule.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      rule,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleDeleteCategoryRule(c *gin.Context) {
+	res, err := db.Exec(`DELETE FROM category_rules WHERE id = ? AND user_id = ?`, c.Param("id"), currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "规则不存在"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "timestamp": time.Now().Unix()})
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：商户分类
+//
+// PUT    /api/v1/transactions/:id/category  {"category":"dining"}  为该笔交易的商户指定分类
+// GET    /api/v1/merchant-categories
+// DELETE /api/v1/merchant-categories/:id                            恢复按规则分类
+// ─────────────────────────────────────────
+
+func handleSetTransactionCategory(c *gin.Context) {
+	var req struct {
+		Category string `json:"category"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if categoryName(req.Category) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "未知分类: " + req.Category})
+		return
+	}
+
+	userID := currentUserID(c)
+	var merchant string
+	err := db.QueryRow(`SELECT merchant FROM bill_transactions WHERE id = ? AND user_id = ?`, c.Param("id"), userID).Scan(&merchant)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "交易不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if merchantKey(merchant) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "该交易没有商户名称"})
+		return
+	}
+
+	mc := MerchantCategory{Merchant: collapseSpaces(merchant), Category: req.Category, UpdatedAt: time.Now().Unix()}
+	err = db.QueryRow(`
+		INSERT INTO merchant_categories (user_id, merchant_key, merchant, category, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, merchant_key) DO UPDATE SET
+			category = excluded.category,
+			updated_at = excluded.updated_at
+		RETURNING id
+	`, userID, merchantKey(merchant), mc.Merchant, mc.Category, mc.UpdatedAt).Scan(&mc.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      mc,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleListMerchantCategories(c *gin.Context) {
+	rows, err := db.Query(`
+		SELECT id, merchant, category, updated_at FROM merchant_categories
+		WHERE user_id = ?
+		ORDER BY merchant
+	`, currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	list := []MerchantCategory{}
+	for rows.Next() {
+		var mc MerchantCategory
+		if err := rows.Scan(&mc.ID, &mc.Merchant, &mc.Category, &mc.UpdatedAt); err != nil {
+			log.Printf("[spending] Scan失败: %v", err)
+			continue
+		}
+		list = append(list, mc)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      list,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleDeleteMerchantCategory(c *gin.Context) {
+	res, err := db.Exec(`DELETE FROM merchant_categories WHERE id = ? AND user_id = ?`, c.Param("id"), currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "商户分类不存在"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "timestamp": time.Now().Unix()})
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：GET /api/v1/spending/summary?month=2024-05
+//
+// 按交易日统计当月消费，分别按分类、卡片、持卡人汇总。还款不计入；退款为负数，冲减所在分类。
+// amount 只合计人民币交易，外币交易按币种合计在 foreign 中；cnyEquivalent 是按交易日汇率
+// 折合人民币后的合计（见 fx_rates.go），缺少汇率的外币不计入，币种列在 missingRates 中。
+// ─────────────────────────────────────────
+
+// spendingBucket 一个汇总维度下的一组
+type spendingBucket struct {
+	Key      string             `json:"key"`
+	Name     string             `json:"name"`
+	Owner    string             `json:"owner,omitempty"`    // 按卡片汇总时为卡片持有人
+	LastFour string             `json:"lastFour,omitempty"` // 按卡片汇总时为卡号尾号
+	Amount   float64            `json:"amount"`
+	Count    int                `json:"count"`
+	Foreign  map[string]float64 `json:"foreign,omitempty"`
+
+	CNYEquivalent float64 `json:"cnyEquivalent"`
+}
+
+// add 计入一笔交易，cny 为折合人民币金额（折算失败时为 0）
+func (b *spendingBucket) add(amount float64, currency string, cny float64) {
+	b.Count++
+	b.CNYEquivalent += cny
+	if currency == "CNY" {
+		b.Amount += amount
+		return
+	}
+	if b.Foreign == nil {
+		b.Foreign = map[string]float64{}
+	}
+	b.Foreign[currency] += amount
+}
+
+// spendingGroups 按 key 聚合，保持首次出现的顺序
+type spendingGroups struct {
+	index   map[string]int
+	buckets []*spendingBucket
+}
+
+func (g *spendingGroups) get(key string, init func() *spendingBucket) *spendingBucket {
+	if g.index == nil {
+		g.index = map[string]int{}
+	}
+	if i, ok := g.index[key]; ok {
+		return g.buckets[i]
+	}
+	b := init()
+	g.index[key] = len(g.buckets)
+	g.buckets = append(g.buckets, b)
+	return b
+}
+
+// sorted 按人民币金额从高到低，金额四舍五入到分
+func (g *spendingGroups) sorted() []*spendingBucket {
+	out := append([]*spendingBucket{}, g.buckets...)
+	for _, b := range out {
+		roundBucket(b)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].CNYEquivalent > out[j].CNYEquivalent })
+	return out
+}
+
+func roundBucket(b *spendingBucket) {
+	b.Amount = roundCents(b.Amount)
+	b.CNYEquivalent = roundCents(b.CNYEquivalent)
+	for cur, v := range b.Foreign {
+		b.Foreign[cur] = roundCents(v)
+	}
+}
+
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+func handleSpendingSummary(c *gin.Context) {
+	userID := currentUserID(c)
+	month := c.DefaultQuery("month", time.Now().Format("2006-01"))
+	if _, err := time.Parse("2006-01", month); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "month 格式应为 YYYY-MM"})
+		return
+	}
+
+	cat, err := loadCategorizer(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	fx, err := loadFXRates(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT t.trans_date, t.merchant, t.amount, t.currency, b.card_sync_id,
+		       COALESCE(k.name, ''), COALESCE(k.owner, ''), COALESCE(k.last_four, '')
+		FROM bill_transactions t
+		JOIN bill_statements b ON b.id = t.bill_id
+		LEFT JOIN cards k ON k.sync_id = b.card_sync_id AND k.user_id = b.user_id
+		WHERE t.user_id = ? AND t.trans_date LIKE ?
+	`, userID, month+"-%")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	total := &spendingBucket{Key: "total", Name: "合计"}
+	var byCategory, byCard, byOwner spendingGroups
+	missing := map[string]bool{}
+	for rows.Next() {
+		var date, merchant, currency, cardID, cardName, owner, lastFour string
+		var amount float64
+		if err := rows.Scan(&date, &merchant, &amount, &currency, &cardID, &cardName, &owner, &lastFour); err != nil {
+			log.Printf("[spending] Scan失败: %v", err)
+			continue
+		}
+		category := cat.classify(merchant)
+		if category == categoryRepayment {
+			continue
+		}
+
+		cny, ok := fx.toCNY(amount, currency, date)
+		if !ok {
+			missing[currency] = true
+		}
+
+		total.add(amount, currency, cny)
+		byCategory.get(category, func() *spendingBucket {
+			return &spendingBucket{Key: category, Name: categoryName(category)}
+		}).add(amount, currency, cny)
+		byCard.get(cardID, func() *spendingBucket {
+			return &spendingBucket{Key: cardID, Name: cardName, Owner: owner, LastFour: lastFour}
+		}).add(amount, currency, cny)
+		byOwner.get(owner, func() *spendingBucket {
+			return &spendingBucket{Key: owner, Name: owner}
+		}).add(amount, currency, cny)
+	}
+	roundBucket(total)
+
+	missingRates := []string{}
+	for cur := range missing {
+		missingRates = append(missingRates, cur)
+	}
+	sort.Strings(missingRates)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"month":      month,
+			"total":      total,
+			"byCategory": byCategory.sorted(),
+			"byCard":     byCard.sorted(),
+			"byOwner":    byOwner.sorted(),
+
+			"missingRates": missingRates,
+		},
+		"timestamp": time.Now().Unix(),
+	})
+}
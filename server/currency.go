@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"regexp"
+	"strings"
+)
+
+// ─────────────────────────────────────────
+// 多币种账单金额
+//
+// 双币卡的账单分别列出人民币和外币的应还金额，常见三种排版：
+//  1. HTML 表格一行一个币种（表头含“币种”和应还金额列）
+//  2. 正文按币种分段（“人民币账户……美元账户……”），每段各有应还/最低还款
+//  3. 同一行并列（“本期应还金额 RMB 1,000.00 USD 50.00”）
+//
+// 依次尝试，取到的币种都存入 bill_amounts；账单本身的 amount/currency 取人民币部分
+// （没有人民币时取第一个币种）。只识别出一个币种时只修正账单的 currency。
+// ─────────────────────────────────────────
+
+// BillAmount 账单中一个币种的应还金额
+type BillAmount struct {
+	Currency   string  `json:"currency"`
+	Amount     float64 `json:"amount"`
+	MinPayment float64 `json:"minPayment"`
+}
+
+// currencyWords 账单中的币种写法 → 币种代码
+var currencyWords = map[string]string{
+	"人民币": "CNY", "RMB": "CNY", "CNY": "CNY",
+	"美元": "USD", "USD": "USD",
+	"港币": "HKD", "港元": "HKD", "HKD": "HKD",
+	"欧元": "EUR", "EUR": "EUR",
+	"日元": "JPY", "JPY": "JPY",
+	"英镑": "GBP", "GBP": "GBP",
+}
+
+const reCurrencyWord = `人民币|美元|港币|港元|欧元|日元|英镑|RMB|CNY|USD|HKD|EUR|JPY|GBP`
+
+var (
+	// 币种分段标题：行首（允许“【”“一、”等少量前缀）的“美元账户”“人民币部分”等
+	reCurrencySection = regexp.MustCompile(`(?m)^[^\n\d]{0,6}?(` + reCurrencyWord + `)\s*(?:账户|账单|部分|结算)`)
+	// 紧跟币种的金额：“USD 12.00”“人民币：100.00”
+	reCurrencyAmount = regexp.MustCompile(`(` + reCurrencyWord + `)\s*[:：]?\s*([0-9][0-9,]*\.\d{2})`)
+	reCurrencyCell   = regexp.MustCompile(`(` + reCurrencyWord + `)`)
+	reAmountLabel    = regexp.MustCompile(`应还款额|账单金额|本期账单|本期应还|应还金额|总欠款|账单总额|还款总额`)
+	reMinPayLabel    = regexp.MustCompile(`最低还款|最低应还`)
+)
+
+// 金额表格中币种列的表头
+var amountCurrencyLabels = []string{"币种", "货币", "账户"}
+
+// currencyAmounts 按出现顺序收集各币种金额
+type currencyAmounts struct {
+	order []string
+	m     map[string]*BillAmount
+}
+
+func (ca *currencyAmounts) get(word string) *BillAmount {
+	cur := currencyWords[strings.ToUpper(word)]
+	if cur == "" {
+		cur = currencyWords[word]
+	}
+	if ca.m == nil {
+		ca.m = map[string]*BillAmount{}
+	}
+	if a, ok := ca.m[cur]; ok {
+		return a
+	}
+	a := &BillAmount{Currency: cur}
+	ca.m[cur] = a
+	ca.order = append(ca.order, cur)
+	return a
+}
+
+func (ca *currencyAmounts) list() []BillAmount {
+	var out []BillAmount
+	for _, cur := range ca.order {
+		out = append(out, *ca.m[cur])
+	}
+	return out
+}
+
+// extractCurrencyAmounts 识别各币种的应还金额，结果写入 pb.amounts
+func extractCurrencyAmounts(pb *parsedBill) {
+	var ca currencyAmounts
+	for _, t := range pb.tables {
+		tableCurrencyAmounts(t, &ca)
+	}
+	if len(ca.order) < 2 {
+		ca = sectionCurrencyAmounts(pb)
+	}
+	if len(ca.order) < 2 {
+		ca = inlineCurrencyAmounts(pb.body)
+	}
+
+	switch len(ca.order) {
+	case 0:
+	case 1:
+		pb.currency = ca.order[0]
+	default:
+		amounts := ca.list()
+		primary := amounts[0]
+		if a, ok := ca.m["CNY"]; ok {
+			primary = *a
+		}
+		pb.currency, pb.amount, pb.minPayment = primary.Currency, primary.Amount, primary.MinPayment
+		pb.amounts = amounts
+		return
+	}
+	pb.amounts = []BillAmount{{Currency: pb.currency, Amount: pb.amount, MinPayment: pb.minPayment}}
+}
+
+// tableCurrencyAmounts 表头含币种列和应还金额列、一行一个币种的表格（交易明细表除外）
+func tableCurrencyAmounts(t htmlTable, ca *currencyAmounts) {
+	for h, header := range t.rows {
+		curCol := headerColumn(header, amountCurrencyLabels)
+		amountCol := headerColumn(header, amountLabels)
+		if curCol < 0 || amountCol < 0 || headerColumn(header, txnDateLabels) >= 0 {
+			continue
+		}
+		minCol := headerColumn(header, minPayLabels)
+		for _, row := range t.rows[h+1:] {
+			word := firstGroup(reCurrencyCell, cellAt(row, curCol))
+			amount := firstGroup(reCellAmount, cellAt(row, amountCol))
+			if word == "" || amount == "" {
+				continue
+			}
+			a := ca.get(word)
+			a.Amount = parseAmount(amount)
+			if v := firstGroup(reCellAmount, cellAt(row, minCol)); v != "" {
+				a.MinPayment = parseAmount(v)
+			}
+		}
+		return
+	}
+}
+
+// sectionCurrencyAmounts 按币种分段的正文，每段单独交给该银行的解析器取应还和最低还款
+func sectionCurrencyAmounts(pb *parsedBill) currencyAmounts {
+	var ca currencyAmounts
+	body := pb.body
+	locs := reCurrencySection.FindAllStringSubmatchIndex(body, -1)
+	for i, loc := range locs {
+		end := len(body)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		section := parsedBill{from: pb.from, subject: pb.subject, body: body[loc[0]:end], bank: pb.bank}
+		statementParserFor(section.bank).Parse(&section)
+		if section.amount == 0 {
+			continue
+		}
+		a := ca.get(body[loc[2]:loc[3]])
+		a.Amount, a.MinPayment = section.amount, section.minPayment
+	}
+	return ca
+}
+
+// inlineCurrencyAmounts 应还金额/最低还款所在行中并列的各币种金额
+func inlineCurrencyAmounts(body string) currencyAmounts {
+	var ca currencyAmounts
+	for _, line := range strings.Split(body, "\n") {
+		isMin := reMinPayLabel.MatchString(line)
+		if !isMin && !reAmountLabel.MatchString(line) {
+			continue
+		}
+		for _, m := range reCurrencyAmount.FindAllStringSubmatch(line, -1) {
+			a := ca.get(m[1])
+			if isMin {
+				a.MinPayment = parseAmount(m[2])
+			} else if a.Amount == 0 {
+				a.Amount = parseAmount(m[2])
+			}
+		}
+	}
+	// 只在最低还款行出现的币种不算
+	var out currencyAmounts
+	for _, cur := range ca.order {
+		if a := ca.m[cur]; a.Amount != 0 {
+			*out.get(cur) = *a
+		}
+	}
+	return out
+}
+
+// ─────────────────────────────────────────
+// 存储
+// ─────────────────────────────────────────
+
+// saveBillAmounts 写入一张账单的各币种金额
+func saveBillAmounts(tx *sql.Tx, userID string, billID int64, amounts []BillAmount) error {
+	for _, a := range amounts {
+		_, err := tx.Exec(`INSERT OR REPLACE INTO bill_amounts (bill_id, user_id, currency, amount, min_payment) VALUES (?, ?, ?, ?, ?)`,
+			billID, userID, a.Currency, a.Amount, a.MinPayment)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadBillAmounts 读取一批账单的各币种金额
+func loadBillAmounts(userID string, billIDs []int64) (map[int64][]BillAmount, error) {
+	out := map[int64][]BillAmount{}
+	if len(billIDs) == 0 {
+		return out, nil
+	}
+	args := []any{userID}
+	for _, id := range billIDs {
+		args = append(args, id)
+	}
+	rows, err := db.Query(`
+		SELECT bill_id, currency, amount, min_payment FROM bill_amounts
+		WHERE user_id = ? AND bill_id IN (?`+strings.Repeat(",?", len(billIDs)-1)+`)
+		ORDER BY bill_id, currency != 'CNY', id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var a BillAmount
+		if err := rows.Scan(&id, &a.Currency, &a.Amount, &a.MinPayment); err != nil {
+			return nil, err
+		}
+		out[id] = append(out[id], a)
+	}
+	return out, rows.Err()
+}
+
+// attachBillAmounts 为账单附上各币种金额和折合人民币合计
+func attachBillAmounts(userID string, bills []BillStatement) error {
+	ids := make([]int64, len(bills))
+	for i, bs := range bills {
+		ids[i] = bs.ID
+	}
+	amounts, err := loadBillAmounts(userID, ids)
+	if err != nil {
+		return err
+	}
+	fx, err := loadFXRates(userID)
+	if err != nil {
+		return err
+	}
+
+	for i := range bills {
+		bs := &bills[i]
+		bs.Amounts = amounts[bs.ID]
+		if len(bs.Amounts) == 0 {
+			bs.Amounts = []BillAmount{{Currency: bs.Currency, Amount: bs.Amount, MinPayment: bs.MinPayment}}
+		}
+		total, ok := 0.0, true
+		for _, a := range bs.Amounts {
+			v, found := fx.toCNY(a.Amount, a.Currency, bs.BillDate)
+			total += v
+			ok = ok && found
+		}
+		if ok {
+			total = roundCents(total)
+			bs.CNYTotal = &total
+		}
+	}
+	return nil
+}
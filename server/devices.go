@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ─────────────────────────────────────────
+// 数据结构
+// ─────────────────────────────────────────
+
+// Device 已登记的同步设备（每台设备持有独立令牌，可单独吊销）
+type Device struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	CreatedAt  int64  `json:"createdAt"`
+	LastSeenAt int64  `json:"lastSeenAt"`
+	LastIP     string `json:"lastIp"`
+	RevokedAt  int64  `json:"revokedAt,omitempty"` // 0 表示未吊销
+}
+
+// gin.Context 中保存当前设备ID的键（仅设备令牌请求会设置）
+const ctxDeviceID = "deviceID"
+
+// ─────────────────────────────────────────
+// 令牌校验（由 authRequired 调用）
+// ─────────────────────────────────────────
+
+// lookupDeviceToken 校验设备令牌，成功时记录最近访问时间和IP
+func lookupDeviceToken(token, clientIP string) (userID, deviceID string, ok bool) {
+	var revokedAt int64
+	err := db.QueryRow(`SELECT id, user_id, revoked_at FROM devices WHERE token_hash = ?`, hashToken(token)).
+		Scan(&deviceID, &userID, &revokedAt)
+	if err != nil || revokedAt != 0 {
+		return "", "", false
+	}
+
+	_, err = db.Exec(`UPDATE devices SET last_seen_at = ?, last_ip = ? WHERE id = ?`,
+		time.Now().Unix(), clientIP, deviceID)
+	if err != nil {
+		log.Printf("[devices] 更新访问记录失败: %v", err)
+	}
+	return userID, deviceID, true
+}
+
+// currentDeviceID 获取当前请求使用的设备ID（会话令牌请求返回空）
+func currentDeviceID(c *gin.Context) string {
+	return c.GetString(ctxDeviceID)
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：/api/v1/devices
+// ─────────────────────────────────────────
+
+// handleEnrollDevice 登记新设备并签发令牌（令牌只在此处返回一次）
+func handleEnrollDevice(c *gin.Context) {
+	if !requireSession(c) {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	dev := Device{
+		ID:        uuid.New().String(),
+		Name:      strings.TrimSpace(req.Name),
+		CreatedAt: time.Now().Unix(),
+	}
+	_, err = db.Exec(`INSERT INTO devices (id, user_id, name, token_hash, created_at) VALUES (?, ?, ?, ?, ?)`,
+		dev.ID, currentUserID(c), dev.Name, hashToken(token), dev.CreatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// 登记用的登录会话就在这台设备上，记到设备名下，吊销设备时一并失效
+	if _, err := db.Exec(`UPDATE sessions SET device_id = ? WHERE token_hash = ?`, dev.ID, hashToken(bearerToken(c))); err != nil {
+		log.Printf("[devices] 关联登录会话失败: %v", err)
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"data": gin.H{
+			"device": dev,
+			"token":  token,
+		},
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleListDevices(c *gin.Context) {
+	rows, err := db.Query(`
+		SELECT id, name, created_at, last_seen_at, last_ip, revoked_at
+		FROM devices WHERE user_id = ?
+		ORDER BY created_at DESC
+	`, currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(&d.ID, &d.Name, &d.CreatedAt, &d.LastSeenAt, &d.LastIP, &d.RevokedAt); err != nil {
+			log.Printf("[devices] Scan失败: %v", err)
+			continue
+		}
+		devices = append(devices, d)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      devices,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleRevokeDevice 吊销设备令牌（如手机丢失），之后该令牌以及登记该设备时所用登录会话的请求一律返回401。
+// 设备上后来另行登录的会话不在此列，需要时用 POST /auth/logout-all 让所有登录会话失效
+func handleRevokeDevice(c *gin.Context) {
+	if !requireSession(c) {
+		return
+	}
+
+	res, err := db.Exec(`UPDATE devices SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at = 0`,
+		time.Now().Unix(), c.Param("id"), currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "设备不存在或已吊销"})
+		return
+	}
+	if _, err := db.Exec(`DELETE FROM push_subscriptions WHERE user_id = ? AND device_id = ?`, currentUserID(c), c.Param("id")); err != nil {
+		log.Printf("[devices] 删除设备推送订阅失败: %v", err)
+	}
+	if _, err := db.Exec(`DELETE FROM sessions WHERE user_id = ? AND device_id = ?`, currentUserID(c), c.Param("id")); err != nil {
+		log.Printf("[devices] 删除设备登录会话失败: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "timestamp": time.Now().Unix()})
+}
+
+// requireSession 设备管理只允许用账号登录令牌操作，防止丢失的设备吊销其他设备
+func requireSession(c *gin.Context) bool {
+	if currentDeviceID(c) != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "设备令牌无权管理设备，请使用账号登录"})
+		return false
+	}
+	return true
+}
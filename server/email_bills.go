@@ -4,6 +4,8 @@ import (
 	"crypto/tls"
 	"database/sql"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -27,17 +29,23 @@ import (
 
 // EmailConfig 邮件拉取配置（存储在 SQLite email_config 表中）
 type EmailConfig struct {
-	ID       int64  `json:"id"`
-	Email    string `json:"email"`    // 邮箱地址
-	Password string `json:"password"` // 授权码（非登录密码）
-	IMAPHost string `json:"imapHost"` // IMAP服务器，如 imap.qq.com:993
+	ID       int64    `json:"id"`
+	Email    string   `json:"email"`    // 邮箱地址
+	Password string   `json:"password"` // 授权码（非登录密码），从库中读出的是密文，连接前用 openSecret 解密
+	IMAPHost string   `json:"imapHost"` // IMAP服务器，如 imap.qq.com:993
+	Folders  []string `json:"folders"`  // 需要扫描的文件夹，默认 INBOX
+	Enabled  bool     `json:"enabled"`  // 停用后不参与拉取
 }
 
 // BillStatement 账单记录
 type BillStatement struct {
 	ID              int64   `json:"id"`
+	UserID          string  `json:"-"`               // 所属用户
 	CardSyncID      string  `json:"cardSyncId"`      // 关联的信用卡 syncId
+	EmailConfigID   int64   `json:"emailConfigId"`   // 来源邮箱配置
+	Mailbox         string  `json:"mailbox"`         // 来源文件夹
 	EmailUID        uint32  `json:"emailUid"`        // IMAP邮件UID（去重用）
+	UIDValidity     uint32  `json:"-"`               // 邮件所在文件夹的 UIDVALIDITY（与 UID 一起去重）
 	Bank            string  `json:"bank"`            // 银行名称
 	Amount          float64 `json:"amount"`          // 账单总额
 	Currency        string  `json:"currency"`        // 货币（CNY/USD等）
@@ -48,16 +56,36 @@ type BillStatement struct {
 	MatchedBy       string  `json:"matchedBy"`       // full_card/last_four/name
 	MatchConfidence string  `json:"matchConfidence"` // high/medium/low/ambiguous
 	FetchedAt       int64   `json:"fetchedAt"`       // 拉取时间戳
+	EmailFrom       string  `json:"emailFrom"`       // 发件人地址（自定义规则匹配用）
+	EmailSubject    string  `json:"emailSubject"`    // 邮件标题
+	Source          string  `json:"source"`          // email/manual/import
+	PaidAmount      float64 `json:"paidAmount"`      // 已还金额（与账单同币种的还款合计）
+	Status          string  `json:"status"`          // unpaid/partially_paid/paid/overdue
 	RawContent      string  `json:"rawContent,omitempty"` // 原始文本（可选返回）
+
+	Amounts  []BillAmount `json:"amounts,omitempty"` // 各币种应还金额（双币卡有多条）
+	CNYTotal *float64     `json:"cnyTotal"`          // 各币种按汇率折合人民币的合计，缺少汇率时为 null
+
+	Overrides []BillOverride `json:"overrides,omitempty"` // 手工修改过的字段（重新拉取时保留）
+
+	MessageID string   `json:"-"` // 邮件的 Message-ID（仅入库时使用）
+	Body      string   `json:"-"` // 完整的邮件文本（仅入库时使用，RawContent 是截断后的）
+	HTML      []string `json:"-"` // HTML 正文原文（仅入库时使用）
 }
 
 // parsedBill 内部解析中间结构
 type parsedBill struct {
 	uid           uint32
+	messageID     string // Message-ID 头，UIDVALIDITY 重置后据此识别已入库的邮件
 	from          string
 	subject       string
-	body          string   // 文本内容
+	date          time.Time   // 邮件日期（还款通知只写月日时用来推算年份）
+	body          string      // 文本内容
 	statementType string
+	pdfs          [][]byte    // PDF 附件原文（提取文字后清空）
+	pdfErr        error       // 无法提取文字的 PDF 附件的错误
+	tables        []htmlTable // HTML 正文中的表格，供 tableValue 按标签取值
+	html          []string    // HTML 正文原文（随账单保存，规则试跑时据此重建 tables）
 
 	// 从邮件中提取的账单字段
 	fullCardNumber  string  // 完整卡号（若有）
@@ -69,102 +97,135 @@ type parsedBill struct {
 	billDate        string
 	dueDate         string
 	bank            string
+	transactions    []BillTransaction
+	amounts         []BillAmount // 各币种应还金额（单币种账单只有一条）
+
+	repayment *repaymentNotice // 还款到账通知（不是账单）
 }
 
 // ─────────────────────────────────────────
-// 数据库初始化（由 main.go initDB 调用）
+// IMAP 拉取
 // ─────────────────────────────────────────
 
-func initBillsTables() {
-	sqls := []string{
-		`CREATE TABLE IF NOT EXISTS email_config (
-			id       INTEGER PRIMARY KEY AUTOINCREMENT,
-			email    TEXT NOT NULL,
-			password TEXT NOT NULL,
-			imap_host TEXT NOT NULL DEFAULT 'imap.qq.com:993'
-		);`,
-		`CREATE TABLE IF NOT EXISTS bill_statements (
-			id               INTEGER PRIMARY KEY AUTOINCREMENT,
-			card_sync_id     TEXT NOT NULL,
-			email_uid        INTEGER NOT NULL,
-			bank             TEXT,
-			amount           REAL,
-			currency         TEXT DEFAULT 'CNY',
-			bill_date        TEXT,
-			due_date         TEXT,
-			min_payment      REAL,
-			statement_type   TEXT,
-			raw_content      TEXT,
-			matched_by       TEXT,
-			match_confidence TEXT,
-			fetched_at       INTEGER
-		);`,
-		`CREATE UNIQUE INDEX IF NOT EXISTS idx_bill_uid ON bill_statements(email_uid);`,
-	}
-	for _, s := range sqls {
-		if _, err := db.Exec(s); err != nil {
-			log.Printf("[bills] 建表警告: %v", err)
-		}
-	}
+// billExtractor 解析一个用户的账单邮件所需的数据
+type billExtractor struct {
+	passwords pdfPasswordBook // PDF 账单密码
+	rules     parseRuleSet    // 自定义解析规则，优先于内置解析器
 }
 
-// ─────────────────────────────────────────
-// IMAP 拉取
-// ─────────────────────────────────────────
+// wants 只凭发件人和标题判断是否需要下载正文
+func (x billExtractor) wants(from, subject string) bool {
+	return isLikelyStatement(from, subject) || x.rules.match(from, subject) != nil
+}
 
-func fetchEmailsFromIMAP(cfg EmailConfig) ([]parsedBill, error) {
+// extract 解析邮件正文和 PDF 附件，再套用命中的自定义规则
+func (x billExtractor) extract(msg *imap.Message, section *imap.BodySectionName) *parsedBill {
+	pb := parseIMAPMessage(msg, section)
+	if pb == nil || pb.repayment != nil {
+		return pb
+	}
+	applyPDFAttachments(pb, x.passwords)
+	x.rules.apply(pb)
+	return pb
+}
+
+// fetchEmailsFromIMAP 拉取 st.Mailbox 中 st 之后的新邮件和 retries 中待重试的邮件，返回解析结果和更新后的进度。
+// 中途出错时返回已完成批次的结果、对应的进度和错误，调用方可以先保存已拉到的部分。
+// PDF 附件在下载后立即解密提取文字，不在内存中积压原文件。
+func fetchEmailsFromIMAP(cfg EmailConfig, st mailboxState, retries []uint32, backfill bool, x billExtractor) ([]parsedBill, mailboxState, error) {
 	tlsCfg := &tls.Config{ServerName: strings.Split(cfg.IMAPHost, ":")[0]}
 	c, err := client.DialTLS(cfg.IMAPHost, tlsCfg)
 	if err != nil {
-		return nil, fmt.Errorf("IMAP连接失败: %w", err)
+		return nil, st, fmt.Errorf("IMAP连接失败: %w", err)
 	}
 	defer c.Logout()
 
 	if err := c.Login(cfg.Email, cfg.Password); err != nil {
-		return nil, fmt.Errorf("IMAP登录失败: %w", err)
+		return nil, st, fmt.Errorf("IMAP登录失败: %w", err)
 	}
 
-	mbox, err := c.Select("INBOX", false)
+	mbox, err := c.Select(st.Mailbox, true)
 	if err != nil {
-		return nil, fmt.Errorf("选择收件箱失败: %w", err)
+		return nil, st, fmt.Errorf("选择文件夹失败: %w", err)
 	}
+	if st.UIDValidity != mbox.UidValidity {
+		retries = nil // 旧 UID 已失效
+	}
+	st = syncUIDValidity(st, mbox.UidValidity)
 
 	if mbox.Messages == 0 {
-		return nil, nil
+		return nil, st, nil
 	}
 
-	// 只取最近 100 封（从最新开始）
-	from := uint32(1)
-	if mbox.Messages > 100 {
-		from = mbox.Messages - 99
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = uidRange(st, backfill)
+	found, err := c.UidSearch(criteria)
+	if err != nil {
+		return nil, st, fmt.Errorf("搜索邮件失败: %w", err)
 	}
+	uids := withRetries(pendingUIDs(found, st, backfill), retries)
+
+	section := &imap.BodySectionName{Peek: true}
+	envelopeItems := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid}
+	bodyItems := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, section.FetchItem()}
+
+	var bills []parsedBill
+	for start := 0; start < len(uids); start += fetchBatchSize {
+		batch := uids[start:min(start+fetchBatchSize, len(uids))]
+
+		// 先只取信封，按发件人/标题筛出疑似账单，再下载这些邮件的正文
+		var candidates []uint32
+		err := uidFetch(c, batch, envelopeItems, func(msg *imap.Message) {
+			if msg.Envelope == nil {
+				return
+			}
+			from := ""
+			if len(msg.Envelope.From) > 0 {
+				from = msg.Envelope.From[0].Address()
+			}
+			if x.wants(from, msg.Envelope.Subject) {
+				candidates = append(candidates, msg.Uid)
+			}
+		})
+		if err != nil {
+			return bills, st, fmt.Errorf("拉取邮件失败: %w", err)
+		}
+
+		if len(candidates) > 0 {
+			err = uidFetch(c, candidates, bodyItems, func(msg *imap.Message) {
+				if parsed := x.extract(msg, section); parsed != nil {
+					bills = append(bills, *parsed)
+				}
+			})
+			if err != nil {
+				return bills, st, fmt.Errorf("拉取邮件失败: %w", err)
+			}
+		}
+
+		if last := batch[len(batch)-1]; last > st.LastUID {
+			st.LastUID = last
+		}
+	}
+	return bills, st, nil
+}
+
+// uidFetch 按 UID 拉取邮件，逐封交给 handle 处理
+func uidFetch(c *client.Client, uids []uint32, items []imap.FetchItem, handle func(*imap.Message)) error {
 	seqset := new(imap.SeqSet)
-	seqset.AddRange(from, mbox.Messages)
+	seqset.AddNum(uids...)
 
 	messages := make(chan *imap.Message, 10)
 	done := make(chan error, 1)
-
-	section := &imap.BodySectionName{}
-	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, section.FetchItem()}
-
 	go func() {
-		done <- c.Fetch(seqset, items, messages)
+		done <- c.UidFetch(seqset, items, messages)
 	}()
 
-	var bills []parsedBill
 	for msg := range messages {
-		if msg == nil {
-			continue
-		}
-		parsed := parseIMAPMessage(msg, section)
-		if parsed != nil {
-			bills = append(bills, *parsed)
+		if msg != nil {
+			handle(msg)
 		}
 	}
-	if err := <-done; err != nil {
-		log.Printf("[bills] Fetch警告: %v", err)
-	}
-	return bills, nil
+	return <-done
 }
 
 // ─────────────────────────────────────────
@@ -177,8 +238,10 @@ func parseIMAPMessage(msg *imap.Message, section *imap.BodySectionName) *parsedB
 	}
 
 	pb := &parsedBill{
-		uid:     msg.Uid,
-		subject: msg.Envelope.Subject,
+		uid:       msg.Uid,
+		messageID: msg.Envelope.MessageId,
+		subject:   msg.Envelope.Subject,
+		date:      msg.Envelope.Date,
 	}
 	if len(msg.Envelope.From) > 0 {
 		pb.from = msg.Envelope.From[0].Address()
@@ -189,11 +252,28 @@ func parseIMAPMessage(msg *imap.Message, section *imap.BodySectionName) *parsedB
 	if r == nil {
 		return pb
 	}
+	if err := readMailBody(pb, r); err != nil {
+		log.Printf("[bills] 解析邮件(%d)失败: %v", msg.Uid, err)
+		return pb
+	}
+	extractMailFields(pb)
+	return pb
+}
 
+// extractMailFields 还款到账通知只提取还款信息，其余邮件按账单解析
+func extractMailFields(pb *parsedBill) {
+	if extractRepayment(pb) {
+		pb.pdfs = nil
+		return
+	}
+	extractBillFields(pb)
+}
+
+// readMailBody 读取整封邮件（含头部）的各个部分：文本和HTML合并为 pb.body，PDF附件暂存到 pb.pdfs
+func readMailBody(pb *parsedBill, r io.Reader) error {
 	mr, err := mail.CreateReader(r)
 	if err != nil {
-		log.Printf("[bills] 解析邮件(%d)失败: %v", msg.Uid, err)
-		return pb
+		return err
 	}
 
 	var textParts []string
@@ -215,22 +295,44 @@ func parseIMAPMessage(msg *imap.Message, section *imap.BodySectionName) *parsedB
 		case "text/html":
 			data, _ := io.ReadAll(p.Body)
 			html := decodeBody(data)
-			textParts = append(textParts, stripHTML(html))
+			text, tables := htmlToText(html)
+			textParts = append(textParts, text)
+			pb.tables = append(pb.tables, tables...)
+			pb.html = append(pb.html, html)
 			if pb.statementType == "" {
 				pb.statementType = "html"
 			}
-		case "application/pdf":
-			// 跳过PDF（不做OCR）
-			log.Printf("[bills] 邮件(%d)包含PDF附件，跳过", msg.Uid)
-			pb.statementType = "pdf"
+		case "application/pdf", "application/octet-stream":
+			if ct == "application/octet-stream" && !isPDFAttachment(p.Header) {
+				continue
+			}
+			// 先保存原文件，下载完成后再提取文字层（扫描件不做OCR）
+			data, err := io.ReadAll(io.LimitReader(p.Body, maxPDFSize+1))
+			if err != nil || len(data) > maxPDFSize {
+				log.Printf("[bills] 邮件(%d)的PDF附件读取失败或超过大小上限，跳过", pb.uid)
+				continue
+			}
+			pb.pdfs = append(pb.pdfs, data)
+			if pb.statementType == "" {
+				pb.statementType = "pdf"
+			}
 		// 忽略图片
 		case "image/jpeg", "image/png", "image/gif":
 		}
 	}
 
 	pb.body = strings.Join(textParts, "\n")
-	extractBillFields(pb)
-	return pb
+	return nil
+}
+
+// isPDFAttachment 按文件名判断未标明类型的附件是否为 PDF
+func isPDFAttachment(h mail.PartHeader) bool {
+	ah, ok := h.(*mail.AttachmentHeader)
+	if !ok {
+		return false
+	}
+	name, _ := ah.Filename()
+	return strings.HasSuffix(strings.ToLower(name), ".pdf")
 }
 
 // decodeBody 处理 base64 / quoted-printable 编码（go-message库已处理，这里只做UTF-8安全截断）
@@ -243,21 +345,6 @@ func decodeBody(data []byte) string {
 	return string(data)
 }
 
-// stripHTML 简单去除HTML标签
-func stripHTML(html string) string {
-	re := regexp.MustCompile(`<[^>]+>`)
-	text := re.ReplaceAllString(html, " ")
-	// 处理常见HTML实体
-	text = strings.ReplaceAll(text, "&nbsp;", " ")
-	text = strings.ReplaceAll(text, "&amp;", "&")
-	text = strings.ReplaceAll(text, "&lt;", "<")
-	text = strings.ReplaceAll(text, "&gt;", ">")
-	text = strings.ReplaceAll(text, "&yen;", "¥")
-	// 压缩多余空白
-	spaceRe := regexp.MustCompile(`\s+`)
-	return strings.TrimSpace(spaceRe.ReplaceAllString(text, " "))
-}
-
 // ─────────────────────────────────────────
 // 账单字段正则提取
 // ─────────────────────────────────────────
@@ -277,6 +364,18 @@ var (
 	reDueDate = regexp.MustCompile(`(?:还款日|还款截止|到期还款日|最后还款日)[：:\s]*(\d{4}[-/年]\d{1,2}[-/月]\d{1,2})`)
 	// 持卡人姓名
 	reName = regexp.MustCompile(`(?:尊敬的客户|亲爱的|持卡人|您好)[，,\s]*([^\s，,。！]{2,8})(?:[，,\s]|$)`)
+
+	// HTML 表格单元格中的金额、日期
+	reCellAmount = regexp.MustCompile(`([0-9][0-9,]*(?:\.\d{1,2})?)`)
+	reCellDate   = regexp.MustCompile(reDatePart)
+)
+
+// HTML 表格中各字段的标签，按优先级排列（见 tableValue）
+var (
+	amountLabels   = []string{"本期应还款额", "本期应还款金额", "本期应还金额", "本期账单金额", "应还款额", "应还金额", "应还总额", "账单金额", "账单总额", "还款总额", "总欠款"}
+	minPayLabels   = []string{"本期最低还款额", "最低还款额", "最低应还款额", "最低还款金额", "最低还款", "最低应还"}
+	billDateLabels = []string{"账单日", "账单日期", "出账日", "出账日期"}
+	dueDateLabels  = []string{"到期还款日", "最后还款日", "还款截止日", "还款日"}
 )
 
 // 银行关键词 → 银行名称映射
@@ -314,13 +413,30 @@ var bankSubjectMap = map[string]string{
 	"邮储":   "邮储银行",
 }
 
+// extractBillFields 识别银行后交给该银行注册的解析器提取字段，再提取明细和各币种金额
 func extractBillFields(pb *parsedBill) {
+	// 识别银行（先从发件人域名，再从标题）
+	pb.bank = detectBank(pb.from, pb.subject)
+	statementParserFor(pb.bank).Parse(pb)
+	extractBillDetails(pb)
+}
+
+// extractBillDetails 解析器提取汇总字段之后的通用步骤：交易明细按账单日推算年份，
+// 多币种金额会修正汇总字段
+func extractBillDetails(pb *parsedBill) {
+	extractTransactions(pb)
+	extractCurrencyAmounts(pb)
+}
+
+// genericParser 通用解析器：按大多数银行的常见措辞提取，未注册专用解析器的银行都用它
+type genericParser struct{}
+
+func (genericParser) Name() string { return "generic" }
+
+func (genericParser) Parse(pb *parsedBill) {
 	text := pb.body
 	subject := pb.subject
 
-	// 识别银行（先从发件人域名，再从标题）
-	pb.bank = detectBank(pb.from, subject)
-
 	// 完整卡号
 	if m := reFullCard.FindStringSubmatch(text); len(m) > 1 {
 		raw := regexp.MustCompile(`[\s\-]`).ReplaceAllString(m[1], "")
@@ -343,24 +459,34 @@ func extractBillFields(pb *parsedBill) {
 		}
 	}
 
+	// 金额和日期优先按 HTML 表格中的标签取值，取不到再在全文中匹配
+
 	// 账单金额
 	pb.currency = "CNY"
-	if m := reAmount.FindStringSubmatch(text); len(m) > 1 {
+	if v := pb.tableValue(reCellAmount, amountLabels...); v != "" {
+		pb.amount = parseAmount(v)
+	} else if m := reAmount.FindStringSubmatch(text); len(m) > 1 {
 		pb.amount = parseAmount(m[1])
 	}
 
 	// 最低还款
-	if m := reMinPay.FindStringSubmatch(text); len(m) > 1 {
+	if v := pb.tableValue(reCellAmount, minPayLabels...); v != "" {
+		pb.minPayment = parseAmount(v)
+	} else if m := reMinPay.FindStringSubmatch(text); len(m) > 1 {
 		pb.minPayment = parseAmount(m[1])
 	}
 
 	// 账单日期
-	if m := reBillDate.FindStringSubmatch(text); len(m) > 1 {
+	if v := pb.tableValue(reCellDate, billDateLabels...); v != "" {
+		pb.billDate = normalizeDate(v)
+	} else if m := reBillDate.FindStringSubmatch(text); len(m) > 1 {
 		pb.billDate = normalizeDate(m[1])
 	}
 
 	// 还款截止日期
-	if m := reDueDate.FindStringSubmatch(text); len(m) > 1 {
+	if v := pb.tableValue(reCellDate, dueDateLabels...); v != "" {
+		pb.dueDate = normalizeDate(v)
+	} else if m := reDueDate.FindStringSubmatch(text); len(m) > 1 {
 		pb.dueDate = normalizeDate(m[1])
 	}
 
@@ -383,18 +509,26 @@ func extractBillFields(pb *parsedBill) {
 }
 
 func detectBank(from, subject string) string {
-	fromLower := strings.ToLower(from)
-	for domain, bank := range bankDomainMap {
-		if strings.Contains(fromLower, domain) {
-			return bank
-		}
+	if bank := longestKeyMatch(strings.ToLower(from), bankDomainMap); bank != "" {
+		return bank
 	}
-	for keyword, bank := range bankSubjectMap {
-		if strings.Contains(subject, keyword) {
-			return bank
+	return longestKeyMatch(subject, bankSubjectMap)
+}
+
+// longestKeyMatch 返回 s 中出现的最长关键词对应的银行（如 cmbchina 优先于 cmbc），结果不受 map 遍历顺序影响
+func longestKeyMatch(s string, m map[string]string) string {
+	best := ""
+	for keyword := range m {
+		if len(keyword) > len(best) && strings.Contains(s, keyword) {
+			best = keyword
 		}
 	}
-	return ""
+	return m[best]
+}
+
+// isLikelyStatement 只凭发件人和标题判断是否可能是信用卡账单（决定是否下载正文）
+func isLikelyStatement(from, subject string) bool {
+	return detectBank(from, subject) != "" || strings.Contains(subject, "账单")
 }
 
 func parseAmount(s string) float64 {
@@ -497,61 +631,291 @@ func normalizeChineseName(s string) string {
 // 存储账单到数据库
 // ─────────────────────────────────────────
 
-func saveBillStatement(bs BillStatement) error {
-	// 已存在则跳过（email_uid唯一索引）
-	_, err := db.Exec(`
-		INSERT OR IGNORE INTO bill_statements 
-		(card_sync_id, email_uid, bank, amount, currency, bill_date, due_date, 
-		 min_payment, statement_type, raw_content, matched_by, match_confidence, fetched_at)
-		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)`,
-		bs.CardSyncID, bs.EmailUID, bs.Bank, bs.Amount, bs.Currency,
+// saveBillStatement 保存账单及其交易明细。
+// 同一封邮件已入库时（见 findEmailBill）按本次解析结果更新，手工修改过的字段保持不变，见 refreshBillStatement。
+func saveBillStatement(bs BillStatement, txns []BillTransaction) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	billID, err := findEmailBill(tx, bs)
+	if err == nil {
+		if err := refreshBillStatement(tx, billID, bs, txns); err != nil {
+			return err
+		}
+		if err := saveBillBody(tx, billID, bs); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO bill_statements 
+		(user_id, card_sync_id, email_config_id, mailbox, email_uid, email_uid_validity, bank, amount, currency, bill_date, due_date, 
+		 min_payment, statement_type, raw_content, matched_by, match_confidence, fetched_at, email_from, email_subject, message_id, source)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,'email')`,
+		bs.UserID, bs.CardSyncID, bs.EmailConfigID, bs.Mailbox, bs.EmailUID, bs.UIDValidity, bs.Bank, bs.Amount, bs.Currency,
 		bs.BillDate, bs.DueDate, bs.MinPayment, bs.StatementType,
-		bs.RawContent, bs.MatchedBy, bs.MatchConfidence, bs.FetchedAt,
+		bs.RawContent, bs.MatchedBy, bs.MatchConfidence, bs.FetchedAt, bs.EmailFrom, bs.EmailSubject, bs.MessageID,
 	)
+	if err != nil {
+		return err
+	}
+	billID, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if err := saveBillAmounts(tx, bs.UserID, billID, bs.Amounts); err != nil {
+		return err
+	}
+	if err := saveBillTransactions(tx, bs.UserID, billID, txns); err != nil {
+		return err
+	}
+	if err := saveBillBody(tx, billID, bs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// saveBillBody 保存账单邮件的完整文本和 HTML 原文，供规则试跑使用（raw_content 只留了前 2000 字且没有表格）
+func saveBillBody(tx *sql.Tx, billID int64, bs BillStatement) error {
+	html, err := json.Marshal(bs.HTML)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO bill_bodies (bill_id, user_id, body, html, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(bill_id) DO UPDATE SET
+			body = excluded.body,
+			html = excluded.html,
+			updated_at = excluded.updated_at
+	`, billID, bs.UserID, bs.Body, string(html), time.Now().Unix())
 	return err
 }
 
+// loadBillBody 读取账单邮件的完整文本，并从 HTML 原文重建表格；没有保存时返回 sql.ErrNoRows
+func loadBillBody(userID string, billID int64) (string, []htmlTable, error) {
+	var body, raw string
+	err := db.QueryRow(`SELECT body, html FROM bill_bodies WHERE bill_id = ? AND user_id = ?`, billID, userID).
+		Scan(&body, &raw)
+	if err != nil {
+		return "", nil, err
+	}
+	var parts []string
+	if err := json.Unmarshal([]byte(raw), &parts); err != nil {
+		return "", nil, err
+	}
+	var tables []htmlTable
+	for _, html := range parts {
+		_, t := htmlToText(html)
+		tables = append(tables, t...)
+	}
+	return body, tables, nil
+}
+
+// findEmailBill 查找同一封邮件已入库的账单：先按 UID；UIDVALIDITY 重置后 UID 重新编号，再按 Message-ID；
+// 没有记录 Message-ID 的旧账单按 卡片 + 账单日 识别。找到后把 UID 和 Message-ID 更新为本次的值。
+func findEmailBill(tx *sql.Tx, bs BillStatement) (int64, error) {
+	var billID int64
+	err := tx.QueryRow(`
+		SELECT id FROM bill_statements
+		WHERE user_id = ? AND source = 'email' AND email_config_id = ? AND mailbox = ? AND email_uid_validity = ? AND email_uid = ?`,
+		bs.UserID, bs.EmailConfigID, bs.Mailbox, bs.UIDValidity, bs.EmailUID).Scan(&billID)
+	if err == sql.ErrNoRows && bs.MessageID != "" {
+		err = tx.QueryRow(`
+			SELECT id FROM bill_statements
+			WHERE user_id = ? AND source = 'email' AND email_config_id = ? AND mailbox = ? AND message_id = ?
+			ORDER BY id LIMIT 1`,
+			bs.UserID, bs.EmailConfigID, bs.Mailbox, bs.MessageID).Scan(&billID)
+	}
+	if err == sql.ErrNoRows && bs.BillDate != "" {
+		err = tx.QueryRow(`
+			SELECT id FROM bill_statements
+			WHERE user_id = ? AND source = 'email' AND email_config_id = ? AND mailbox = ? AND message_id = ''
+				AND email_uid_validity != ? AND card_sync_id = ? AND bill_date = ?
+			ORDER BY id LIMIT 1`,
+			bs.UserID, bs.EmailConfigID, bs.Mailbox, bs.UIDValidity, bs.CardSyncID, bs.BillDate).Scan(&billID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`
+		UPDATE bill_statements SET email_uid = ?, email_uid_validity = ?, message_id = COALESCE(NULLIF(?, ''), message_id)
+		WHERE id = ?`, bs.EmailUID, bs.UIDValidity, bs.MessageID, billID)
+	return billID, err
+}
+
 // ─────────────────────────────────────────
 // HTTP Handler：POST /api/v1/bills/fetch
 // ─────────────────────────────────────────
 
 func handleFetchBills(c *gin.Context) {
-	// 从数据库读取邮件配置
-	cfg, err := loadEmailConfig()
-	if err != nil {
+	userID := currentUserID(c)
+	if !requireEmailSecrets(c) {
+		return
+	}
+
+	if !hasEnabledEmailConfig(userID) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "未配置邮箱，请先在设置中配置邮箱授权码"})
 		return
 	}
 
-	// 拉取IMAP邮件
-	bills, err := fetchEmailsFromIMAP(cfg)
+	// 同步执行，但同样记录到任务历史
+	jobID, err := startFetchJob(userID, jobTriggerManual)
+	if err == errFetchRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
-		log.Printf("[bills] IMAP拉取失败: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	result, err := runFetchJob(jobID, userID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"jobId":   jobID,
+			"total":   result.total,
+			"saved":   result.saved,
+			"skipped": result.skipped,
+		},
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// fetchAndSaveBills 拉取用户所有启用邮箱中的账单，匹配卡片后入库（HTTP 请求和定时任务共用）。
+// backfill 为 true 时扫描整个文件夹，否则只拉取上次之后的新邮件。
+// 某个邮箱或文件夹失败不影响其他的，错误合并后返回。
+func fetchAndSaveBills(userID string, backfill bool) (fetchResult, error) {
+	var result fetchResult
+	if !emailSecretsReady() {
+		return result, errNoSecretKey
+	}
+
+	// 从数据库读取邮件配置
+	cfgs, err := loadEmailConfigs(userID, true)
+	if err != nil {
+		return result, err
+	}
+	if len(cfgs) == 0 {
+		return result, fmt.Errorf("未配置邮箱")
+	}
 
 	// 加载全部卡片用于匹配
-	cards := getCardsAll()
+	cards := getCardsAll(userID)
+
+	var x billExtractor
+	if x.passwords, err = loadPDFPasswords(userID); err != nil {
+		return result, err
+	}
+	if x.rules, err = loadParseRuleSet(userID); err != nil {
+		return result, err
+	}
+
+	var errs []error
+	for _, cfg := range cfgs {
+		password, err := openSecret(cfg.Password)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", cfg.Email, err))
+			continue
+		}
+		cfg.Password = password
+
+		for _, folder := range cfg.Folders {
+			r, err := fetchAndSaveMailbox(userID, cfg, folder, cards, x, backfill)
+			result.total += r.total
+			result.saved += r.saved
+			result.skipped += r.skipped
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s/%s: %w", cfg.Email, folder, err))
+			}
+		}
+	}
+	return result, errors.Join(errs...)
+}
+
+// fetchAndSaveMailbox 拉取一个邮箱文件夹并保存匹配到的账单
+func fetchAndSaveMailbox(userID string, cfg EmailConfig, folder string, cards []Card, x billExtractor, backfill bool) (fetchResult, error) {
+	var result fetchResult
+
+	st, err := loadMailboxState(cfg.ID, folder)
+	if err != nil {
+		return result, err
+	}
+	firstRun := st.UIDValidity == 0
+
+	retries, err := loadMailRetries(st)
+	if err != nil {
+		return result, err
+	}
+
+	// 拉取IMAP邮件（出错时仍保存已拉到的部分，进度只推进到成功的批次）
+	bills, newState, fetchErr := fetchEmailsFromIMAP(cfg, st, retries, backfill, x)
+	if fetchErr != nil {
+		log.Printf("[bills] IMAP拉取失败(%s/%s): %v", cfg.Email, folder, fetchErr)
+	}
+	result.total = len(bills)
+
+	if firstRun && newState.UIDValidity != 0 {
+		if err := adoptUIDValidity(newState); err != nil {
+			return result, err
+		}
+	}
 
-	// 匹配并存储
-	var saved, skipped int
+	// 匹配并存储，没能入库的记入重试列表
+	failed := map[uint32]string{}
 	for _, pb := range bills {
-		// 跳过PDF（无文字可解析）
+		if pb.repayment != nil {
+			added, err := saveDetectedPayment(userID, cfg, folder, newState.UIDValidity, pb, cards)
+			if err != nil {
+				log.Printf("[payments] 登记还款失败: %v", err)
+			}
+			if added {
+				result.saved++
+			} else {
+				result.skipped++
+			}
+			continue
+		}
+
+		// 跳过没有文字层或无法解密的PDF
 		if pb.statementType == "pdf" && pb.body == "" {
-			skipped++
+			failed[pb.uid] = "PDF 没有文字层或无法解密"
+			if errors.Is(pb.pdfErr, errPDFUnsupportedEncryption) {
+				failed[pb.uid] = errPDFUnsupportedEncryption.Error()
+			}
+			result.skipped++
 			continue
 		}
 
 		mr := matchBillToCard(pb, cards)
 		if !mr.found {
-			skipped++
+			failed[pb.uid] = "未匹配到卡片"
+			result.skipped++
 			continue
 		}
 
 		bs := BillStatement{
+			UserID:          userID,
 			CardSyncID:      mr.card.SyncID,
+			EmailConfigID:   cfg.ID,
+			Mailbox:         folder,
 			EmailUID:        pb.uid,
+			UIDValidity:     newState.UIDValidity,
+			MessageID:       pb.messageID,
+			Body:            pb.body,
+			HTML:            pb.html,
 			Bank:            pb.bank,
 			Amount:          pb.amount,
 			Currency:        pb.currency,
@@ -563,23 +927,29 @@ func handleFetchBills(c *gin.Context) {
 			MatchedBy:       mr.matchedBy,
 			MatchConfidence: mr.confidence,
 			FetchedAt:       time.Now().Unix(),
+			EmailFrom:       pb.from,
+			EmailSubject:    pb.subject,
+			Amounts:         pb.amounts,
 		}
-		if err := saveBillStatement(bs); err != nil {
+		if err := saveBillStatement(bs, pb.transactions); err != nil {
 			log.Printf("[bills] 保存账单失败: %v", err)
+			failed[pb.uid] = err.Error()
 		} else {
-			saved++
+			result.saved++
 		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"data": gin.H{
-			"total":   len(bills),
-			"saved":   saved,
-			"skipped": skipped,
-		},
-		"timestamp": time.Now().Unix(),
-	})
+	if newState.UIDValidity != 0 {
+		if err := saveMailRetries(newState, retries, failed, fetchErr == nil); err != nil {
+			return result, err
+		}
+	}
+	if newState != st {
+		if err := saveMailboxState(newState); err != nil {
+			return result, err
+		}
+	}
+	return result, fetchErr
 }
 
 // ─────────────────────────────────────────
@@ -587,14 +957,14 @@ func handleFetchBills(c *gin.Context) {
 // ─────────────────────────────────────────
 
 func handleGetBills(c *gin.Context) {
+	userID := currentUserID(c)
 	rows, err := db.Query(`
-		SELECT id, card_sync_id, email_uid, bank, amount, currency,
-		       bill_date, due_date, min_payment, statement_type,
-		       matched_by, match_confidence, fetched_at
+		SELECT `+billColumns+`
 		FROM bill_statements
+		WHERE user_id = ?
 		ORDER BY fetched_at DESC
 		LIMIT 200
-	`)
+	`, userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -603,12 +973,7 @@ func handleGetBills(c *gin.Context) {
 
 	var bills []BillStatement
 	for rows.Next() {
-		var bs BillStatement
-		err := rows.Scan(
-			&bs.ID, &bs.CardSyncID, &bs.EmailUID, &bs.Bank, &bs.Amount,
-			&bs.Currency, &bs.BillDate, &bs.DueDate, &bs.MinPayment,
-			&bs.StatementType, &bs.MatchedBy, &bs.MatchConfidence, &bs.FetchedAt,
-		)
+		bs, err := scanBill(rows)
 		if err != nil {
 			log.Printf("[bills] Scan失败: %v", err)
 			continue
@@ -616,6 +981,11 @@ func handleGetBills(c *gin.Context) {
 		bills = append(bills, bs)
 	}
 
+	if err := attachBillDetails(userID, bills); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"success":   true,
 		"data":      bills,
@@ -627,9 +997,11 @@ func handleGetBills(c *gin.Context) {
 // HTTP Handler：GET/POST /api/v1/email-config
 // ─────────────────────────────────────────
 
+// 旧版单邮箱接口：读写用户的第一个邮箱配置，多邮箱请使用 /email-configs
+
 func handleGetEmailConfig(c *gin.Context) {
-	cfg, err := loadEmailConfig()
-	if err != nil {
+	cfgs, err := loadEmailConfigs(currentUserID(c), false)
+	if err != nil || len(cfgs) == 0 {
 		// 未配置，返回空
 		c.JSON(http.StatusOK, gin.H{
 			"success": true,
@@ -640,35 +1012,45 @@ func handleGetEmailConfig(c *gin.Context) {
 	}
 	// 不返回密码原文
 	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"data": gin.H{
-			"id":       cfg.ID,
-			"email":    cfg.Email,
-			"imapHost": cfg.IMAPHost,
-		},
+		"success":   true,
+		"data":      emailConfigView(cfgs[0]),
 		"timestamp": time.Now().Unix(),
 	})
 }
 
 func handleSaveEmailConfig(c *gin.Context) {
-	var cfg EmailConfig
-	if err := c.ShouldBindJSON(&cfg); err != nil {
+	if !requireEmailSecrets(c) {
+		return
+	}
+
+	var req emailConfigRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if cfg.IMAPHost == "" {
-		cfg.IMAPHost = "imap.qq.com:993"
+	userID := currentUserID(c)
+
+	cfgs, err := loadEmailConfigs(userID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
-	// upsert（只保留一条配置）
-	_, err := db.Exec(`
-		INSERT INTO email_config (id, email, password, imap_host)
-		VALUES (1, ?, ?, ?)
-		ON CONFLICT(id) DO UPDATE SET
-			email = excluded.email,
-			password = excluded.password,
-			imap_host = excluded.imap_host
-	`, cfg.Email, cfg.Password, cfg.IMAPHost)
+	// 已有配置则修改第一个，否则新建
+	old := EmailConfig{Enabled: true}
+	if len(cfgs) > 0 {
+		old = cfgs[0]
+	}
+	cfg, err := applyEmailConfigRequest(old, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if old.ID != 0 {
+		err = updateEmailConfig(old, cfg)
+	} else {
+		_, err = insertEmailConfig(userID, cfg)
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -708,24 +1090,14 @@ func handleTestEmailConfig(c *gin.Context) {
 // 辅助函数
 // ─────────────────────────────────────────
 
-func loadEmailConfig() (EmailConfig, error) {
-	var cfg EmailConfig
-	err := db.QueryRow(`SELECT id, email, password, imap_host FROM email_config WHERE id=1`).
-		Scan(&cfg.ID, &cfg.Email, &cfg.Password, &cfg.IMAPHost)
-	if err == sql.ErrNoRows {
-		return cfg, fmt.Errorf("未配置")
-	}
-	return cfg, err
-}
-
 // getCardsAll 获取全部未删除卡片（不做分页，账单匹配用）
-func getCardsAll() []Card {
+func getCardsAll(userID string) []Card {
 	rows, err := db.Query(`
 		SELECT id, sync_id, name, bank, card_number, cvv, expiry_date,
 		       cardholder_name, credit_limit, billing_day, payment_due_day,
-		       color, card_front_image, card_back_image, notes, iv, owner, last_four,
+		       color, card_front_image_hash, card_back_image_hash, notes, iv, owner, last_four,
 		       is_deleted, created_at, updated_at
-		FROM cards WHERE is_deleted=0`)
+		FROM cards WHERE is_deleted=0 AND user_id=?`, userID)
 	if err != nil {
 		return nil
 	}
@@ -740,7 +1112,7 @@ func getCardsAll() []Card {
 			&card.CardNumber, &card.CVV, &card.ExpiryDate,
 			&card.CardholderName, &card.CreditLimit, &card.BillingDay,
 			&card.PaymentDueDay, &card.Color,
-			&card.CardFrontImage, &card.CardBackImage,
+			&card.CardFrontImageHash, &card.CardBackImageHash,
 			&card.Notes, &card.IV, &card.Owner, &card.LastFour,
 			&isDeleted, &card.CreatedAt, &card.UpdatedAt,
 		)
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────
+// 多邮箱配置
+//
+// 每个用户可以配置多个邮箱账号，每个账号可以扫描多个文件夹（默认只扫描 INBOX），
+// 并可单独停用。拉取进度按 (账号, 文件夹) 记录在 mailbox_state 中，
+// 账单记录来源账号和文件夹，UID 去重也在同一个 (账号, 文件夹) 范围内进行。
+// ─────────────────────────────────────────
+
+const defaultIMAPHost = "imap.qq.com:993"
+
+// emailConfigRequest 创建/修改邮箱配置的请求体（Enabled 为空表示不修改，新建时默认启用）
+type emailConfigRequest struct {
+	Email    string   `json:"email"`
+	Password string   `json:"password"` // 修改时留空表示沿用原授权码
+	IMAPHost string   `json:"imapHost"`
+	Folders  []string `json:"folders"`
+	Enabled  *bool    `json:"enabled"`
+}
+
+// ─────────────────────────────────────────
+// 读写
+// ─────────────────────────────────────────
+
+const emailConfigColumns = `id, email, password, imap_host, folders, enabled`
+
+func scanEmailConfig(r rowScanner) (EmailConfig, error) {
+	var cfg EmailConfig
+	var folders string
+	var enabled int
+	err := r.Scan(&cfg.ID, &cfg.Email, &cfg.Password, &cfg.IMAPHost, &folders, &enabled)
+	if err != nil {
+		return cfg, err
+	}
+	_ = json.Unmarshal([]byte(folders), &cfg.Folders)
+	cfg.Folders = normalizeFolders(cfg.Folders)
+	cfg.Enabled = enabled != 0
+	return cfg, nil
+}
+
+// loadEmailConfigs 读取用户的邮箱配置（按创建顺序）
+func loadEmailConfigs(userID string, enabledOnly bool) ([]EmailConfig, error) {
+	query := `SELECT ` + emailConfigColumns + ` FROM email_config WHERE user_id = ?`
+	if enabledOnly {
+		query += ` AND enabled = 1`
+	}
+	rows, err := db.Query(query+` ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cfgs []EmailConfig
+	for rows.Next() {
+		cfg, err := scanEmailConfig(rows)
+		if err != nil {
+			return nil, err
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, rows.Err()
+}
+
+func loadEmailConfig(userID string, id int64) (EmailConfig, error) {
+	row := db.QueryRow(`SELECT `+emailConfigColumns+` FROM email_config WHERE id = ? AND user_id = ?`, id, userID)
+	return scanEmailConfig(row)
+}
+
+// hasEnabledEmailConfig 用户是否至少有一个启用的邮箱
+func hasEnabledEmailConfig(userID string) bool {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM email_config WHERE user_id = ? AND enabled = 1`, userID).Scan(&n)
+	return err == nil && n > 0
+}
+
+func insertEmailConfig(userID string, cfg EmailConfig) (int64, error) {
+	folders, _ := json.Marshal(cfg.Folders)
+	res, err := db.Exec(`INSERT INTO email_config (user_id, email, password, imap_host, folders, enabled) VALUES (?, ?, ?, ?, ?, ?)`,
+		userID, cfg.Email, cfg.Password, cfg.IMAPHost, string(folders), boolToInt(cfg.Enabled))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// updateEmailConfig 保存修改；换了邮箱账号或服务器时旧的 UID 进度不再适用，一并清空
+func updateEmailConfig(old, cfg EmailConfig) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	folders, _ := json.Marshal(cfg.Folders)
+	_, err = tx.Exec(`UPDATE email_config SET email = ?, password = ?, imap_host = ?, folders = ?, enabled = ? WHERE id = ?`,
+		cfg.Email, cfg.Password, cfg.IMAPHost, string(folders), boolToInt(cfg.Enabled), cfg.ID)
+	if err != nil {
+		return err
+	}
+	if old.Email != cfg.Email || old.IMAPHost != cfg.IMAPHost {
+		if err := resetMailboxState(tx, cfg.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// applyEmailConfigRequest 把请求合并到已有配置上（新建时 cfg 为零值）
+func applyEmailConfigRequest(cfg EmailConfig, req emailConfigRequest) (EmailConfig, error) {
+	cfg.Email = strings.TrimSpace(req.Email)
+	if req.Password != "" {
+		sealed, err := sealSecret(req.Password)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Password = sealed
+	}
+	cfg.IMAPHost = strings.TrimSpace(req.IMAPHost)
+	if cfg.IMAPHost == "" {
+		cfg.IMAPHost = defaultIMAPHost
+	}
+	if req.Folders != nil {
+		cfg.Folders = req.Folders
+	}
+	cfg.Folders = normalizeFolders(cfg.Folders)
+	if req.Enabled != nil {
+		cfg.Enabled = *req.Enabled
+	}
+
+	if cfg.Email == "" || cfg.Password == "" {
+		return cfg, fmt.Errorf("邮箱和授权码不能为空")
+	}
+	return cfg, nil
+}
+
+// normalizeFolders 去掉空白和重复的文件夹，为空时默认 INBOX
+func normalizeFolders(folders []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, f := range folders {
+		f = strings.TrimSpace(f)
+		if f == "" || seen[f] {
+			continue
+		}
+		seen[f] = true
+		out = append(out, f)
+	}
+	if len(out) == 0 {
+		return []string{"INBOX"}
+	}
+	return out
+}
+
+// emailConfigView 返回给客户端的配置（不含授权码）
+func emailConfigView(cfg EmailConfig) gin.H {
+	return gin.H{
+		"id":       cfg.ID,
+		"email":    cfg.Email,
+		"imapHost": cfg.IMAPHost,
+		"folders":  cfg.Folders,
+		"enabled":  cfg.Enabled,
+	}
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：/api/v1/email-configs
+// ─────────────────────────────────────────
+
+func handleListEmailConfigs(c *gin.Context) {
+	cfgs, err := loadEmailConfigs(currentUserID(c), false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	views := []gin.H{}
+	for _, cfg := range cfgs {
+		views = append(views, emailConfigView(cfg))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      views,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleCreateEmailConfig(c *gin.Context) {
+	if !requireEmailSecrets(c) {
+		return
+	}
+
+	var req emailConfigRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cfg, err := applyEmailConfigRequest(EmailConfig{Enabled: true}, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cfg.ID, err = insertEmailConfig(currentUserID(c), cfg)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success":   true,
+		"data":      emailConfigView(cfg),
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleUpdateEmailConfig(c *gin.Context) {
+	if !requireEmailSecrets(c) {
+		return
+	}
+
+	old, ok := emailConfigFromParam(c)
+	if !ok {
+		return
+	}
+
+	var req emailConfigRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cfg, err := applyEmailConfigRequest(old, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := updateEmailConfig(old, cfg); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      emailConfigView(cfg),
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleDeleteEmailConfig 删除邮箱配置（已拉取的账单保留）
+func handleDeleteEmailConfig(c *gin.Context) {
+	cfg, ok := emailConfigFromParam(c)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM email_config WHERE id = ?`, cfg.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := resetMailboxState(tx, cfg.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "timestamp": time.Now().Unix()})
+}
+
+// requireEmailSecrets 未配置加密密钥时拒绝读写授权码
+func requireEmailSecrets(c *gin.Context) bool {
+	if !emailSecretsReady() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoSecretKey.Error()})
+		return false
+	}
+	return true
+}
+
+// emailConfigFromParam 读取路径中 :id 对应的当前用户配置，失败时已写好响应
+func emailConfigFromParam(c *gin.Context) (EmailConfig, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "邮箱配置不存在"})
+		return EmailConfig{}, false
+	}
+	cfg, err := loadEmailConfig(currentUserID(c), id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "邮箱配置不存在"})
+		return cfg, false
+	}
+	if err != nil {
+		log.Printf("[bills] 读取邮箱配置失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return cfg, false
+	}
+	return cfg, true
+}
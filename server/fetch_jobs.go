@@ -0,0 +1,322 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"card-server/billingcycle"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────
+// 账单定时拉取
+//
+// 后台调度器定期检查每个配置了邮箱的用户，满足以下任一条件就在后台拉取一次：
+//   - 距上次拉取已超过 BILL_FETCH_INTERVAL（默认 24h，设为 0 关闭定时拉取）
+//   - 昨天是某张卡的账单日（银行一般次日发账单邮件），且今天还没拉取过
+// 每次拉取（定时、手动、异步触发）都记录在 fetch_jobs 表中。
+// ─────────────────────────────────────────
+
+// FetchJob 一次账单拉取任务
+type FetchJob struct {
+	ID         int64  `json:"id"`
+	Trigger    string `json:"trigger"` // schedule/manual/async/backfill
+	Status     string `json:"status"`  // running/success/failed
+	StartedAt  int64  `json:"startedAt"`
+	FinishedAt int64  `json:"finishedAt,omitempty"`
+	Total      int    `json:"total"`
+	Saved      int    `json:"saved"`
+	Skipped    int    `json:"skipped"`
+	Error      string `json:"error,omitempty"`
+}
+
+// fetchResult 一次拉取的统计结果
+type fetchResult struct {
+	total, saved, skipped int
+}
+
+const (
+	jobTriggerSchedule = "schedule"
+	jobTriggerManual   = "manual"
+	jobTriggerAsync    = "async"
+	jobTriggerBackfill = "backfill"
+
+	jobStatusRunning = "running"
+	jobStatusSuccess = "success"
+	jobStatusFailed  = "failed"
+)
+
+// 调度器检查间隔
+const schedulerTick = 10 * time.Minute
+
+// 同一用户同一时间只允许一个拉取任务
+var (
+	runningFetchesMu sync.Mutex
+	runningFetches   = map[string]bool{}
+)
+
+var errFetchRunning = fmt.Errorf("已有拉取任务正在进行")
+
+// ─────────────────────────────────────────
+// 任务执行
+// ─────────────────────────────────────────
+
+// startFetchJob 登记任务；同一用户已有任务在跑时返回 errFetchRunning
+func startFetchJob(userID, trigger string) (int64, error) {
+	runningFetchesMu.Lock()
+	defer runningFetchesMu.Unlock()
+	if runningFetches[userID] {
+		return 0, errFetchRunning
+	}
+
+	res, err := db.Exec(`INSERT INTO fetch_jobs (user_id, trigger_type, status, started_at) VALUES (?, ?, ?, ?)`,
+		userID, trigger, jobStatusRunning, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	runningFetches[userID] = true
+	return res.LastInsertId()
+}
+
+// runFetchJob 执行已登记的任务并记录结果
+func runFetchJob(jobID int64, userID string, backfill bool) (fetchResult, error) {
+	defer func() {
+		runningFetchesMu.Lock()
+		delete(runningFetches, userID)
+		runningFetchesMu.Unlock()
+	}()
+
+	result, err := fetchAndSaveBills(userID, backfill)
+
+	status, errMsg := jobStatusSuccess, ""
+	if err != nil {
+		status, errMsg = jobStatusFailed, err.Error()
+		log.Printf("[jobs] 拉取任务(%d)失败: %v", jobID, err)
+	}
+	_, dbErr := db.Exec(`
+		UPDATE fetch_jobs SET status = ?, finished_at = ?, total = ?, saved = ?, skipped = ?, error = ?
+		WHERE id = ?`,
+		status, time.Now().Unix(), result.total, result.saved, result.skipped, errMsg, jobID)
+	if dbErr != nil {
+		log.Printf("[jobs] 更新任务(%d)状态失败: %v", jobID, dbErr)
+	}
+	return result, err
+}
+
+// ─────────────────────────────────────────
+// 调度器
+// ─────────────────────────────────────────
+
+// fetchInterval 读取 BILL_FETCH_INTERVAL（如 12h、30m），0 表示关闭定时拉取
+func fetchInterval() time.Duration {
+	raw := os.Getenv("BILL_FETCH_INTERVAL")
+	if raw == "" {
+		return 24 * time.Hour
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Printf("[jobs] BILL_FETCH_INTERVAL 格式错误(%s)，使用默认 24h", raw)
+		return 24 * time.Hour
+	}
+	return d
+}
+
+// startBillScheduler 启动后台调度（由 main 调用）
+func startBillScheduler() {
+	// 上次进程退出时未完成的任务标记为失败
+	_, err := db.Exec(`UPDATE fetch_jobs SET status = ?, error = ?, finished_at = ? WHERE status = ?`,
+		jobStatusFailed, "服务重启，任务中断", time.Now().Unix(), jobStatusRunning)
+	if err != nil {
+		log.Printf("[jobs] 清理中断任务失败: %v", err)
+	}
+
+	if !emailSecretsReady() {
+		log.Println("[jobs] 未配置邮箱加密密钥，不启动账单定时拉取")
+		return
+	}
+
+	interval := fetchInterval()
+	if interval <= 0 {
+		log.Println("[jobs] 已关闭账单定时拉取")
+		return
+	}
+
+	log.Printf("[jobs] 账单定时拉取已启动，间隔 %s", interval)
+	go func() {
+		for {
+			runDueFetches(interval, time.Now())
+			time.Sleep(schedulerTick)
+		}
+	}()
+}
+
+// runDueFetches 为所有到期的用户依次执行拉取
+func runDueFetches(interval time.Duration, now time.Time) {
+	rows, err := db.Query(`SELECT DISTINCT user_id FROM email_config WHERE user_id != '' AND enabled = 1`)
+	if err != nil {
+		log.Printf("[jobs] 读取邮箱配置失败: %v", err)
+		return
+	}
+	var users []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err == nil {
+			users = append(users, userID)
+		}
+	}
+	rows.Close()
+
+	for _, userID := range users {
+		due, err := fetchDue(userID, interval, now)
+		if err != nil {
+			log.Printf("[jobs] 检查用户(%s)拉取计划失败: %v", userID, err)
+			continue
+		}
+		if !due {
+			continue
+		}
+		jobID, err := startFetchJob(userID, jobTriggerSchedule)
+		if err != nil {
+			continue
+		}
+		runFetchJob(jobID, userID, false)
+	}
+}
+
+// fetchDue 判断用户是否需要拉取
+func fetchDue(userID string, interval time.Duration, now time.Time) (bool, error) {
+	var lastStarted sql.NullInt64
+	err := db.QueryRow(`SELECT MAX(started_at) FROM fetch_jobs WHERE user_id = ?`, userID).Scan(&lastStarted)
+	if err != nil {
+		return false, err
+	}
+	if !lastStarted.Valid || now.Sub(time.Unix(lastStarted.Int64, 0)) >= interval {
+		return true, nil
+	}
+
+	// 昨天是账单日的卡片，今天还没拉过就补拉一次
+	startOfToday := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if lastStarted.Int64 >= startOfToday.Unix() {
+		return false, nil
+	}
+	yesterday := now.AddDate(0, 0, -1)
+	for _, card := range getCardsAll(userID) {
+		if (billingcycle.Rule{BillingDay: card.BillingDay}).IsStatementDate(yesterday) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：/api/v1/bills/jobs
+// ─────────────────────────────────────────
+
+// handleTriggerFetchJob 异步触发一次拉取，立即返回任务ID。
+// ?backfill=true 时扫描各文件夹的全部历史邮件（用于首次导入历史账单）。
+func handleTriggerFetchJob(c *gin.Context) {
+	userID := currentUserID(c)
+	if !requireEmailSecrets(c) {
+		return
+	}
+	if !hasEnabledEmailConfig(userID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "未配置邮箱，请先在设置中配置邮箱授权码"})
+		return
+	}
+
+	backfill := c.Query("backfill") == "true"
+	trigger := jobTriggerAsync
+	if backfill {
+		trigger = jobTriggerBackfill
+	}
+
+	jobID, err := startFetchJob(userID, trigger)
+	if err == errFetchRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	go runFetchJob(jobID, userID, backfill)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"success":   true,
+		"data":      gin.H{"jobId": jobID},
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleListFetchJobs(c *gin.Context) {
+	limit := 50
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil && n > 0 && n <= 500 {
+		limit = n
+	}
+
+	rows, err := db.Query(`
+		SELECT id, trigger_type, status, started_at, COALESCE(finished_at, 0),
+		       total, saved, skipped, COALESCE(error, '')
+		FROM fetch_jobs WHERE user_id = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, currentUserID(c), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	jobs := []FetchJob{}
+	for rows.Next() {
+		j, err := scanFetchJob(rows)
+		if err != nil {
+			log.Printf("[jobs] Scan失败: %v", err)
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      jobs,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleGetFetchJob(c *gin.Context) {
+	row := db.QueryRow(`
+		SELECT id, trigger_type, status, started_at, COALESCE(finished_at, 0),
+		       total, saved, skipped, COALESCE(error, '')
+		FROM fetch_jobs WHERE id = ? AND user_id = ?
+	`, c.Param("id"), currentUserID(c))
+	j, err := scanFetchJob(row)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "任务不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": j, "timestamp": time.Now().Unix()})
+}
+
+// rowScanner 同时兼容 *sql.Row 和 *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanFetchJob(r rowScanner) (FetchJob, error) {
+	var j FetchJob
+	err := r.Scan(&j.ID, &j.Trigger, &j.Status, &j.StartedAt, &j.FinishedAt,
+		&j.Total, &j.Saved, &j.Skipped, &j.Error)
+	return j, err
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────
+// 汇率表
+//
+// 服务端不联网取汇率，由用户导入 CSV 维护（每行：日期,币种,汇率），汇率为 1 单位外币折合的人民币。
+// 折算时取交易/账单日当天或之前最近的一条汇率，早于所有记录的日期用最早的一条；
+// 没有该币种汇率时折算失败，汇总中单独列出缺少汇率的币种。
+// ─────────────────────────────────────────
+
+// FXRate 一条汇率记录
+type FXRate struct {
+	ID       int64   `json:"id"`
+	Currency string  `json:"currency"`
+	Date     string  `json:"date"` // YYYY-MM-DD
+	Rate     float64 `json:"rate"` // 1 单位外币折合人民币
+}
+
+// fxTable 币种 → 按日期升序的汇率
+type fxTable map[string][]FXRate
+
+func loadFXRates(userID string) (fxTable, error) {
+	rows, err := db.Query(`SELECT id, currency, rate_date, rate FROM fx_rates WHERE user_id = ? ORDER BY currency, rate_date`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	t := fxTable{}
+	for rows.Next() {
+		var r FXRate
+		if err := rows.Scan(&r.ID, &r.Currency, &r.Date, &r.Rate); err != nil {
+			return nil, err
+		}
+		t[r.Currency] = append(t[r.Currency], r)
+	}
+	return t, rows.Err()
+}
+
+// toCNY 折算为人民币；没有该币种汇率时返回 false
+func (t fxTable) toCNY(amount float64, currency, date string) (float64, bool) {
+	if currency == "" || currency == "CNY" {
+		return amount, true
+	}
+	rates := t[currency]
+	if len(rates) == 0 {
+		return 0, false
+	}
+	// 第一条日期大于 date 的位置，前一条即当天或之前最近的汇率
+	i := sort.Search(len(rates), func(i int) bool { return rates[i].Date > date })
+	if i > 0 {
+		i--
+	}
+	return amount * rates[i].Rate, true
+}
+
+// parseFXCSV 解析汇率 CSV，首行不是数据时视为表头跳过；返回逐行错误
+func parseFXCSV(r io.Reader) ([]FXRate, []string) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	var rates []FXRate
+	var errs []string
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("第%d行: %v", line, err))
+			break
+		}
+		if len(rec) == 1 && strings.TrimSpace(rec[0]) == "" {
+			continue
+		}
+		rate, err := parseFXRecord(rec)
+		if err != nil {
+			if line == 1 {
+				continue // 表头
+			}
+			errs = append(errs, fmt.Sprintf("第%d行: %v", line, err))
+			continue
+		}
+		rates = append(rates, rate)
+	}
+	return rates, errs
+}
+
+func parseFXRecord(rec []string) (FXRate, error) {
+	if len(rec) < 3 {
+		return FXRate{}, fmt.Errorf("应为 日期,币种,汇率 三列")
+	}
+	date, err := time.Parse("2006-01-02", strings.ReplaceAll(strings.TrimSpace(rec[0]), "/", "-"))
+	if err != nil {
+		return FXRate{}, fmt.Errorf("日期格式应为 YYYY-MM-DD")
+	}
+	cur := strings.ToUpper(strings.TrimSpace(rec[1]))
+	if code, ok := currencyWords[cur]; ok {
+		cur = code
+	}
+	if len(cur) != 3 || cur == "CNY" {
+		return FXRate{}, fmt.Errorf("币种无效: %s", rec[1])
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(rec[2]), 64)
+	if err != nil || rate <= 0 {
+		return FXRate{}, fmt.Errorf("汇率无效: %s", rec[2])
+	}
+	return FXRate{Currency: cur, Date: date.Format("2006-01-02"), Rate: rate}, nil
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：/api/v1/fx-rates
+// ─────────────────────────────────────────
+
+// handleListFXRates GET /api/v1/fx-rates?currency=USD
+func handleListFXRates(c *gin.Context) {
+	query := `SELECT id, currency, rate_date, rate FROM fx_rates WHERE user_id = ?`
+	args := []any{currentUserID(c)}
+	if cur := strings.ToUpper(c.Query("currency")); cur != "" {
+		query += ` AND currency = ?`
+		args = append(args, cur)
+	}
+	rows, err := db.Query(query+` ORDER BY currency, rate_date DESC`, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	rates := []FXRate{}
+	for rows.Next() {
+		var r FXRate
+		if err := rows.Scan(&r.ID, &r.Currency, &r.Date, &r.Rate); err != nil {
+			log.Printf("[fx] Scan失败: %v", err)
+			continue
+		}
+		rates = append(rates, r)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      rates,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleImportFXRates POST /api/v1/fx-rates/import
+// 请求体为 CSV 文本，或 multipart 表单的 file 字段。任一行有误时整批不导入；同币种同日期的记录被覆盖。
+func handleImportFXRates(c *gin.Context) {
+	var body io.Reader = c.Request.Body
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		fh, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "缺少 file 字段"})
+			return
+		}
+		f, err := fh.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+
+	rates, errs := parseFXCSV(io.LimitReader(body, 5<<20))
+	if len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSV 有误，未导入", "details": errs})
+		return
+	}
+	if len(rates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSV 中没有汇率"})
+		return
+	}
+
+	userID := currentUserID(c)
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now().Unix()
+	for _, r := range rates {
+		_, err := tx.Exec(`
+			INSERT INTO fx_rates (user_id, currency, rate_date, rate, updated_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(user_id, currency, rate_date) DO UPDATE SET rate = excluded.rate, updated_at = excluded.updated_at
+		`, userID, r.Currency, r.Date, r.Rate, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("[fx] 用户 %s 导入汇率 %d 条", userID, len(rates))
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      gin.H{"imported": len(rates)},
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleDeleteFXRate(c *gin.Context) {
+	res, err := db.Exec(`DELETE FROM fx_rates WHERE id = ? AND user_id = ?`, c.Param("id"), currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "汇率不存在"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "timestamp": time.Now().Unix()})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// ─────────────────────────────────────────
+// HTML 账单结构化提取
+//
+// 银行的 HTML 账单大多把“标签 | 数值”放在表格里，有的表头在上一行、数值在下一行。
+// 这里用 HTML 分词器逐个读取标签：块级元素和表格行换行，单元格之间留空格，
+// 实体（&yen; &#165; &ensp; 等）全部解码；同时按 行/列 保存每个表格，
+// 供解析器用 tableValue 查询“标签 X 旁边的值”。不处理 rowspan。
+// ─────────────────────────────────────────
+
+// htmlCell 表格单元格
+type htmlCell struct {
+	text string
+	col  int // 起始列号（已计入左侧单元格的 colspan）
+	span int
+}
+
+// htmlTable 一个表格的全部行（嵌套表格单独成表，不计入外层单元格）
+type htmlTable struct {
+	rows [][]htmlCell
+}
+
+// 整段内容都不输出的元素
+var htmlSkipTags = map[string]bool{
+	"head": true, "title": true, "script": true, "style": true, "noscript": true, "template": true,
+}
+
+// 开始和结束时都换行的元素
+var htmlBlockTags = map[string]bool{
+	"p": true, "div": true, "li": true, "ul": true, "ol": true, "dl": true, "dt": true, "dd": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "hr": true,
+	"section": true, "article": true, "header": true, "footer": true, "center": true,
+	"blockquote": true, "pre": true, "caption": true,
+}
+
+// tableBuilder 正在读取的表格
+type tableBuilder struct {
+	table   htmlTable
+	row     []htmlCell
+	inRow   bool
+	cell    *strings.Builder
+	span    int
+	nextCol int
+}
+
+func (t *tableBuilder) closeCell() {
+	if t.cell == nil {
+		return
+	}
+	t.row = append(t.row, htmlCell{text: collapseSpaces(t.cell.String()), col: t.nextCol, span: t.span})
+	t.nextCol += t.span
+	t.cell = nil
+}
+
+func (t *tableBuilder) closeRow() {
+	t.closeCell()
+	if t.inRow && len(t.row) > 0 {
+		t.table.rows = append(t.table.rows, t.row)
+	}
+	t.row, t.inRow, t.nextCol = nil, false, 0
+}
+
+func (t *tableBuilder) openCell(span int) {
+	t.closeCell()
+	// <td> 前缺少 <tr> 时视为新行
+	t.inRow = true
+	t.cell = &strings.Builder{}
+	t.span = span
+}
+
+// htmlToText 把 HTML 转成按行排列的文本，并返回其中的表格
+func htmlToText(src string) (string, []htmlTable) {
+	z := html.NewTokenizer(strings.NewReader(src))
+
+	var (
+		lines  []string
+		line   strings.Builder
+		stack  []*tableBuilder
+		tables []htmlTable
+		skip   string // 正在跳过的元素名
+	)
+	flushLine := func() {
+		if s := collapseSpaces(line.String()); s != "" {
+			lines = append(lines, s)
+		}
+		line.Reset()
+	}
+	top := func() *tableBuilder {
+		if len(stack) == 0 {
+			return nil
+		}
+		return stack[len(stack)-1]
+	}
+	// 单元格内的换行只当作空格，保证表格的一行仍是文本的一行
+	breakLine := func() {
+		if t := top(); t != nil && t.cell != nil {
+			line.WriteByte(' ')
+			t.cell.WriteByte(' ')
+			return
+		}
+		flushLine()
+	}
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break // io.EOF 或畸形输入，已读到的部分照常输出
+		}
+		tok := z.Token()
+
+		if skip != "" {
+			if tt == html.EndTagToken && tok.Data == skip {
+				skip = ""
+			}
+			continue
+		}
+
+		switch tt {
+		case html.TextToken:
+			// 分词器已解码实体，&nbsp; 解码为 U+00A0，统一当作普通空格
+			text := strings.ReplaceAll(tok.Data, "\u00a0", " ")
+			line.WriteString(text)
+			if t := top(); t != nil && t.cell != nil {
+				t.cell.WriteString(text)
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch name := tok.Data; {
+			case htmlSkipTags[name] && tt == html.StartTagToken:
+				skip = name
+			case name == "br":
+				breakLine()
+			case name == "table":
+				if t := top(); t != nil && t.cell != nil {
+					t.cell.WriteByte(' ')
+				}
+				flushLine()
+				stack = append(stack, &tableBuilder{})
+			case name == "tr":
+				if t := top(); t != nil {
+					t.closeRow()
+					t.inRow = true
+				}
+				flushLine()
+			case name == "td" || name == "th":
+				if t := top(); t != nil {
+					t.openCell(colspan(tok))
+				}
+				line.WriteByte(' ')
+			case htmlBlockTags[name]:
+				breakLine()
+			}
+
+		case html.EndTagToken:
+			switch name := tok.Data; {
+			case name == "table":
+				if t := top(); t != nil {
+					t.closeRow()
+					if len(t.table.rows) > 0 {
+						tables = append(tables, t.table)
+					}
+					stack = stack[:len(stack)-1]
+				}
+				flushLine()
+			case name == "tr":
+				if t := top(); t != nil {
+					t.closeRow()
+				}
+				flushLine()
+			case name == "td" || name == "th":
+				if t := top(); t != nil {
+					t.closeCell()
+				}
+				line.WriteByte(' ')
+			case htmlBlockTags[name]:
+				breakLine()
+			}
+		}
+	}
+
+	// 未闭合的表格也保留
+	for i := len(stack) - 1; i >= 0; i-- {
+		stack[i].closeRow()
+		if len(stack[i].table.rows) > 0 {
+			tables = append(tables, stack[i].table)
+		}
+	}
+	flushLine()
+	return strings.Join(lines, "\n"), tables
+}
+
+func colspan(tok html.Token) int {
+	for _, a := range tok.Attr {
+		if a.Key == "colspan" {
+			if n, err := strconv.Atoi(strings.TrimSpace(a.Val)); err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+	return 1
+}
+
+// collapseSpaces 合并连续空白并去掉首尾空白
+func collapseSpaces(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// ─────────────────────────────────────────
+// 按标签查值
+// ─────────────────────────────────────────
+
+// tableValue 在邮件的 HTML 表格中查找 labels 中第一个能取到值的标签，返回 valueRe 第一个分组。
+// 单元格以标签开头即视为标签单元格（“本期应还款额（人民币）”能匹配“本期应还款额”，
+// “最低应还款额”不会匹配“应还款额”），值依次从以下位置取：
+// 标签单元格中标签之后的文字、同一行右侧的单元格、下一行覆盖同一列的单元格。
+func (pb *parsedBill) tableValue(valueRe *regexp.Regexp, labels ...string) string {
+	for _, label := range labels {
+		for _, t := range pb.tables {
+			if v := t.valueNextTo(label, valueRe); v != "" {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+func (t htmlTable) valueNextTo(label string, valueRe *regexp.Regexp) string {
+	for r, row := range t.rows {
+		for i, cell := range row {
+			rest, ok := strings.CutPrefix(cell.text, label)
+			if !ok {
+				continue
+			}
+			if v := firstGroup(valueRe, rest); v != "" {
+				return v
+			}
+			for _, right := range row[i+1:] {
+				if right.text == "" {
+					continue
+				}
+				if v := firstGroup(valueRe, right.text); v != "" {
+					return v
+				}
+				break
+			}
+			if r+1 < len(t.rows) {
+				for _, below := range t.rows[r+1] {
+					if below.col <= cell.col && cell.col < below.col+below.span {
+						if v := firstGroup(valueRe, below.text); v != "" {
+							return v
+						}
+						break
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// ─────────────────────────────────────────
+// IMAP 增量拉取状态
+//
+// 每个邮箱账号的每个文件夹记录 UIDVALIDITY 和已处理的最大 UID，下次只 UID SEARCH 比它大的新邮件。
+// 服务器的 UIDVALIDITY 变化说明旧 UID 已失效，此时清空进度从头开始，已入库的账单按 Message-ID 去重（见 findEmailBill）。
+// 首次拉取只取最近 initialFetchLimit 封；需要整个历史时用 backfill 模式拉一次全量。
+//
+// 进度越过的疑似账单邮件如果没能入库（没匹配到卡片、PDF 打不开、保存失败），记入 mail_retries，
+// 之后每次拉取连同新邮件一起再试，最多 maxMailRetries 次。补充了卡片或 PDF 密码后，这些邮件会自动入库。
+// ─────────────────────────────────────────
+
+// mailboxState 一个邮箱文件夹的拉取进度
+type mailboxState struct {
+	ConfigID    int64
+	Mailbox     string
+	UIDValidity uint32
+	LastUID     uint32
+}
+
+const (
+	// 首次（非 backfill）拉取时最多取的邮件数
+	initialFetchLimit = 100
+	// 每批 UID FETCH 的邮件数
+	fetchBatchSize = 50
+	// 未能入库的邮件最多重试的次数，之后只能用 backfill 重新拉取
+	maxMailRetries = 5
+)
+
+func loadMailboxState(configID int64, mailbox string) (mailboxState, error) {
+	st := mailboxState{ConfigID: configID, Mailbox: mailbox}
+	err := db.QueryRow(`SELECT uid_validity, last_uid FROM mailbox_state WHERE config_id = ? AND mailbox = ?`,
+		configID, mailbox).Scan(&st.UIDValidity, &st.LastUID)
+	if err == sql.ErrNoRows {
+		return st, nil
+	}
+	return st, err
+}
+
+func saveMailboxState(st mailboxState) error {
+	_, err := db.Exec(`
+		INSERT INTO mailbox_state (config_id, mailbox, uid_validity, last_uid, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(config_id, mailbox) DO UPDATE SET
+			uid_validity = excluded.uid_validity,
+			last_uid = excluded.last_uid,
+			updated_at = excluded.updated_at
+	`, st.ConfigID, st.Mailbox, st.UIDValidity, st.LastUID, time.Now().Unix())
+	return err
+}
+
+// resetMailboxState 清空邮箱账号的拉取进度（更换或删除邮箱账号时调用）
+func resetMailboxState(ex execer, configID int64) error {
+	if _, err := ex.Exec(`DELETE FROM mailbox_state WHERE config_id = ?`, configID); err != nil {
+		return err
+	}
+	_, err := ex.Exec(`DELETE FROM mail_retries WHERE config_id = ?`, configID)
+	return err
+}
+
+// adoptUIDValidity 首次记录 UIDVALIDITY 时，把引入增量拉取之前保存的账单归到当前 UIDVALIDITY 下，
+// 避免同一封邮件以新的 (uid_validity, uid) 再存一份
+func adoptUIDValidity(st mailboxState) error {
+	_, err := db.Exec(`
+		UPDATE bill_statements SET email_uid_validity = ?
+		WHERE email_config_id = ? AND mailbox = ? AND email_uid_validity = 0
+	`, st.UIDValidity, st.ConfigID, st.Mailbox)
+	return err
+}
+
+// syncUIDValidity 根据服务器返回的 UIDVALIDITY 校正本地进度
+func syncUIDValidity(st mailboxState, uidValidity uint32) mailboxState {
+	if st.UIDValidity == uidValidity {
+		return st
+	}
+	if st.UIDValidity != 0 {
+		log.Printf("[bills] 邮箱 %s 的 UIDVALIDITY 已变化(%d → %d)，从头拉取",
+			st.Mailbox, st.UIDValidity, uidValidity)
+	}
+	return mailboxState{ConfigID: st.ConfigID, Mailbox: st.Mailbox, UIDValidity: uidValidity}
+}
+
+// pendingUIDs 从 UID SEARCH 结果中挑出待拉取的 UID（升序）
+func pendingUIDs(found []uint32, st mailboxState, backfill bool) []uint32 {
+	var uids []uint32
+	for _, uid := range found {
+		// "N:*" 在没有新邮件时也会返回最后一封，需要再过滤一次
+		if backfill || uid > st.LastUID {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	if !backfill && st.LastUID == 0 && len(uids) > initialFetchLimit {
+		uids = uids[len(uids)-initialFetchLimit:]
+	}
+	return uids
+}
+
+// uidRange 待搜索的 UID 范围：增量为 LastUID+1:*，backfill 为 1:*
+func uidRange(st mailboxState, backfill bool) *imap.SeqSet {
+	from := st.LastUID + 1
+	if backfill {
+		from = 1
+	}
+	set := new(imap.SeqSet)
+	set.AddRange(from, 0)
+	return set
+}
+
+// ─────────────────────────────────────────
+// 重试列表
+// ─────────────────────────────────────────
+
+// loadMailRetries 当前 UIDVALIDITY 下待重试的邮件 UID
+func loadMailRetries(st mailboxState) ([]uint32, error) {
+	rows, err := db.Query(`
+		SELECT uid FROM mail_retries
+		WHERE config_id = ? AND mailbox = ? AND uid_validity = ?
+		ORDER BY uid`, st.ConfigID, st.Mailbox, st.UIDValidity)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uids []uint32
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, rows.Err()
+}
+
+// saveMailRetries 记录本次没能入库的邮件（failed 为 UID → 原因），并清理重试列表：
+// UIDVALIDITY 已变化的、本次重试成功或已不在文件夹中的、超过重试次数的。
+// 拉取中途出错（complete 为 false）时没拉到的重试项保留到下次。
+func saveMailRetries(st mailboxState, retried []uint32, failed map[uint32]string, complete bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM mail_retries WHERE config_id = ? AND mailbox = ? AND uid_validity != ?`,
+		st.ConfigID, st.Mailbox, st.UIDValidity)
+	if err != nil {
+		return err
+	}
+	if complete {
+		for _, uid := range retried {
+			if _, ok := failed[uid]; ok {
+				continue
+			}
+			_, err := tx.Exec(`DELETE FROM mail_retries WHERE config_id = ? AND mailbox = ? AND uid_validity = ? AND uid = ?`,
+				st.ConfigID, st.Mailbox, st.UIDValidity, uid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	now := time.Now().Unix()
+	for uid, reason := range failed {
+		_, err := tx.Exec(`
+			INSERT INTO mail_retries (config_id, mailbox, uid_validity, uid, last_error, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(config_id, mailbox, uid_validity, uid) DO UPDATE SET
+				attempts = attempts + 1,
+				last_error = excluded.last_error,
+				updated_at = excluded.updated_at
+		`, st.ConfigID, st.Mailbox, st.UIDValidity, uid, reason, now)
+		if err != nil {
+			return err
+		}
+	}
+	res, err := tx.Exec(`DELETE FROM mail_retries WHERE config_id = ? AND mailbox = ? AND attempts > ?`,
+		st.ConfigID, st.Mailbox, maxMailRetries)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("[bills] 邮箱 %s 有 %d 封邮件重试 %d 次仍未入库，不再自动重试", st.Mailbox, n, maxMailRetries)
+	}
+	return tx.Commit()
+}
+
+// withRetries 把待重试的 UID 并入本次要拉取的 UID（升序、去重）
+func withRetries(uids, retries []uint32) []uint32 {
+	if len(retries) == 0 {
+		return uids
+	}
+	seen := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		seen[uid] = true
+	}
+	for _, uid := range retries {
+		if !seen[uid] {
+			seen[uid] = true
+			uids = append(uids, uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
@@ -3,9 +3,14 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -16,53 +21,93 @@ import (
 
 // Card 信用卡数据结构（存储加密后的数据）
 type Card struct {
-	ID             json.Number `json:"id"`
-	SyncID         string      `json:"syncId"`
-	Name           string      `json:"name"`
-	Bank           string      `json:"bank"`
-	CardNumber     string      `json:"cardNumber"`
-	CVV            string      `json:"cvv"`
-	ExpiryDate     string      `json:"expiryDate"`
-	CardholderName string      `json:"cardholderName"`
-	CreditLimit    float64     `json:"creditLimit"`
-	BillingDay     int         `json:"billingDay"`
-	PaymentDueDay  int         `json:"paymentDueDay"`
-	Color          string      `json:"color"`
-	CardFrontImage string      `json:"cardFrontImage,omitempty"`
-	CardBackImage  string      `json:"cardBackImage,omitempty"`
-	Notes          string      `json:"notes,omitempty"`
-	IsDeleted      bool        `json:"isDeleted"`
-	CreatedAt      int64       `json:"createdAt"`
-	UpdatedAt      int64       `json:"updatedAt"`
-	IV             string      `json:"iv,omitempty"`
-	Owner          string      `json:"owner,omitempty"`
-	LastFour       string      `json:"lastFour,omitempty"` // 卡号后4位（明文，用于账单匹配）
+	ID                 json.Number `json:"id"`
+	SyncID             string      `json:"syncId"`
+	Name               string      `json:"name"`
+	Bank               string      `json:"bank"`
+	CardNumber         string      `json:"cardNumber"`
+	CVV                string      `json:"cvv"`
+	ExpiryDate         string      `json:"expiryDate"`
+	CardholderName     string      `json:"cardholderName"`
+	CreditLimit        float64     `json:"creditLimit"`
+	BillingDay         int         `json:"billingDay"`
+	PaymentDueDay      int         `json:"paymentDueDay"`
+	Color              string      `json:"color"`
+	CardFrontImage     string      `json:"cardFrontImage,omitempty"` // 图片内容，仅兼容旧客户端（服务器存为 blob）
+	CardBackImage      string      `json:"cardBackImage,omitempty"`
+	CardFrontImageHash string      `json:"cardFrontImageHash,omitempty"` // 图片 blob 的 SHA-256
+	CardBackImageHash  string      `json:"cardBackImageHash,omitempty"`
+	Notes              string      `json:"notes,omitempty"`
+	IsDeleted          bool        `json:"isDeleted"`
+	CreatedAt          int64       `json:"createdAt"`
+	UpdatedAt          int64       `json:"updatedAt"`
+	IV                 string      `json:"iv,omitempty"`
+	Owner              string      `json:"owner,omitempty"`
+	LastFour           string      `json:"lastFour,omitempty"` // 卡号后4位（明文，用于账单匹配）
+	Version            int64       `json:"version"`            // 服务器维护的行版本号
+
+	// 以下字段仅在客户端提交时使用（字段级合并，见 sync_merge.go）
+	BaseVersion   int64    `json:"baseVersion,omitempty"`   // 客户端修改前看到的 version
+	ChangedFields []string `json:"changedFields,omitempty"` // 客户端实际修改过的字段
 }
 
 // SyncRequest 同步请求
 type SyncRequest struct {
 	Cards      []Card `json:"cards"`
-	LastSyncAt int64  `json:"lastSyncAt"`
+	LastSyncAt int64  `json:"lastSyncAt"` // 已废弃，仅兼容不支持 cursor 的旧客户端
+	Cursor     string `json:"cursor"`     // 上次同步返回的游标，首次同步为空
 	DeviceID   string `json:"deviceId"`
+
+	// 图片传输方式：inline（默认，图片内容放在卡片里）或 blob（只传哈希，客户端按需下载）
+	ImageMode  string   `json:"imageMode"`
+	KnownBlobs []string `json:"knownBlobs"` // blob 模式下客户端本地已有的图片哈希
 }
 
 // SyncResponse 同步响应
 type SyncResponse struct {
-	Cards      []Card `json:"cards"`
-	ServerTime int64  `json:"serverTime"`
-	Success    bool   `json:"success"`
+	Cards        []Card         `json:"cards"`
+	Conflicts    []SyncConflict `json:"conflicts"`
+	Failed       []SyncFailure  `json:"failed"` // 未能保存的卡片，客户端应保留本地修改稍后重试
+	Cursor       string         `json:"cursor"`
+	MissingBlobs []string       `json:"missingBlobs,omitempty"` // blob 模式下客户端需要下载的图片
+	ServerTime   int64          `json:"serverTime"`
+	Success      bool           `json:"success"`
+}
+
+// SyncFailure 同步时未能保存的卡片
+type SyncFailure struct {
+	SyncID string `json:"syncId"`
+	Error  string `json:"error"`
 }
 
 var db *sql.DB
 
+// dataDir 数据目录（数据库、blob 等都放在这里）
+var dataDir string
+
 func main() {
+	showSchemaVersion := flag.Bool("schema-version", false, "打印数据库结构版本后退出（不执行迁移）")
+	flag.Parse()
+
+	if *showSchemaVersion {
+		openDB()
+		defer db.Close()
+		current, err := currentSchemaVersion()
+		if err != nil {
+			log.Fatal("读取数据库结构版本失败:", err)
+		}
+		fmt.Printf("当前结构版本: %d\n最新结构版本: %d\n", current, latestSchemaVersion())
+		return
+	}
+
 	// 初始化数据库
 	initDB()
 	defer db.Close()
 
 	// 设置Gin
 	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
+	r := gin.New()
+	r.Use(gin.LoggerWithFormatter(requestLogFormatter), gin.Recovery())
 
 	// CORS配置 - 允许所有来源（因为是私有部署）
 	r.Use(cors.New(cors.Config{
@@ -78,20 +123,101 @@ func main() {
 	api := r.Group("/api/v1")
 	{
 		api.GET("/health", healthCheck)
-		api.POST("/sync", syncCards)
-		api.GET("/cards", getCards)
-		api.POST("/cards", createCard)
-		api.PUT("/cards/:id", updateCard)
-		api.DELETE("/cards/:id", deleteCard)
+
+		// 用户相关路由（无需登录）
+		api.POST("/auth/register", handleRegister)
+		api.POST("/auth/login", handleLogin)
+
+		// 日历订阅（凭订阅地址中的密钥访问）
+		api.GET("/calendar.ics", handleCalendarFeed)
+	}
+
+	// 以下路由需要登录，数据按用户隔离
+	authed := api.Group("", authRequired())
+	{
+		authed.GET("/auth/me", handleGetMe)
+		authed.POST("/auth/logout", handleLogout)
+		authed.POST("/auth/logout-all", handleLogoutAll)
+
+		// 卡面图片 blob
+		authed.POST("/blobs", handleUploadBlob)
+		authed.GET("/blobs/:hash", handleDownloadBlob)
+
+		// 设备相关路由
+		authed.GET("/devices", handleListDevices)
+		authed.POST("/devices", handleEnrollDevice)
+		authed.DELETE("/devices/:id", handleRevokeDevice)
+
+		authed.POST("/sync", syncCards)
+		authed.GET("/cards", getCards)
+		authed.POST("/cards", createCard)
+		authed.PUT("/cards/:id", updateCard)
+		authed.DELETE("/cards/:id", deleteCard)
+		authed.GET("/cards/:id/cycle", handleGetCardCycle)
+		authed.PUT("/cards/:id/cycle", handleSetCardCycle)
 
 		// 账单相关路由
-		api.GET("/bills", handleGetBills)
-		api.POST("/bills/fetch", handleFetchBills)
-		api.GET("/email-config", handleGetEmailConfig)
-		api.POST("/email-config", handleSaveEmailConfig)
-		api.POST("/email-config/test", handleTestEmailConfig)
+		authed.GET("/bills", handleGetBills)
+		authed.POST("/bills", handleCreateBill)
+		authed.POST("/bills/fetch", handleFetchBills)
+		authed.PUT("/bills/:id", handleUpdateBill)
+		authed.DELETE("/bills/:id", handleDeleteBill)
+		authed.GET("/bills/:id/payments", handleListBillPayments)
+		authed.POST("/bills/:id/payments", handleCreateBillPayment)
+		authed.DELETE("/payments/:id", handleDeleteBillPayment)
+		authed.GET("/bills/:id/transactions", handleGetBillTransactions)
+		authed.PUT("/transactions/:id/category", handleSetTransactionCategory)
+		authed.GET("/spending/categories", handleListSpendingCategories)
+		authed.GET("/spending/summary", handleSpendingSummary)
+		authed.GET("/category-rules", handleListCategoryRules)
+		authed.POST("/category-rules", handleCreateCategoryRule)
+		authed.PUT("/category-rules/:id", handleUpdateCategoryRule)
+		authed.DELETE("/category-rules/:id", handleDeleteCategoryRule)
+		authed.GET("/merchant-categories", handleListMerchantCategories)
+		authed.GET("/fx-rates", handleListFXRates)
+		authed.POST("/fx-rates/import", handleImportFXRates)
+		authed.DELETE("/fx-rates/:id", handleDeleteFXRate)
+		authed.DELETE("/merchant-categories/:id", handleDeleteMerchantCategory)
+		authed.GET("/bills/jobs", handleListFetchJobs)
+		authed.POST("/bills/jobs", handleTriggerFetchJob)
+		authed.GET("/bills/jobs/:id", handleGetFetchJob)
+		authed.GET("/email-config", handleGetEmailConfig)
+		authed.POST("/email-config", handleSaveEmailConfig)
+		authed.POST("/email-config/test", handleTestEmailConfig)
+		authed.GET("/email-configs", handleListEmailConfigs)
+		authed.POST("/email-configs", handleCreateEmailConfig)
+		authed.PUT("/email-configs/:id", handleUpdateEmailConfig)
+		authed.DELETE("/email-configs/:id", handleDeleteEmailConfig)
+		authed.GET("/pdf-passwords", handleListPDFPasswords)
+		authed.POST("/pdf-passwords", handleCreatePDFPassword)
+		authed.DELETE("/pdf-passwords/:id", handleDeletePDFPassword)
+		authed.GET("/parse-rules", handleListParseRules)
+		authed.POST("/parse-rules", handleCreateParseRule)
+		authed.POST("/parse-rules/test", handleTestDraftParseRule)
+		authed.PUT("/parse-rules/:id", handleUpdateParseRule)
+		authed.DELETE("/parse-rules/:id", handleDeleteParseRule)
+		authed.POST("/parse-rules/:id/test", handleTestParseRule)
+		authed.GET("/notifications/preferences", handleGetNotificationPrefs)
+		authed.PUT("/notifications/preferences", handleSaveNotificationPrefs)
+		authed.GET("/notifications/upcoming", handleListUpcomingDues)
+		authed.GET("/notifications/deliveries", handleListReminderDeliveries)
+		authed.POST("/notifications/test", handleTestNotification)
+		authed.GET("/push/vapid-public-key", handleGetVAPIDPublicKey)
+		authed.GET("/push/subscriptions", handleListPushSubscriptions)
+		authed.POST("/push/subscriptions", handleSavePushSubscription)
+		authed.DELETE("/push/subscriptions", handleDeletePushSubscription)
+		authed.POST("/push/test", handleTestPush)
+		authed.GET("/calendar/feed", handleGetCalendarFeed)
+		authed.POST("/calendar/feed", handleCreateCalendarFeed)
+		authed.DELETE("/calendar/feed", handleDeleteCalendarFeed)
 	}
 
+	// 后台定时拉取账单
+	startBillScheduler()
+
+	// 还款到期提醒
+	startReminderScheduler()
+
 	// 获取端口
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -103,10 +229,28 @@ func main() {
 }
 
 func initDB() {
+	openDB()
+
+	// 图片 blob 目录（迁移中会用到）
+	initBlobStore()
+
+	// 按顺序应用数据库结构迁移，失败会终止启动
+	runMigrations()
+
+	// 邮箱授权码加密密钥（未配置时停用账单拉取）
+	initEmailSecrets()
+
+	// Web Push 的 VAPID 密钥（首次启动时生成）
+	initVAPIDKeys()
+
+	log.Println("数据库初始化完成")
+}
+
+func openDB() {
 	var err error
 	
 	// 数据目录
-	dataDir := os.Getenv("DATA_DIR")
+	dataDir = os.Getenv("DATA_DIR")
 	if dataDir == "" {
 		dataDir = "./data"
 	}
@@ -117,56 +261,14 @@ func initDB() {
 	if err != nil {
 		log.Fatal("数据库连接失败:", err)
 	}
-
-	// 创建表
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS cards (
-		id TEXT PRIMARY KEY,
-		sync_id TEXT UNIQUE,
-		name TEXT NOT NULL,
-		bank TEXT NOT NULL,
-		card_number TEXT,
-		cvv TEXT,
-		expiry_date TEXT,
-		cardholder_name TEXT,
-		credit_limit REAL,
-		billing_day INTEGER,
-		payment_due_day INTEGER,
-		color TEXT,
-		card_front_image TEXT,
-		card_back_image TEXT,
-		notes TEXT,
-		iv TEXT,
-		owner TEXT,
-		last_four TEXT,
-		is_deleted INTEGER DEFAULT 0,
-		created_at INTEGER,
-		updated_at INTEGER
-	);
-	CREATE INDEX IF NOT EXISTS idx_updated_at ON cards(updated_at);
-	CREATE INDEX IF NOT EXISTS idx_sync_id ON cards(sync_id);
-	`
-	
-	_, err = db.Exec(createTableSQL)
-	if err != nil {
-		log.Fatal("创建表失败:", err)
-	}
-	
-	// 迁移：若旧数据库缺少 owner 列，自动添加（幂等操作）
-	_, _ = db.Exec(`ALTER TABLE cards ADD COLUMN owner TEXT DEFAULT ''`)
-	_, _ = db.Exec(`ALTER TABLE cards ADD COLUMN last_four TEXT DEFAULT ''`)
-
-	// 初始化账单相关表（email_config、bill_statements）
-	initBillsTables()
-
-	log.Println("数据库初始化完成")
 }
 
 func healthCheck(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
-		"status":    "ok",
-		"timestamp": time.Now().Unix(),
-		"version":   "1.0.0",
+		"status":        "ok",
+		"timestamp":     time.Now().Unix(),
+		"version":       "1.0.0",
+		"schemaVersion": latestSchemaVersion(),
 	})
 }
 
@@ -178,38 +280,90 @@ func syncCards(c *gin.Context) {
 		return
 	}
 
+	since, err := decodeCursor(req.Cursor)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := currentUserID(c)
 	serverTime := time.Now().Unix()
 	
-	// 处理客户端发来的卡片
+	// 处理客户端发来的卡片（字段级合并，冲突交回客户端处理）
+	conflicts := []SyncConflict{}
+	failed := []SyncFailure{}
 	for _, card := range req.Cards {
 		if card.SyncID == "" {
 			card.SyncID = uuid.New().String()
 		}
-		upsertCard(card)
+		conflict, err := mergeCard(userID, card)
+		if err != nil {
+			log.Printf("[syncCards] 合并卡片(%s)失败: %v", card.SyncID, err)
+			failed = append(failed, SyncFailure{SyncID: card.SyncID, Error: err.Error()})
+			continue
+		}
+		if conflict != nil {
+			conflicts = append(conflicts, *conflict)
+		}
 	}
 
 	// 获取服务器上更新的卡片
-	serverCards := getCardsSince(req.LastSyncAt)
+	var serverCards []Card
+	var missing []string
+	var cursor string
+	if req.Cursor == "" && req.LastSyncAt > 0 {
+		// 旧客户端：按 updated_at 增量同步，同时下发游标，升级后的客户端可直接改用游标
+		head, err := headRevision(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		serverCards = getCardsSince(userID, req.LastSyncAt)
+		cursor = encodeCursor(head)
+	} else {
+		serverCards, cursor, err = getCardsAfterRevision(userID, since)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	conflictCards := make([]Card, len(conflicts))
+	for i := range conflicts {
+		conflictCards[i] = conflicts[i].Server
+	}
+	if req.ImageMode == "blob" {
+		missing = missingBlobs(append(serverCards, conflictCards...), req.KnownBlobs)
+	} else {
+		inlineCardImages(serverCards)
+		inlineCardImages(conflictCards)
+		for i := range conflicts {
+			conflicts[i].Server = conflictCards[i]
+		}
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"data": gin.H{
-			"cards":      serverCards,
-			"serverTime": serverTime,
+			"cards":        serverCards,
+			"conflicts":    conflicts,
+			"failed":       failed,
+			"cursor":       cursor,
+			"missingBlobs": missing,
+			"serverTime":   serverTime,
 		},
 		"timestamp": serverTime,
 	})
 }
 
 func getCards(c *gin.Context) {
-	rows, err := db.Query(`
-		SELECT id, sync_id, name, bank, card_number, cvv, expiry_date, 
-		       cardholder_name, credit_limit, billing_day, payment_due_day,
-		       color, card_front_image, card_back_image, notes, iv, owner, last_four,
-		       is_deleted, created_at, updated_at
-		FROM cards WHERE is_deleted = 0
-		ORDER BY updated_at DESC
-	`)
+	q, err := parseCardListQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query, args := q.sql(currentUserID(c))
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -224,9 +378,9 @@ func getCards(c *gin.Context) {
 			&card.ID, &card.SyncID, &card.Name, &card.Bank,
 			&card.CardNumber, &card.CVV, &card.ExpiryDate,
 			&card.CardholderName, &card.CreditLimit, &card.BillingDay,
-			&card.PaymentDueDay, &card.Color, &card.CardFrontImage,
-			&card.CardBackImage, &card.Notes, &card.IV, &card.Owner, &card.LastFour,
-			&isDeleted, &card.CreatedAt, &card.UpdatedAt,
+			&card.PaymentDueDay, &card.Color, &card.CardFrontImageHash,
+			&card.CardBackImageHash, &card.Notes, &card.IV, &card.Owner, &card.LastFour,
+			&isDeleted, &card.CreatedAt, &card.UpdatedAt, &card.Version,
 		)
 		if err != nil {
 			continue
@@ -235,7 +389,17 @@ func getCards(c *gin.Context) {
 		cards = append(cards, card)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"cards": cards})
+	// 多取的一条说明还有下一页
+	nextCursor := ""
+	if q.limit > 0 && len(cards) > q.limit {
+		cards = cards[:q.limit]
+		nextCursor = q.nextCursor(cards[len(cards)-1])
+	}
+	if q.includeImages {
+		inlineCardImages(cards)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"cards": cards, "nextCursor": nextCursor})
 }
 
 func createCard(c *gin.Context) {
@@ -245,16 +409,28 @@ func createCard(c *gin.Context) {
 		return
 	}
 
-	card.ID = json.Number(uuid.New().String())
+	userID := currentUserID(c)
 	card.SyncID = uuid.New().String()
 	card.CreatedAt = time.Now().Unix()
 	card.UpdatedAt = card.CreatedAt
 
-	err := insertCard(card)
+	_, err := mergeCard(userID, card)
+	if errors.Is(err, errInvalidBlobRef) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, errCardNotOwned) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if card.ID, err = cardIDBySyncID(userID, card.SyncID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
 	c.JSON(http.StatusCreated, card)
 }
@@ -268,14 +444,37 @@ func updateCard(c *gin.Context) {
 		return
 	}
 
-	card.ID = json.Number(id)
+	userID := currentUserID(c)
 	card.UpdatedAt = time.Now().Unix()
+	if card.SyncID == "" {
+		err := db.QueryRow(`SELECT sync_id FROM cards WHERE (id = ? OR sync_id = ?) AND user_id = ?`, id, id, userID).
+			Scan(&card.SyncID)
+		if err != nil {
+			card.SyncID = uuid.New().String()
+		}
+	}
 
-	err := upsertCard(card)
+	conflict, err := mergeCard(userID, card)
+	if errors.Is(err, errInvalidBlobRef) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, errCardNotOwned) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if conflict != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "卡片已被其他设备修改", "conflict": conflict})
+		return
+	}
+	if card.ID, err = cardIDBySyncID(userID, card.SyncID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
 	c.JSON(http.StatusOK, card)
 }
@@ -283,10 +482,7 @@ func updateCard(c *gin.Context) {
 func deleteCard(c *gin.Context) {
 	id := c.Param("id")
 	
-	_, err := db.Exec(`
-		UPDATE cards SET is_deleted = 1, updated_at = ? WHERE id = ? OR sync_id = ?
-	`, time.Now().Unix(), id, id)
-	
+	err := deleteCardByID(currentUserID(c), id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -295,70 +491,51 @@ func deleteCard(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
-func insertCard(card Card) error {
-	_, err := db.Exec(`
-		INSERT INTO cards (
-			id, sync_id, name, bank, card_number, cvv, expiry_date,
-			cardholder_name, credit_limit, billing_day, payment_due_day,
-			color, card_front_image, card_back_image, notes, iv, owner, last_four,
-			is_deleted, created_at, updated_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`,
-		card.ID, card.SyncID, card.Name, card.Bank, card.CardNumber,
-		card.CVV, card.ExpiryDate, card.CardholderName, card.CreditLimit,
-		card.BillingDay, card.PaymentDueDay, card.Color, card.CardFrontImage,
-		card.CardBackImage, card.Notes, card.IV, card.Owner, card.LastFour, 0, card.CreatedAt, card.UpdatedAt,
-	)
-	return err
-}
+// deleteCardByID 软删除卡片（id 或 sync_id 均可）并记录变更
+func deleteCardByID(userID, id string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-func upsertCard(card Card) error {
-	_, err := db.Exec(`
-		INSERT INTO cards (
-			id, sync_id, name, bank, card_number, cvv, expiry_date,
-			cardholder_name, credit_limit, billing_day, payment_due_day,
-			color, card_front_image, card_back_image, notes, iv, owner, last_four,
-			is_deleted, created_at, updated_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT(sync_id) DO UPDATE SET
-			name = excluded.name,
-			bank = excluded.bank,
-			card_number = excluded.card_number,
-			cvv = excluded.cvv,
-			expiry_date = excluded.expiry_date,
-			cardholder_name = excluded.cardholder_name,
-			credit_limit = excluded.credit_limit,
-			billing_day = excluded.billing_day,
-			payment_due_day = excluded.payment_due_day,
-			color = excluded.color,
-			card_front_image = excluded.card_front_image,
-			card_back_image = excluded.card_back_image,
-			notes = excluded.notes,
-			iv = excluded.iv,
-			owner = excluded.owner,
-				last_four = excluded.last_four,
-			is_deleted = excluded.is_deleted,
-			updated_at = excluded.updated_at
-		WHERE excluded.updated_at > cards.updated_at
-	`,
-		card.ID, card.SyncID, card.Name, card.Bank, card.CardNumber,
-		card.CVV, card.ExpiryDate, card.CardholderName, card.CreditLimit,
-		card.BillingDay, card.PaymentDueDay, card.Color, card.CardFrontImage,
-		card.CardBackImage, card.Notes, card.IV, card.Owner, card.LastFour,
-		boolToInt(card.IsDeleted), card.CreatedAt, card.UpdatedAt,
-	)
-	return err
+	var syncID string
+	err = tx.QueryRow(`SELECT sync_id FROM cards WHERE (id = ? OR sync_id = ?) AND user_id = ?`, id, id, userID).
+		Scan(&syncID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// 删除也是一次字段修改，需要递增版本号，否则其他设备的合并会把它覆盖回来
+	_, err = tx.Exec(`
+		UPDATE cards SET
+			is_deleted = 1,
+			updated_at = ?,
+			version = version + 1,
+			field_versions = json_set(COALESCE(NULLIF(field_versions, ''), '{}'), '$.isDeleted', version + 1)
+		WHERE sync_id = ?
+	`, time.Now().Unix(), syncID)
+	if err != nil {
+		return err
+	}
+	if err := recordCardChange(tx, syncID); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func getCardsSince(since int64) []Card {
+func getCardsSince(userID string, since int64) []Card {
 	rows, err := db.Query(`
 		SELECT id, sync_id, name, bank, card_number, cvv, expiry_date,
 		       cardholder_name, credit_limit, billing_day, payment_due_day,
-		       color, card_front_image, card_back_image, notes, iv, owner, last_four,
-		       is_deleted, created_at, updated_at
-		FROM cards WHERE updated_at > ?
+		       color, card_front_image_hash, card_back_image_hash, notes, iv, owner, last_four,
+		       is_deleted, created_at, updated_at, version
+		FROM cards WHERE updated_at > ? AND user_id = ?
 		ORDER BY updated_at DESC
-	`, since)
+	`, since, userID)
 	if err != nil {
 		return []Card{}
 	}
@@ -372,9 +549,9 @@ func getCardsSince(since int64) []Card {
 			&card.ID, &card.SyncID, &card.Name, &card.Bank,
 			&card.CardNumber, &card.CVV, &card.ExpiryDate,
 			&card.CardholderName, &card.CreditLimit, &card.BillingDay,
-			&card.PaymentDueDay, &card.Color, &card.CardFrontImage,
-			&card.CardBackImage, &card.Notes, &card.IV, &card.Owner, &card.LastFour,
-			&isDeleted, &card.CreatedAt, &card.UpdatedAt,
+			&card.PaymentDueDay, &card.Color, &card.CardFrontImageHash,
+			&card.CardBackImageHash, &card.Notes, &card.IV, &card.Owner, &card.LastFour,
+			&isDeleted, &card.CreatedAt, &card.UpdatedAt, &card.Version,
 		)
 		if err != nil {
 			continue
@@ -391,3 +568,31 @@ func boolToInt(b bool) int {
 	}
 	return 0
 }
+
+// requestLogFormatter 与 gin 默认的请求日志格式相同（不带颜色），但隐去查询参数中的 token：
+// 日历订阅地址凭 ?token= 访问，不能出现在日志里
+func requestLogFormatter(param gin.LogFormatterParams) string {
+	path := param.Path
+	if p, rawQuery, ok := strings.Cut(path, "?"); ok {
+		q, err := url.ParseQuery(rawQuery)
+		switch {
+		case err != nil:
+			path = p // 解析不了的查询串整段不记
+		case q.Has("token"):
+			q.Set("token", "REDACTED")
+			path = p + "?" + q.Encode()
+		}
+	}
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		path,
+		param.ErrorMessage,
+	)
+}
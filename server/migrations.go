@@ -0,0 +1,705 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// ─────────────────────────────────────────
+// 数据库结构迁移
+//
+// 所有表结构变更都按顺序登记在 migrations 中，启动时在事务里逐个执行尚未应用的迁移，
+// 并记录到 schema_version 表。任何一步失败都会回滚并终止启动，不会带着半成品结构运行。
+//
+// 新增迁移只能追加到末尾，已发布的迁移不要修改。为兼容引入迁移框架之前创建的数据库，
+// 建表用 IF NOT EXISTS，加列用 addColumn（列已存在时跳过）。
+// ─────────────────────────────────────────
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "初始结构：cards、email_config、bill_statements", migrateBaseline},
+	{2, "多用户：users、sessions，数据按 user_id 隔离", migrateUsers},
+	{3, "同步设备令牌：devices", migrateDevices},
+	{4, "卡片字段级版本号", migrateCardVersions},
+	{5, "同步变更日志：card_changes", migrateCardChanges},
+	{6, "卡面图片 blob 存储", migrateBlobs},
+	{7, "账单拉取任务：fetch_jobs", migrateFetchJobs},
+	{8, "IMAP 增量拉取进度：mailbox_state", migrateMailboxState},
+	{9, "多邮箱账号与文件夹", migrateMultiMailbox},
+	{10, "PDF 账单密码：pdf_passwords", migratePDFPasswords},
+	{11, "自定义解析规则：parse_rules", migrateParseRules},
+	{12, "账单交易明细：bill_transactions", migrateBillTransactions},
+	{13, "消费分类：category_rules、merchant_categories", migrateSpendingCategories},
+	{14, "多币种金额与汇率：bill_amounts、fx_rates", migrateCurrencies},
+	{15, "手工账单与字段覆盖：bill_statements.source、bill_overrides", migrateBillSources},
+	{16, "还款记录：bill_payments", migrateBillPayments},
+	{17, "还款提醒：notification_prefs、reminder_deliveries", migrateReminders},
+	{18, "Web Push 订阅：push_subscriptions", migratePushSubscriptions},
+	{19, "日历订阅：calendar_feeds", migrateCalendarFeeds},
+	{20, "卡片账期规则：card_cycle_rules", migrateCardCycleRules},
+}
+
+// latestSchemaVersion 代码所期望的结构版本
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// currentSchemaVersion 数据库当前的结构版本（未初始化时为 0）
+func currentSchemaVersion() (int, error) {
+	var exists int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'`).
+		Scan(&exists)
+	if err != nil || exists == 0 {
+		return 0, err
+	}
+	var v int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&v)
+	return v, err
+}
+
+// runMigrations 应用所有未执行的迁移，失败时直接终止进程
+func runMigrations() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT,
+		applied_at INTEGER
+	)`)
+	if err != nil {
+		log.Fatal("创建 schema_version 表失败:", err)
+	}
+
+	current, err := currentSchemaVersion()
+	if err != nil {
+		log.Fatal("读取数据库结构版本失败:", err)
+	}
+	if current > latestSchemaVersion() {
+		log.Fatalf("数据库结构版本(%d)高于程序支持的版本(%d)，请升级服务端", current, latestSchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(m); err != nil {
+			log.Fatalf("数据库迁移 %d（%s）失败: %v", m.version, m.name, err)
+		}
+		log.Printf("数据库迁移 %d（%s）完成", m.version, m.name)
+	}
+}
+
+func applyMigration(m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`,
+		m.version, m.name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ─────────────────────────────────────────
+// 辅助函数
+// ─────────────────────────────────────────
+
+func execAll(tx *sql.Tx, stmts ...string) error {
+	for _, s := range stmts {
+		if _, err := tx.Exec(s); err != nil {
+			return fmt.Errorf("%w\n%s", err, s)
+		}
+	}
+	return nil
+}
+
+// addColumn 列不存在时才添加（兼容迁移框架之前已经加过列的数据库）
+func addColumn(tx *sql.Tx, table, column, decl string) error {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, decl))
+	return err
+}
+
+// ─────────────────────────────────────────
+// 迁移
+// ─────────────────────────────────────────
+
+func migrateBaseline(tx *sql.Tx) error {
+	err := execAll(tx,
+		`CREATE TABLE IF NOT EXISTS cards (
+			id TEXT PRIMARY KEY,
+			sync_id TEXT UNIQUE,
+			name TEXT NOT NULL,
+			bank TEXT NOT NULL,
+			card_number TEXT,
+			cvv TEXT,
+			expiry_date TEXT,
+			cardholder_name TEXT,
+			credit_limit REAL,
+			billing_day INTEGER,
+			payment_due_day INTEGER,
+			color TEXT,
+			card_front_image TEXT,
+			card_back_image TEXT,
+			notes TEXT,
+			iv TEXT,
+			is_deleted INTEGER DEFAULT 0,
+			created_at INTEGER,
+			updated_at INTEGER
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_updated_at ON cards(updated_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_sync_id ON cards(sync_id)`,
+		`CREATE TABLE IF NOT EXISTS email_config (
+			id       INTEGER PRIMARY KEY AUTOINCREMENT,
+			email    TEXT NOT NULL,
+			password TEXT NOT NULL,
+			imap_host TEXT NOT NULL DEFAULT 'imap.qq.com:993'
+		)`,
+		`CREATE TABLE IF NOT EXISTS bill_statements (
+			id               INTEGER PRIMARY KEY AUTOINCREMENT,
+			card_sync_id     TEXT NOT NULL,
+			email_uid        INTEGER NOT NULL,
+			bank             TEXT,
+			amount           REAL,
+			currency         TEXT DEFAULT 'CNY',
+			bill_date        TEXT,
+			due_date         TEXT,
+			min_payment      REAL,
+			statement_type   TEXT,
+			raw_content      TEXT,
+			matched_by       TEXT,
+			match_confidence TEXT,
+			fetched_at       INTEGER
+		)`,
+	)
+	if err != nil {
+		return err
+	}
+	if err := addColumn(tx, "cards", "owner", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	return addColumn(tx, "cards", "last_four", "TEXT DEFAULT ''")
+}
+
+func migrateUsers(tx *sql.Tx) error {
+	err := execAll(tx,
+		`CREATE TABLE IF NOT EXISTS users (
+			id            TEXT PRIMARY KEY,
+			username      TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			created_at    INTEGER
+		)`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			token_hash TEXT PRIMARY KEY,
+			user_id    TEXT NOT NULL,
+			created_at INTEGER,
+			expires_at INTEGER
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id)`,
+	)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"cards", "email_config", "bill_statements"} {
+		if err := addColumn(tx, table, "user_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+	// 邮箱配置每个用户一条；账单按 user_id + email_uid 去重（原先全局按 email_uid）
+	return execAll(tx,
+		`CREATE INDEX IF NOT EXISTS idx_cards_user ON cards(user_id)`,
+		`DROP INDEX IF EXISTS idx_bill_uid`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_email_config_user ON email_config(user_id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_bill_user_uid ON bill_statements(user_id, email_uid)`,
+	)
+}
+
+func migrateDevices(tx *sql.Tx) error {
+	err := execAll(tx,
+		`CREATE TABLE IF NOT EXISTS devices (
+			id           TEXT PRIMARY KEY,
+			user_id      TEXT NOT NULL,
+			name         TEXT NOT NULL DEFAULT '',
+			token_hash   TEXT NOT NULL UNIQUE,
+			created_at   INTEGER,
+			last_seen_at INTEGER DEFAULT 0,
+			last_ip      TEXT DEFAULT '',
+			revoked_at   INTEGER DEFAULT 0
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_devices_user ON devices(user_id)`,
+	)
+	if err != nil {
+		return err
+	}
+	// 会话记录登记时所在的设备，吊销设备时一并失效
+	return addColumn(tx, "sessions", "device_id", "TEXT NOT NULL DEFAULT ''")
+}
+
+func migrateCardVersions(tx *sql.Tx) error {
+	if err := addColumn(tx, "cards", "version", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	return addColumn(tx, "cards", "field_versions", "TEXT DEFAULT ''")
+}
+
+func migrateCardChanges(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS card_changes (
+			revision   INTEGER PRIMARY KEY AUTOINCREMENT,
+			sync_id    TEXT NOT NULL,
+			changed_at INTEGER
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_card_changes_sync_id ON card_changes(sync_id)`,
+		// 为已有卡片补一条变更记录，保证旧数据也能通过游标下发
+		`INSERT INTO card_changes (sync_id, changed_at)
+			SELECT sync_id, updated_at FROM cards
+			WHERE NOT EXISTS (SELECT 1 FROM card_changes)
+			ORDER BY updated_at`,
+	)
+}
+
+func migrateBlobs(tx *sql.Tx) error {
+	err := execAll(tx,
+		`CREATE TABLE IF NOT EXISTS blobs (
+			hash       TEXT NOT NULL,
+			user_id    TEXT NOT NULL,
+			size       INTEGER,
+			created_at INTEGER,
+			PRIMARY KEY (hash, user_id)
+		)`,
+	)
+	if err != nil {
+		return err
+	}
+	if err := addColumn(tx, "cards", "card_front_image_hash", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "cards", "card_back_image_hash", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	return migrateInlineImages(tx)
+}
+
+func migrateFetchJobs(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS fetch_jobs (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id      TEXT NOT NULL,
+			trigger_type TEXT NOT NULL,
+			status       TEXT NOT NULL,
+			started_at   INTEGER,
+			finished_at  INTEGER,
+			total        INTEGER DEFAULT 0,
+			saved        INTEGER DEFAULT 0,
+			skipped      INTEGER DEFAULT 0,
+			error        TEXT DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_fetch_jobs_user ON fetch_jobs(user_id, started_at)`,
+	)
+}
+
+func migrateMailboxState(tx *sql.Tx) error {
+	err := execAll(tx,
+		`CREATE TABLE IF NOT EXISTS mailbox_state (
+			user_id      TEXT NOT NULL,
+			mailbox      TEXT NOT NULL,
+			uid_validity INTEGER NOT NULL DEFAULT 0,
+			last_uid     INTEGER NOT NULL DEFAULT 0,
+			updated_at   INTEGER,
+			PRIMARY KEY (user_id, mailbox)
+		)`,
+	)
+	if err != nil {
+		return err
+	}
+	if err := addColumn(tx, "bill_statements", "email_uid_validity", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "bill_statements", "message_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// UIDVALIDITY 变化后 UID 会重新编号，去重键需要带上 UIDVALIDITY，另按 Message-ID 识别重新编号的邮件
+	return execAll(tx,
+		`DROP INDEX IF EXISTS idx_bill_user_uid`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_bill_user_uid ON bill_statements(user_id, email_uid_validity, email_uid)`,
+		`CREATE INDEX IF NOT EXISTS idx_bill_statements_message ON bill_statements(user_id, message_id)`,
+		`CREATE TABLE IF NOT EXISTS mail_retries (
+			user_id      TEXT NOT NULL,
+			mailbox      TEXT NOT NULL,
+			uid_validity INTEGER NOT NULL,
+			uid          INTEGER NOT NULL,
+			attempts     INTEGER NOT NULL DEFAULT 1,
+			last_error   TEXT NOT NULL DEFAULT '',
+			updated_at   INTEGER,
+			PRIMARY KEY (user_id, mailbox, uid_validity, uid)
+		)`,
+	)
+}
+
+func migrateMultiMailbox(tx *sql.Tx) error {
+	if err := addColumn(tx, "email_config", "folders", `TEXT NOT NULL DEFAULT '["INBOX"]'`); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "email_config", "enabled", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "bill_statements", "email_config_id", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "bill_statements", "mailbox", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	return execAll(tx,
+		// 每个用户可以有多个邮箱配置
+		`DROP INDEX IF EXISTS idx_email_config_user`,
+		`CREATE INDEX IF NOT EXISTS idx_email_config_user_id ON email_config(user_id)`,
+		// 拉取进度和重试列表改为按 (邮箱配置, 文件夹) 记录；此前每个用户只有一个配置，按 user_id 对应过去
+		`CREATE TABLE mailbox_state_v2 (
+			config_id    INTEGER NOT NULL,
+			mailbox      TEXT NOT NULL,
+			uid_validity INTEGER NOT NULL DEFAULT 0,
+			last_uid     INTEGER NOT NULL DEFAULT 0,
+			updated_at   INTEGER,
+			PRIMARY KEY (config_id, mailbox)
+		)`,
+		`INSERT INTO mailbox_state_v2 (config_id, mailbox, uid_validity, last_uid, updated_at)
+			SELECT e.id, s.mailbox, s.uid_validity, s.last_uid, s.updated_at
+			FROM mailbox_state s JOIN email_config e ON e.user_id = s.user_id`,
+		`DROP TABLE mailbox_state`,
+		`ALTER TABLE mailbox_state_v2 RENAME TO mailbox_state`,
+		`CREATE TABLE mail_retries_v2 (
+			config_id    INTEGER NOT NULL,
+			mailbox      TEXT NOT NULL,
+			uid_validity INTEGER NOT NULL,
+			uid          INTEGER NOT NULL,
+			attempts     INTEGER NOT NULL DEFAULT 1,
+			last_error   TEXT NOT NULL DEFAULT '',
+			updated_at   INTEGER,
+			PRIMARY KEY (config_id, mailbox, uid_validity, uid)
+		)`,
+		`INSERT INTO mail_retries_v2 (config_id, mailbox, uid_validity, uid, attempts, last_error, updated_at)
+			SELECT e.id, r.mailbox, r.uid_validity, r.uid, r.attempts, r.last_error, r.updated_at
+			FROM mail_retries r JOIN email_config e ON e.user_id = r.user_id`,
+		`DROP TABLE mail_retries`,
+		`ALTER TABLE mail_retries_v2 RENAME TO mail_retries`,
+		// 已有账单都来自各用户唯一邮箱的 INBOX
+		`UPDATE bill_statements SET
+			email_config_id = COALESCE((SELECT e.id FROM email_config e WHERE e.user_id = bill_statements.user_id), 0),
+			mailbox = 'INBOX'
+			WHERE email_config_id = 0`,
+		// UID 只在同一邮箱的同一文件夹内唯一
+		`DROP INDEX IF EXISTS idx_bill_user_uid`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_bill_source_uid
+			ON bill_statements(user_id, email_config_id, mailbox, email_uid_validity, email_uid)`,
+	)
+}
+
+func migratePDFPasswords(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS pdf_passwords (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id    TEXT NOT NULL,
+			bank       TEXT NOT NULL DEFAULT '',
+			note       TEXT NOT NULL DEFAULT '',
+			password   TEXT NOT NULL,
+			created_at INTEGER
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_pdf_passwords_user ON pdf_passwords(user_id)`,
+	)
+}
+
+func migrateParseRules(tx *sql.Tx) error {
+	err := execAll(tx,
+		`CREATE TABLE IF NOT EXISTS parse_rules (
+			id                INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id           TEXT NOT NULL,
+			name              TEXT NOT NULL DEFAULT '',
+			sender_pattern    TEXT NOT NULL DEFAULT '',
+			subject_pattern   TEXT NOT NULL DEFAULT '',
+			bank              TEXT NOT NULL DEFAULT '',
+			amount_pattern    TEXT NOT NULL DEFAULT '',
+			min_pay_pattern   TEXT NOT NULL DEFAULT '',
+			bill_date_pattern TEXT NOT NULL DEFAULT '',
+			due_date_pattern  TEXT NOT NULL DEFAULT '',
+			last_four_pattern TEXT NOT NULL DEFAULT '',
+			priority          INTEGER NOT NULL DEFAULT 0,
+			enabled           INTEGER NOT NULL DEFAULT 1,
+			created_at        INTEGER,
+			updated_at        INTEGER
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_parse_rules_user ON parse_rules(user_id)`,
+		// 账单邮件全文，试跑规则时使用（raw_content 只截取了前 2000 字）
+		`CREATE TABLE IF NOT EXISTS bill_bodies (
+			bill_id    INTEGER PRIMARY KEY,
+			user_id    TEXT NOT NULL,
+			body       TEXT NOT NULL DEFAULT '',
+			html       TEXT NOT NULL DEFAULT '[]',
+			updated_at INTEGER
+		)`,
+	)
+	if err != nil {
+		return err
+	}
+	// 试跑规则时需要按发件人和标题匹配已入库的账单
+	if err := addColumn(tx, "bill_statements", "email_from", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	return addColumn(tx, "bill_statements", "email_subject", "TEXT DEFAULT ''")
+}
+
+func migrateBillTransactions(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS bill_transactions (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			bill_id    INTEGER NOT NULL,
+			user_id    TEXT NOT NULL,
+			trans_date TEXT NOT NULL DEFAULT '',
+			post_date  TEXT NOT NULL DEFAULT '',
+			merchant   TEXT NOT NULL DEFAULT '',
+			amount     REAL NOT NULL DEFAULT 0,
+			currency   TEXT NOT NULL DEFAULT 'CNY',
+			last_four  TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_bill_transactions_bill ON bill_transactions(bill_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_bill_transactions_user ON bill_transactions(user_id, trans_date)`,
+	)
+}
+
+// builtinCategoryKeywords 迁移 13 写入的内置分类关键词（之后调整内置规则需要新的迁移）
+var builtinCategoryKeywords = map[string][]string{
+	"dining":        {"餐饮", "餐厅", "美团外卖", "饿了么", "星巴克", "瑞幸", "咖啡", "麦当劳", "肯德基", "海底捞", "STARBUCKS", "MCDONALD"},
+	"groceries":     {"超市", "盒马", "永辉", "沃尔玛", "家乐福", "山姆", "叮咚买菜", "朴朴", "WALMART", "COSTCO"},
+	"shopping":      {"京东", "淘宝", "天猫", "拼多多", "唯品会", "商场", "AMAZON", "APPLE.COM"},
+	"travel":        {"航空", "酒店", "携程", "去哪儿", "飞猪", "12306", "铁路", "HOTELS.COM", "AIRBNB", "BOOKING"},
+	"transport":     {"滴滴", "加油", "中国石化", "中国石油", "地铁", "公交", "停车", "高速", "ETC", "UBER"},
+	"utilities":     {"电费", "水费", "燃气", "供电", "物业", "话费", "宽带", "中国移动", "中国联通", "中国电信"},
+	"entertainment": {"电影", "影城", "猫眼", "腾讯视频", "爱奇艺", "优酷", "网易云音乐", "STEAM", "NETFLIX", "SPOTIFY"},
+	"health":        {"医院", "药房", "药店", "诊所", "体检"},
+	"education":     {"学费", "培训", "教育", "书店"},
+	"fee":           {"利息", "年费", "滞纳金", "手续费"},
+	"repayment":     {"还款"},
+}
+
+func migrateSpendingCategories(tx *sql.Tx) error {
+	err := execAll(tx,
+		// user_id 为空的是内置规则
+		`CREATE TABLE IF NOT EXISTS category_rules (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id    TEXT NOT NULL DEFAULT '',
+			pattern    TEXT NOT NULL,
+			is_regex   INTEGER NOT NULL DEFAULT 0,
+			category   TEXT NOT NULL,
+			priority   INTEGER NOT NULL DEFAULT 0,
+			created_at INTEGER
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_category_rules_user ON category_rules(user_id)`,
+		`CREATE TABLE IF NOT EXISTS merchant_categories (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id      TEXT NOT NULL,
+			merchant_key TEXT NOT NULL,
+			merchant     TEXT NOT NULL,
+			category     TEXT NOT NULL,
+			updated_at   INTEGER,
+			UNIQUE(user_id, merchant_key)
+		)`,
+	)
+	if err != nil {
+		return err
+	}
+
+	// 按分类名排序写入，保证每次安装的规则 id 一致
+	categories := make([]string, 0, len(builtinCategoryKeywords))
+	for category := range builtinCategoryKeywords {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	now := time.Now().Unix()
+	for _, category := range categories {
+		for _, kw := range builtinCategoryKeywords[category] {
+			_, err := tx.Exec(`INSERT INTO category_rules (user_id, pattern, category, created_at) VALUES ('', ?, ?, ?)`,
+				kw, category, now)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func migrateCurrencies(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS bill_amounts (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			bill_id     INTEGER NOT NULL,
+			user_id     TEXT NOT NULL,
+			currency    TEXT NOT NULL,
+			amount      REAL NOT NULL DEFAULT 0,
+			min_payment REAL NOT NULL DEFAULT 0,
+			UNIQUE(bill_id, currency)
+		)`,
+		// 已有账单都按单币种处理
+		`INSERT OR IGNORE INTO bill_amounts (bill_id, user_id, currency, amount, min_payment)
+			SELECT id, user_id, COALESCE(NULLIF(currency, ''), 'CNY'), amount, min_payment FROM bill_statements`,
+		`CREATE TABLE IF NOT EXISTS fx_rates (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id    TEXT NOT NULL,
+			currency   TEXT NOT NULL,
+			rate_date  TEXT NOT NULL,
+			rate       REAL NOT NULL,
+			updated_at INTEGER,
+			UNIQUE(user_id, currency, rate_date)
+		)`,
+	)
+}
+
+func migrateBillSources(tx *sql.Tx) error {
+	if err := addColumn(tx, "bill_statements", "source", "TEXT NOT NULL DEFAULT 'email'"); err != nil {
+		return err
+	}
+	return execAll(tx,
+		// 手工录入的账单没有邮件 UID，去重索引只约束邮件账单
+		`DROP INDEX IF EXISTS idx_bill_source_uid`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_bill_source_uid
+			ON bill_statements(user_id, email_config_id, mailbox, email_uid_validity, email_uid)
+			WHERE source = 'email'`,
+		`CREATE INDEX IF NOT EXISTS idx_bill_card_date ON bill_statements(user_id, card_sync_id, bill_date)`,
+		`CREATE TABLE IF NOT EXISTS bill_overrides (
+			bill_id      INTEGER NOT NULL,
+			user_id      TEXT NOT NULL,
+			field        TEXT NOT NULL,
+			parsed_value TEXT NOT NULL DEFAULT '',
+			value        TEXT NOT NULL DEFAULT '',
+			updated_at   INTEGER,
+			PRIMARY KEY (bill_id, field)
+		)`,
+	)
+}
+
+func migrateBillPayments(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS bill_payments (
+			id                 INTEGER PRIMARY KEY AUTOINCREMENT,
+			bill_id            INTEGER NOT NULL,
+			user_id            TEXT NOT NULL,
+			amount             REAL NOT NULL,
+			currency           TEXT NOT NULL DEFAULT 'CNY',
+			paid_at            TEXT NOT NULL,
+			kind               TEXT NOT NULL DEFAULT 'partial',
+			source             TEXT NOT NULL DEFAULT 'manual',
+			note               TEXT NOT NULL DEFAULT '',
+			created_at         INTEGER,
+			email_config_id    INTEGER NOT NULL DEFAULT 0,
+			mailbox            TEXT NOT NULL DEFAULT '',
+			email_uid_validity INTEGER NOT NULL DEFAULT 0,
+			email_uid          INTEGER NOT NULL DEFAULT 0,
+			message_id         TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_bill_payments_bill ON bill_payments(bill_id)`,
+		// 同一封还款通知只登记一次；UIDVALIDITY 重置后按 Message-ID 识别
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_bill_payments_email
+			ON bill_payments(user_id, email_config_id, mailbox, email_uid_validity, email_uid)
+			WHERE source = 'email'`,
+		`CREATE INDEX IF NOT EXISTS idx_bill_payments_message ON bill_payments(user_id, message_id)`,
+	)
+}
+
+func migrateReminders(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS notification_prefs (
+			user_id     TEXT PRIMARY KEY,
+			enabled     INTEGER NOT NULL DEFAULT 1,
+			channels    TEXT NOT NULL DEFAULT '[]',
+			days_before TEXT NOT NULL DEFAULT '[7,3,1]',
+			email_to    TEXT NOT NULL DEFAULT '',
+			webhook_url TEXT NOT NULL DEFAULT '',
+			updated_at  INTEGER
+		)`,
+		`CREATE TABLE IF NOT EXISTS reminder_deliveries (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id     TEXT NOT NULL,
+			ref_key     TEXT NOT NULL,
+			due_date    TEXT NOT NULL,
+			days_before INTEGER NOT NULL,
+			channel     TEXT NOT NULL,
+			title       TEXT NOT NULL DEFAULT '',
+			status      TEXT NOT NULL,
+			error       TEXT NOT NULL DEFAULT '',
+			created_at  INTEGER
+		)`,
+		// 发送前按 待还款项 + 档位 + 渠道 查重
+		`CREATE INDEX IF NOT EXISTS idx_reminder_deliveries_ref
+			ON reminder_deliveries(user_id, ref_key, due_date, days_before, channel)`,
+	)
+}
+
+func migratePushSubscriptions(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS push_subscriptions (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id         TEXT NOT NULL,
+			device_id       TEXT NOT NULL DEFAULT '',
+			endpoint        TEXT NOT NULL UNIQUE,
+			p256dh          TEXT NOT NULL,
+			auth            TEXT NOT NULL,
+			user_agent      TEXT NOT NULL DEFAULT '',
+			created_at      INTEGER,
+			last_success_at INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_push_subscriptions_user ON push_subscriptions(user_id, device_id)`,
+	)
+}
+
+func migrateCalendarFeeds(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS calendar_feeds (
+			user_id        TEXT PRIMARY KEY,
+			token_hash     TEXT NOT NULL UNIQUE,
+			created_at     INTEGER,
+			last_access_at INTEGER NOT NULL DEFAULT 0
+		)`,
+	)
+}
+
+func migrateCardCycleRules(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS card_cycle_rules (
+			user_id        TEXT NOT NULL,
+			card_sync_id   TEXT NOT NULL,
+			due_after_days INTEGER NOT NULL DEFAULT 0,
+			updated_at     INTEGER,
+			PRIMARY KEY (user_id, card_sync_id)
+		)`,
+	)
+}
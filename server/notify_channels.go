@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ─────────────────────────────────────────
+// 提醒发送渠道
+//
+// 每个渠道实现 NotifyChannel 并在 init 中注册，用户在提醒设置里选择启用哪些渠道。
+// 渠道的收件地址来自用户设置（邮箱、Webhook 地址）或渠道自己的订阅数据。
+//   email    通过 SMTP 发信，服务端用 SMTP_HOST（host:port）、SMTP_USER、SMTP_PASSWORD、
+//            SMTP_FROM 配置发件账号；465 端口直接走 TLS，其他端口支持时使用 STARTTLS
+//   webhook  向用户填写的地址 POST JSON，只允许公网地址（见 publicDialer）
+//   webpush  推送到用户已订阅的浏览器（见 push.go）
+// ─────────────────────────────────────────
+
+// notification 一条待发送的提醒
+type notification struct {
+	Title string   `json:"title"`
+	Body  string   `json:"body"`
+	Due   *dueItem `json:"due,omitempty"` // 对应的待还款项（测试消息为空）
+}
+
+// NotifyChannel 提醒发送渠道
+type NotifyChannel interface {
+	// Name 渠道名称，同时是用户设置中的取值
+	Name() string
+	// Send 把提醒发给用户，prefs 中包含该渠道需要的收件地址
+	Send(userID string, prefs NotificationPrefs, n notification) error
+}
+
+// notifyChannels 渠道名称 → 渠道
+var notifyChannels = map[string]NotifyChannel{}
+
+// registerNotifyChannel 注册渠道（同名后注册的覆盖先注册的）
+func registerNotifyChannel(ch NotifyChannel) {
+	notifyChannels[ch.Name()] = ch
+}
+
+func init() {
+	registerNotifyChannel(smtpChannel{})
+	registerNotifyChannel(webhookChannel{})
+}
+
+// 渠道发送的网络超时
+const notifyTimeout = 15 * time.Second
+
+// ─────────────────────────────────────────
+// email：SMTP
+// ─────────────────────────────────────────
+
+type smtpChannel struct{}
+
+func (smtpChannel) Name() string { return "email" }
+
+func (smtpChannel) Send(userID string, prefs NotificationPrefs, n notification) error {
+	addr := strings.TrimSpace(os.Getenv("SMTP_HOST"))
+	if addr == "" {
+		return fmt.Errorf("服务端未配置 SMTP_HOST")
+	}
+	if prefs.EmailTo == "" {
+		return fmt.Errorf("未填写接收提醒的邮箱")
+	}
+	if !strings.Contains(addr, ":") {
+		addr += ":587"
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	user := os.Getenv("SMTP_USER")
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = user
+	}
+	if from == "" {
+		return fmt.Errorf("服务端未配置 SMTP_FROM")
+	}
+
+	var c *smtp.Client
+	if port == "465" {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: notifyTimeout}, "tcp", addr, &tls.Config{ServerName: host})
+		if err != nil {
+			return fmt.Errorf("SMTP连接失败: %w", err)
+		}
+		conn.SetDeadline(time.Now().Add(notifyTimeout))
+		if c, err = smtp.NewClient(conn, host); err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		conn, err := net.DialTimeout("tcp", addr, notifyTimeout)
+		if err != nil {
+			return fmt.Errorf("SMTP连接失败: %w", err)
+		}
+		// 整个会话共用一个截止时间，服务器不响应时不会一直占住提醒调度
+		conn.SetDeadline(time.Now().Add(notifyTimeout))
+		if c, err = smtp.NewClient(conn, host); err != nil {
+			conn.Close()
+			return err
+		}
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				c.Close()
+				return err
+			}
+		}
+	}
+	defer c.Close()
+
+	if user != "" {
+		if err := c.Auth(smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)); err != nil {
+			return fmt.Errorf("SMTP登录失败: %w", err)
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(prefs.EmailTo); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buildReminderMail(from, prefs.EmailTo, n)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildReminderMail 生成纯文本 UTF-8 邮件
+func buildReminderMail(from, to string, n notification) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", n.Title))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+
+	body := base64.StdEncoding.EncodeToString([]byte(n.Body))
+	for len(body) > 76 {
+		b.WriteString(body[:76] + "\r\n")
+		body = body[76:]
+	}
+	b.WriteString(body + "\r\n")
+	return b.Bytes()
+}
+
+// ─────────────────────────────────────────
+// webhook：POST JSON
+// ─────────────────────────────────────────
+
+type webhookChannel struct{}
+
+func (webhookChannel) Name() string { return "webhook" }
+
+var webhookClient = &http.Client{
+	Timeout: notifyTimeout,
+	Transport: &http.Transport{
+		DialContext:         publicDialer(),
+		TLSHandshakeTimeout: notifyTimeout,
+	},
+}
+
+var (
+	errWebhookBlocked     = errors.New("Webhook 地址指向本机或内网，已拒绝")
+	errWebhookUnreachable = errors.New("无法连接 Webhook 地址")
+)
+
+// errPrivateAddress publicDialer 拒绝连接的地址
+var errPrivateAddress = errors.New("目标地址为本机或内网地址")
+
+func (webhookChannel) Send(userID string, prefs NotificationPrefs, n notification) error {
+	if prefs.WebhookURL == "" {
+		return fmt.Errorf("未填写 Webhook 地址")
+	}
+	payload, err := json.Marshal(map[string]any{
+		"event":     "payment_due",
+		"title":     n.Title,
+		"body":      n.Body,
+		"due":       n.Due,
+		"timestamp": time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(prefs.WebhookURL, "application/json", bytes.NewReader(payload))
+	if errors.Is(err, errPrivateAddress) {
+		return errWebhookBlocked
+	}
+	if err != nil {
+		// 具体原因（拒绝连接、超时等）只记日志，不返回给用户，避免被用来探测网络
+		log.Printf("[notify] Webhook 发送失败(%s): %v", userID, err)
+		return errWebhookUnreachable
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Webhook 返回 HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// publicDialer 只连接公网地址的拨号函数：在 DNS 解析之后、建立连接之前检查实际要连的 IP，
+// 因此无法用指向内网的域名或 DNS rebinding 绕过。跟随重定向时同样会经过这里。
+func publicDialer() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{
+		Timeout: notifyTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+	return d.DialContext
+}
+
+// 除 net.IP 自带判断之外需要拒绝的网段
+var blockedNets = mustParseCIDRs(
+	"0.0.0.0/8",     // 本网络
+	"100.64.0.0/10", // 运营商级 NAT，部分云厂商的元数据服务在此网段
+	"192.0.0.0/24",  // IETF 协议分配
+	"198.18.0.0/15", // 基准测试
+	"64:ff9b::/96",  // NAT64，可映射到任意 IPv4
+)
+
+// isPublicIP 是否为公网单播地址（排除本机、内网、链路本地（含 169.254.169.254 元数据服务）、组播等）
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
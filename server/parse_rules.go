@@ -0,0 +1,473 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────
+// 用户自定义解析规则
+//
+// 银行更换账单模板后，用户可以自己在 parse_rules 中补一条规则，不必等服务端发版。
+// 规则按发件人/标题正则匹配邮件，命中后先跑内置解析器，再用规则的字段正则覆盖匹配到的字段，
+// 即数据库规则优先于内置规则。多条规则都命中时取 priority 最大的（相同时取先创建的）。
+// 发件人匹配不区分大小写；字段正则的第一个分组是字段值。
+// ─────────────────────────────────────────
+
+// ParseRule 用户自定义解析规则
+type ParseRule struct {
+	ID              int64  `json:"id"`
+	Name            string `json:"name"`
+	SenderPattern   string `json:"senderPattern"`     // 发件人地址正则
+	SubjectPattern  string `json:"subjectPattern"`    // 标题正则
+	Bank            string `json:"bank"`              // 命中后使用的银行名称，为空时沿用自动识别结果
+	AmountPattern   string `json:"amountPattern"`     // 账单金额
+	MinPayPattern   string `json:"minPaymentPattern"` // 最低还款额
+	BillDatePattern string `json:"billDatePattern"`   // 账单日
+	DueDatePattern  string `json:"dueDatePattern"`    // 还款截止日
+	LastFourPattern string `json:"lastFourPattern"`   // 卡号尾号
+	Priority        int    `json:"priority"`
+	Enabled         bool   `json:"enabled"`
+	CreatedAt       int64  `json:"createdAt"`
+	UpdatedAt       int64  `json:"updatedAt"`
+}
+
+// parseRuleRequest 创建/修改规则的请求体（Enabled 为空表示不修改，新建时默认启用）
+type parseRuleRequest struct {
+	Name            string `json:"name"`
+	SenderPattern   string `json:"senderPattern"`
+	SubjectPattern  string `json:"subjectPattern"`
+	Bank            string `json:"bank"`
+	AmountPattern   string `json:"amountPattern"`
+	MinPayPattern   string `json:"minPaymentPattern"`
+	BillDatePattern string `json:"billDatePattern"`
+	DueDatePattern  string `json:"dueDatePattern"`
+	LastFourPattern string `json:"lastFourPattern"`
+	Priority        int    `json:"priority"`
+	Enabled         *bool  `json:"enabled"`
+}
+
+// parseRule 编译后的规则，实现 StatementParser
+type parseRule struct {
+	ParseRule
+	sender  *regexp.Regexp
+	subject *regexp.Regexp
+	fieldRegexes
+}
+
+func (r *parseRule) Name() string { return "rule:" + strconv.FormatInt(r.ID, 10) }
+
+// Parse 先按银行跑内置解析器，再用规则的字段正则覆盖；字段可能变化，明细和各币种金额重新提取
+func (r *parseRule) Parse(pb *parsedBill) {
+	if r.Bank != "" {
+		pb.bank = r.Bank
+	}
+	statementParserFor(pb.bank).Parse(pb)
+	r.apply(pb)
+	extractBillDetails(pb)
+}
+
+// matches 发件人和标题是否都满足规则（未设置的一项视为满足）
+func (r *parseRule) matches(from, subject string) bool {
+	if r.sender != nil && !r.sender.MatchString(from) {
+		return false
+	}
+	if r.subject != nil && !r.subject.MatchString(subject) {
+		return false
+	}
+	return true
+}
+
+// compileParseRule 校验并编译规则
+func compileParseRule(rule ParseRule) (*parseRule, error) {
+	if rule.SenderPattern == "" && rule.SubjectPattern == "" {
+		return nil, fmt.Errorf("发件人和标题正则至少填写一个")
+	}
+	r := &parseRule{ParseRule: rule}
+
+	var err error
+	if rule.SenderPattern != "" {
+		if r.sender, err = regexp.Compile("(?i)" + rule.SenderPattern); err != nil {
+			return nil, fmt.Errorf("发件人正则无效: %w", err)
+		}
+	}
+	if rule.SubjectPattern != "" {
+		if r.subject, err = regexp.Compile(rule.SubjectPattern); err != nil {
+			return nil, fmt.Errorf("标题正则无效: %w", err)
+		}
+	}
+
+	fields := []struct {
+		label   string
+		pattern string
+		dst     **regexp.Regexp
+	}{
+		{"账单金额", rule.AmountPattern, &r.amount},
+		{"最低还款额", rule.MinPayPattern, &r.minPay},
+		{"账单日", rule.BillDatePattern, &r.billDate},
+		{"还款日", rule.DueDatePattern, &r.dueDate},
+		{"卡号尾号", rule.LastFourPattern, &r.lastFour},
+	}
+	hasField := false
+	for _, f := range fields {
+		if f.pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(f.pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s正则无效: %w", f.label, err)
+		}
+		if re.NumSubexp() < 1 {
+			return nil, fmt.Errorf("%s正则需要用括号标出字段值", f.label)
+		}
+		*f.dst = re
+		hasField = true
+	}
+	if !hasField && rule.Bank == "" {
+		return nil, fmt.Errorf("至少填写一个字段正则或银行名称")
+	}
+	return r, nil
+}
+
+// parseRuleSet 一个用户启用的规则，已按优先级排序
+type parseRuleSet []*parseRule
+
+// match 返回第一条命中的规则
+func (rs parseRuleSet) match(from, subject string) *parseRule {
+	for _, r := range rs {
+		if r.matches(from, subject) {
+			return r
+		}
+	}
+	return nil
+}
+
+// apply 有规则命中时用规则重新解析（内置解析器的结果已在 pb 中）
+func (rs parseRuleSet) apply(pb *parsedBill) {
+	if r := rs.match(pb.from, pb.subject); r != nil {
+		r.Parse(pb)
+	}
+}
+
+// ─────────────────────────────────────────
+// 读写
+// ─────────────────────────────────────────
+
+const parseRuleColumns = `id, name, sender_pattern, subject_pattern, bank, amount_pattern, min_pay_pattern,
+	bill_date_pattern, due_date_pattern, last_four_pattern, priority, enabled, created_at, updated_at`
+
+func scanParseRule(r rowScanner) (ParseRule, error) {
+	var rule ParseRule
+	var enabled int
+	err := r.Scan(&rule.ID, &rule.Name, &rule.SenderPattern, &rule.SubjectPattern, &rule.Bank,
+		&rule.AmountPattern, &rule.MinPayPattern, &rule.BillDatePattern, &rule.DueDatePattern,
+		&rule.LastFourPattern, &rule.Priority, &enabled, &rule.CreatedAt, &rule.UpdatedAt)
+	rule.Enabled = enabled != 0
+	return rule, err
+}
+
+// loadParseRules 读取用户的规则（按匹配顺序）
+func loadParseRules(userID string, enabledOnly bool) ([]ParseRule, error) {
+	query := `SELECT ` + parseRuleColumns + ` FROM parse_rules WHERE user_id = ?`
+	if enabledOnly {
+		query += ` AND enabled = 1`
+	}
+	rows, err := db.Query(query+` ORDER BY priority DESC, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []ParseRule
+	for rows.Next() {
+		rule, err := scanParseRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// loadParseRuleSet 读取并编译用户启用的规则；保存时已校验过，个别编译失败的规则跳过
+func loadParseRuleSet(userID string) (parseRuleSet, error) {
+	rules, err := loadParseRules(userID, true)
+	if err != nil {
+		return nil, err
+	}
+	var rs parseRuleSet
+	for _, rule := range rules {
+		r, err := compileParseRule(rule)
+		if err != nil {
+			log.Printf("[bills] 解析规则(%d)无效，已跳过: %v", rule.ID, err)
+			continue
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+func loadParseRule(userID string, id int64) (ParseRule, error) {
+	row := db.QueryRow(`SELECT `+parseRuleColumns+` FROM parse_rules WHERE id = ? AND user_id = ?`, id, userID)
+	return scanParseRule(row)
+}
+
+// applyParseRuleRequest 把请求合并到已有规则上并校验（新建时 rule 为零值）
+func applyParseRuleRequest(rule ParseRule, req parseRuleRequest) (ParseRule, error) {
+	rule.Name = strings.TrimSpace(req.Name)
+	rule.SenderPattern = strings.TrimSpace(req.SenderPattern)
+	rule.SubjectPattern = strings.TrimSpace(req.SubjectPattern)
+	rule.Bank = strings.TrimSpace(req.Bank)
+	rule.AmountPattern = req.AmountPattern
+	rule.MinPayPattern = req.MinPayPattern
+	rule.BillDatePattern = req.BillDatePattern
+	rule.DueDatePattern = req.DueDatePattern
+	rule.LastFourPattern = req.LastFourPattern
+	rule.Priority = req.Priority
+	if req.Enabled != nil {
+		rule.Enabled = *req.Enabled
+	}
+	_, err := compileParseRule(rule)
+	return rule, err
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：/api/v1/parse-rules
+// ─────────────────────────────────────────
+
+func handleListParseRules(c *gin.Context) {
+	rules, err := loadParseRules(currentUserID(c), false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rules == nil {
+		rules = []ParseRule{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      rules,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleCreateParseRule(c *gin.Context) {
+	var req parseRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rule, err := applyParseRuleRequest(ParseRule{Enabled: true}, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now().Unix()
+	rule.CreatedAt, rule.UpdatedAt = now, now
+	res, err := db.Exec(`
+		INSERT INTO parse_rules (user_id, name, sender_pattern, subject_pattern, bank, amount_pattern, min_pay_pattern,
+			bill_date_pattern, due_date_pattern, last_four_pattern, priority, enabled, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		currentUserID(c), rule.Name, rule.SenderPattern, rule.SubjectPattern, rule.Bank, rule.AmountPattern,
+		rule.MinPayPattern, rule.BillDatePattern, rule.DueDatePattern, rule.LastFourPattern,
+		rule.Priority, boolToInt(rule.Enabled), rule.CreatedAt, rule.UpdatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	rule.ID, _ = res.LastInsertId()
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success":   true,
+		"data":      rule,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleUpdateParseRule(c *gin.Context) {
+	old, ok := parseRuleFromParam(c)
+	if !ok {
+		return
+	}
+
+	var req parseRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rule, err := applyParseRuleRequest(old, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule.UpdatedAt = time.Now().Unix()
+	_, err = db.Exec(`
+		UPDATE parse_rules SET name = ?, sender_pattern = ?, subject_pattern = ?, bank = ?, amount_pattern = ?,
+			min_pay_pattern = ?, bill_date_pattern = ?, due_date_pattern = ?, last_four_pattern = ?,
+			priority = ?, enabled = ?, updated_at = ?
+		WHERE id = ?`,
+		rule.Name, rule.SenderPattern, rule.SubjectPattern, rule.Bank, rule.AmountPattern,
+		rule.MinPayPattern, rule.BillDatePattern, rule.DueDatePattern, rule.LastFourPattern,
+		rule.Priority, boolToInt(rule.Enabled), rule.UpdatedAt, rule.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      rule,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleDeleteParseRule(c *gin.Context) {
+	res, err := db.Exec(`DELETE FROM parse_rules WHERE id = ? AND user_id = ?`, c.Param("id"), currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "规则不存在"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "timestamp": time.Now().Unix()})
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：规则试跑
+//
+// POST /api/v1/parse-rules/test     {"billId": 1, "rule": {...}}  试跑尚未保存的规则
+// POST /api/v1/parse-rules/:id/test {"billId": 1}                 试跑已保存的规则
+// 用已入库账单的邮件全文（含 HTML 表格）分别跑内置解析器和规则，返回两者的结果供对比，不修改账单。
+// 引入规则之前入库的账单没有记录发件人和标题，matched 恒为 false，但字段正则照常试跑。
+// 开始保存邮件全文之前入库的账单只有截断后的 raw_content，此时 fullText 为 false，重新拉取（backfill）后即可补上。
+// ─────────────────────────────────────────
+
+func handleTestDraftParseRule(c *gin.Context) {
+	var req struct {
+		BillID int64            `json:"billId"`
+		Rule   parseRuleRequest `json:"rule"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rule, err := applyParseRuleRequest(ParseRule{Enabled: true}, req.Rule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	testParseRule(c, rule, req.BillID)
+}
+
+func handleTestParseRule(c *gin.Context) {
+	rule, ok := parseRuleFromParam(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		BillID int64 `json:"billId"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	testParseRule(c, rule, req.BillID)
+}
+
+func testParseRule(c *gin.Context, rule ParseRule, billID int64) {
+	r, err := compileParseRule(rule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var storedBank string
+	pb := parsedBill{}
+	err = db.QueryRow(`SELECT email_from, email_subject, raw_content, bank FROM bill_statements WHERE id = ? AND user_id = ?`,
+		billID, currentUserID(c)).Scan(&pb.from, &pb.subject, &pb.body, &storedBank)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "账单不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	body, tables, err := loadBillBody(currentUserID(c), billID)
+	fullText := err == nil
+	if fullText {
+		pb.body, pb.tables = body, tables
+	} else if err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if pb.body == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "该账单没有保存原始文本"})
+		return
+	}
+
+	extractBillFields(&pb)
+	if pb.bank == "" {
+		// 旧账单缺少发件人和标题，按入库时识别的银行选择内置解析器
+		pb.bank = storedBank
+		statementParserFor(pb.bank).Parse(&pb)
+	}
+	builtin := pb
+	r.Parse(&pb)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"matched":  r.matches(pb.from, pb.subject),
+			"fullText": fullText,
+			"builtin":  parsedFieldsView(builtin),
+			"result":   parsedFieldsView(pb),
+		},
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// parsedFieldsView 解析结果中规则可以影响的字段
+func parsedFieldsView(pb parsedBill) gin.H {
+	return gin.H{
+		"bank":       pb.bank,
+		"amount":     pb.amount,
+		"minPayment": pb.minPayment,
+		"billDate":   pb.billDate,
+		"dueDate":    pb.dueDate,
+		"lastFour":   pb.lastFourFromMsg,
+	}
+}
+
+// parseRuleFromParam 读取路径中 :id 对应的当前用户规则，失败时已写好响应
+func parseRuleFromParam(c *gin.Context) (ParseRule, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "规则不存在"})
+		return ParseRule{}, false
+	}
+	rule, err := loadParseRule(currentUserID(c), id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "规则不存在"})
+		return rule, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return rule, false
+	}
+	return rule, true
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────
+// 还款记录与账单状态
+//
+// 每张账单可以登记多笔还款（全额/最低/部分），账单状态按还款合计实时计算：
+//   paid            已还金额不低于账单金额（含零账单和溢缴款）
+//   overdue         已过还款日且已还金额不足最低还款额（账单未列最低还款时按账单金额）
+//   partially_paid  有还款但未还清
+//   unpaid          没有还款
+// 只累计与账单币种相同的还款。
+//
+// 银行的“还款成功/还款已入账”通知邮件在拉取时识别：按卡号尾号匹配卡片，
+// 登记到还款日当天或之前最近的一期账单；同一封邮件只登记一次。
+// ─────────────────────────────────────────
+
+// BillPayment 一笔还款
+type BillPayment struct {
+	ID        int64   `json:"id"`
+	BillID    int64   `json:"billId"`
+	Amount    float64 `json:"amount"`
+	Currency  string  `json:"currency"`
+	PaidAt    string  `json:"paidAt"` // 还款日期 YYYY-MM-DD
+	Kind      string  `json:"kind"`   // full/minimum/partial
+	Source    string  `json:"source"` // manual/email
+	Note      string  `json:"note"`
+	CreatedAt int64   `json:"createdAt"`
+}
+
+const (
+	paymentFull    = "full"
+	paymentMinimum = "minimum"
+	paymentPartial = "partial"
+)
+
+const (
+	billStatusUnpaid        = "unpaid"
+	billStatusPartiallyPaid = "partially_paid"
+	billStatusPaid          = "paid"
+	billStatusOverdue       = "overdue"
+)
+
+// 金额比较的容差（分以下的误差视为相等）
+const centEpsilon = 0.005
+
+// billStatus 按已还金额和还款日计算账单状态
+func billStatus(bs BillStatement, paid float64, today string) string {
+	if paid >= bs.Amount-centEpsilon {
+		return billStatusPaid
+	}
+	need := bs.MinPayment
+	if need <= 0 {
+		need = bs.Amount
+	}
+	if bs.DueDate != "" && bs.DueDate < today && paid < need-centEpsilon {
+		return billStatusOverdue
+	}
+	if paid > 0 {
+		return billStatusPartiallyPaid
+	}
+	return billStatusUnpaid
+}
+
+// paymentKind 按这笔还款之后的累计金额判断还款类型
+func paymentKind(bs BillStatement, paidBefore, amount float64) string {
+	total := paidBefore + amount
+	switch {
+	case total >= bs.Amount-centEpsilon:
+		return paymentFull
+	case bs.MinPayment > 0 && total >= bs.MinPayment-centEpsilon && paidBefore < bs.MinPayment-centEpsilon:
+		return paymentMinimum
+	}
+	return paymentPartial
+}
+
+// attachBillPayments 为账单计算已还金额和状态
+func attachBillPayments(userID string, bills []BillStatement) error {
+	if len(bills) == 0 {
+		return nil
+	}
+	args := []any{userID}
+	for _, bs := range bills {
+		args = append(args, bs.ID)
+	}
+	rows, err := db.Query(`
+		SELECT p.bill_id, SUM(p.amount) FROM bill_payments p
+		JOIN bill_statements b ON b.id = p.bill_id AND p.currency = COALESCE(NULLIF(b.currency, ''), 'CNY')
+		WHERE p.user_id = ? AND p.bill_id IN (?`+strings.Repeat(",?", len(bills)-1)+`)
+		GROUP BY p.bill_id
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	paid := map[int64]float64{}
+	for rows.Next() {
+		var id int64
+		var sum float64
+		if err := rows.Scan(&id, &sum); err != nil {
+			return err
+		}
+		paid[id] = roundCents(sum)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	today := time.Now().Format("2006-01-02")
+	for i := range bills {
+		bs := &bills[i]
+		bs.PaidAmount = paid[bs.ID]
+		bs.Status = billStatus(*bs, bs.PaidAmount, today)
+	}
+	return nil
+}
+
+func loadBillPayments(userID string, billID int64) ([]BillPayment, error) {
+	rows, err := db.Query(`
+		SELECT id, bill_id, amount, currency, paid_at, kind, source, note, created_at
+		FROM bill_payments WHERE bill_id = ? AND user_id = ?
+		ORDER BY paid_at, id
+	`, billID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := []BillPayment{}
+	for rows.Next() {
+		var p BillPayment
+		if err := rows.Scan(&p.ID, &p.BillID, &p.Amount, &p.Currency, &p.PaidAt, &p.Kind, &p.Source, &p.Note, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+// ─────────────────────────────────────────
+// 还款通知邮件
+// ─────────────────────────────────────────
+
+// repaymentNotice 从还款到账通知中提取的还款
+type repaymentNotice struct {
+	amount   float64
+	currency string
+	paidAt   string // YYYY-MM-DD
+}
+
+var (
+	// “还款提醒”是到期提醒，不算到账通知
+	reRepaymentSubject = regexp.MustCompile(`还款(?:成功|已?入账|已?到账)|(?:收到|已收).{0,12}还款|(?i:payment received|repayment received)`)
+	reRepaymentAmount  = regexp.MustCompile(`(?:还款|入账|存入)(?:金额)?[^\d\n]{0,12}?(` + reCurrencyWord + `)?\s*[:：]?\s*[¥￥]?\s*([0-9][0-9,]*\.\d{2})`)
+	reRepaymentDate    = regexp.MustCompile(`(\d{4}[-/年]\d{1,2}[-/月]\d{1,2})|(\d{1,2})月(\d{1,2})日`)
+)
+
+// extractRepayment 识别还款到账通知，是通知时写入 pb.repayment 和卡号尾号并返回 true
+func extractRepayment(pb *parsedBill) bool {
+	if !reRepaymentSubject.MatchString(pb.subject) {
+		return false
+	}
+	m := reRepaymentAmount.FindStringSubmatch(pb.body)
+	if m == nil {
+		return false
+	}
+
+	n := &repaymentNotice{amount: parseAmount(m[2]), currency: "CNY"}
+	if m[1] != "" {
+		n.currency = currencyWords[strings.ToUpper(m[1])]
+		if n.currency == "" {
+			n.currency = currencyWords[m[1]]
+		}
+	}
+
+	ref := pb.date
+	if ref.IsZero() {
+		ref = time.Now()
+	}
+	n.paidAt = ref.Format("2006-01-02")
+	if d := reRepaymentDate.FindStringSubmatch(pb.body); d != nil {
+		if d[1] != "" {
+			n.paidAt = normalizeDate(d[1])
+		} else {
+			n.paidAt = resolveTxnDate(d[2]+"-"+d[3], n.paidAt)
+		}
+	}
+
+	pb.bank = detectBank(pb.from, pb.subject)
+	pb.lastFourFromMsg = firstGroup(reLastFour, pb.body)
+	if pb.lastFourFromMsg == "" {
+		pb.lastFourFromMsg = firstGroup(reLastFour, pb.subject)
+	}
+	pb.repayment = n
+	return true
+}
+
+// saveDetectedPayment 登记还款通知邮件中的还款，返回是否新登记了一笔
+func saveDetectedPayment(userID string, cfg EmailConfig, folder string, uidValidity uint32, pb parsedBill, cards []Card) (bool, error) {
+	mr := matchBillToCard(pb, cards)
+	if !mr.found || mr.confidence == "ambiguous" {
+		return false, nil
+	}
+	n := pb.repayment
+
+	bs, err := scanBill(db.QueryRow(`
+		SELECT `+billColumns+` FROM bill_statements
+		WHERE user_id = ? AND card_sync_id = ? AND bill_date <= ? AND bill_date != ''
+		ORDER BY bill_date DESC, id DESC LIMIT 1`,
+		userID, mr.card.SyncID, n.paidAt))
+	if err == sql.ErrNoRows {
+		log.Printf("[payments] 还款通知(%d)没有对应的账单: 卡片 %s, %s", pb.uid, mr.card.SyncID, n.paidAt)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	bills := []BillStatement{bs}
+	if err := attachBillPayments(userID, bills); err != nil {
+		return false, err
+	}
+
+	// UIDVALIDITY 重置后同一封通知会以新的 UID 再次出现：按 Message-ID 查重，
+	// 没有记录 Message-ID 的旧还款按 账单 + 金额 + 还款日 查重
+	var dup int
+	err = db.QueryRow(`
+		SELECT COUNT(*) FROM bill_payments
+		WHERE user_id = ? AND source = 'email' AND email_config_id = ? AND mailbox = ? AND email_uid_validity != ?
+			AND ((message_id != '' AND message_id = ?) OR (message_id = '' AND bill_id = ? AND amount = ? AND paid_at = ?))`,
+		userID, cfg.ID, folder, uidValidity, pb.messageID, bs.ID, n.amount, n.paidAt).Scan(&dup)
+	if err != nil {
+		return false, err
+	}
+	if dup > 0 {
+		return false, nil
+	}
+
+	kind := paymentPartial
+	if n.currency == bs.Currency {
+		kind = paymentKind(bs, bills[0].PaidAmount, n.amount)
+	}
+	res, err := db.Exec(`
+		INSERT OR IGNORE INTO bill_payments
+		(bill_id, user_id, amount, currency, paid_at, kind, source, note, created_at,
+		 email_config_id, mailbox, email_uid_validity, email_uid, message_id)
+		VALUES (?, ?, ?, ?, ?, ?, 'email', ?, ?, ?, ?, ?, ?, ?)`,
+		bs.ID, userID, n.amount, n.currency, n.paidAt, kind, truncate(pb.subject, 100), time.Now().Unix(),
+		cfg.ID, folder, uidValidity, pb.uid, pb.messageID)
+	if err != nil {
+		return false, err
+	}
+	if added, _ := res.RowsAffected(); added == 0 {
+		return false, nil
+	}
+	log.Printf("[payments] 账单 %d 登记还款 %.2f %s（%s）", bs.ID, n.amount, n.currency, n.paidAt)
+	return true, nil
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：/api/v1/bills/:id/payments
+// ─────────────────────────────────────────
+
+// handleListBillPayments GET /api/v1/bills/:id/payments
+func handleListBillPayments(c *gin.Context) {
+	bs, ok := billFromParam(c)
+	if !ok {
+		return
+	}
+	bills := []BillStatement{bs}
+	if err := attachBillPayments(bs.UserID, bills); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	bs = bills[0]
+	payments, err := loadBillPayments(bs.UserID, bs.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"billId":     bs.ID,
+			"amount":     bs.Amount,
+			"currency":   bs.Currency,
+			"paidAmount": bs.PaidAmount,
+			"remaining":  roundCents(math.Max(bs.Amount-bs.PaidAmount, 0)),
+			"status":     bs.Status,
+			"payments":   payments,
+		},
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleCreateBillPayment POST /api/v1/bills/:id/payments
+// kind 为 full 时金额默认为剩余应还，minimum 时默认为最低还款额，partial 必须提供金额；
+// 还款日期默认为当天，币种为账单币种。
+func handleCreateBillPayment(c *gin.Context) {
+	bs, ok := billFromParam(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Kind   string   `json:"kind"`
+		Amount *float64 `json:"amount"`
+		PaidAt string   `json:"paidAt"`
+		Note   string   `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	bills := []BillStatement{bs}
+	if err := attachBillPayments(bs.UserID, bills); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	paid := bills[0].PaidAmount
+
+	p := BillPayment{BillID: bs.ID, Currency: bs.Currency, Kind: req.Kind, Source: "manual", Note: strings.TrimSpace(req.Note)}
+	switch req.Kind {
+	case paymentFull:
+		p.Amount = roundCents(bs.Amount - paid)
+	case paymentMinimum:
+		if bs.MinPayment <= 0 && req.Amount == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "账单没有最低还款额，请提供 amount"})
+			return
+		}
+		p.Amount = bs.MinPayment
+	case paymentPartial:
+		if req.Amount == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "部分还款需要提供 amount"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind 应为 full、minimum 或 partial"})
+		return
+	}
+	if req.Amount != nil {
+		p.Amount = roundCents(*req.Amount)
+	}
+	if math.IsNaN(p.Amount) || p.Amount <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "还款金额应大于 0"})
+		return
+	}
+
+	p.PaidAt = strings.TrimSpace(req.PaidAt)
+	if p.PaidAt == "" {
+		p.PaidAt = time.Now().Format("2006-01-02")
+	}
+	if _, err := time.Parse("2006-01-02", p.PaidAt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "paidAt 格式应为 YYYY-MM-DD"})
+		return
+	}
+
+	p.CreatedAt = time.Now().Unix()
+	err := db.QueryRow(`
+		INSERT INTO bill_payments (bill_id, user_id, amount, currency, paid_at, kind, source, note, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, p.BillID, bs.UserID, p.Amount, p.Currency, p.PaidAt, p.Kind, p.Source, p.Note, p.CreatedAt).Scan(&p.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	paid = roundCents(paid + p.Amount)
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"data": gin.H{
+			"payment":    p,
+			"paidAmount": paid,
+			"status":     billStatus(bs, paid, time.Now().Format("2006-01-02")),
+		},
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleDeleteBillPayment DELETE /api/v1/payments/:id
+func handleDeleteBillPayment(c *gin.Context) {
+	res, err := db.Exec(`DELETE FROM bill_payments WHERE id = ? AND user_id = ?`, c.Param("id"), currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "还款记录不存在"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "timestamp": time.Now().Unix()})
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ledongthuc/pdf"
+)
+
+// ─────────────────────────────────────────
+// PDF 账单文本提取
+//
+// 部分银行只发 PDF 账单（有的还用身份证后几位加密）。这里用纯 Go 的 PDF 库读取文字层，
+// 按坐标把字符重新拼成行，交给 extractBillFields 走同一套字段提取。扫描件（无文字层）不做 OCR。
+// 加密 PDF 依次尝试用户为该银行配置的密码和不限银行的通用密码，密码与邮箱授权码一样加密存储。
+// PDF 库只实现了 RC4 和 AES-128 的标准加密，AES-256 的账单单独报“不支持的加密方式”。
+// ─────────────────────────────────────────
+
+// 单个 PDF 附件的大小上限，超过的不解析
+const maxPDFSize = 10 << 20
+
+// errPDFUnsupportedEncryption PDF 库只支持 RC4 和 AES-128 的标准加密，AES-256（V5）的账单无法解密
+var errPDFUnsupportedEncryption = errors.New("PDF使用了不支持的加密方式（如AES-256）")
+
+// PDFPassword 用户配置的 PDF 账单密码（不返回密码本身）
+type PDFPassword struct {
+	ID        int64  `json:"id"`
+	Bank      string `json:"bank"` // 为空表示所有银行都尝试
+	Note      string `json:"note"` // 备注，如“张三身份证后6位”
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// pdfPasswordBook 按银行分组的已解密密码
+type pdfPasswordBook map[string][]string
+
+// candidates 某个银行的 PDF 依次尝试的密码：先该银行的，再通用的
+func (b pdfPasswordBook) candidates(bank string) []string {
+	var out []string
+	if bank != "" {
+		out = append(out, b[bank]...)
+	}
+	return append(out, b[""]...)
+}
+
+// ─────────────────────────────────────────
+// 文本提取
+// ─────────────────────────────────────────
+
+// applyPDFAttachments 提取邮件中 PDF 附件的文字，追加到正文后重新提取账单字段
+func applyPDFAttachments(pb *parsedBill, passwords pdfPasswordBook) {
+	if len(pb.pdfs) == 0 {
+		return
+	}
+	var texts []string
+	for i, data := range pb.pdfs {
+		text, err := extractPDFText(data, passwords.candidates(pb.bank))
+		if err != nil {
+			log.Printf("[bills] 邮件(%d)第%d个PDF解析失败: %v", pb.uid, i+1, err)
+			pb.pdfErr = err
+			continue
+		}
+		if strings.TrimSpace(text) != "" {
+			texts = append(texts, text)
+		}
+	}
+	pb.pdfs = nil
+	if len(texts) == 0 {
+		return
+	}
+
+	if pb.body != "" {
+		texts = append([]string{pb.body}, texts...)
+	}
+	pb.body = strings.Join(texts, "\n")
+	extractBillFields(pb)
+}
+
+// extractPDFText 读取 PDF 的文字层；加密文件依次尝试 passwords
+func extractPDFText(data []byte, passwords []string) (text string, err error) {
+	// PDF 库遇到畸形文件可能 panic
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("PDF解析异常: %v", r)
+		}
+	}()
+
+	next := 0
+	r, err := pdf.NewReaderEncrypted(bytes.NewReader(data), int64(len(data)), func() string {
+		if next >= len(passwords) {
+			return ""
+		}
+		next++
+		return passwords[next-1]
+	})
+	if err == pdf.ErrInvalidPassword {
+		return "", fmt.Errorf("PDF已加密，已配置的密码都不正确")
+	}
+	if err != nil && isUnsupportedPDFEncryption(err) {
+		return "", fmt.Errorf("%w: %v", errPDFUnsupportedEncryption, err)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	for i := 1; i <= r.NumPage(); i++ {
+		page := r.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		lines = append(lines, pdfTextLines(page.Content().Text)...)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// isUnsupportedPDFEncryption PDF 库对不支持的加密版本（V5 等）和超过 128 位的密钥返回的错误
+func isUnsupportedPDFEncryption(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "unsupported PDF: encryption") || strings.HasSuffix(msg, "-bit encryption key")
+}
+
+// pdfTextLines 把逐字的文本按坐标拼成行：Y 相近的归为一行，行内按 X 排序，
+// 字符间距明显大于字号时补一个空格，避免标签和数值、相邻两列的数字粘在一起
+func pdfTextLines(chars []pdf.Text) []string {
+	sort.SliceStable(chars, func(i, j int) bool { return chars[i].Y > chars[j].Y })
+
+	var lines []string
+	for start := 0; start < len(chars); {
+		lineY := chars[start].Y
+		tolerance := math.Max(chars[start].FontSize, 1) / 2
+		end := start + 1
+		for end < len(chars) && lineY-chars[end].Y <= tolerance {
+			end++
+		}
+
+		line := chars[start:end]
+		sort.SliceStable(line, func(i, j int) bool { return line[i].X < line[j].X })
+
+		var sb strings.Builder
+		for i, t := range line {
+			if i > 0 {
+				prev := line[i-1]
+				gap := t.X - (prev.X + prev.W)
+				// 字宽未知（部分 CID 字体）时只能按起点距离估算
+				threshold := prev.FontSize * 0.3
+				if prev.W == 0 {
+					threshold = prev.FontSize * 1.5
+				}
+				if gap > threshold {
+					sb.WriteByte(' ')
+				}
+			}
+			sb.WriteString(t.S)
+		}
+		if s := strings.TrimSpace(sb.String()); s != "" {
+			lines = append(lines, s)
+		}
+		start = end
+	}
+	return lines
+}
+
+// ─────────────────────────────────────────
+// 密码读写
+// ─────────────────────────────────────────
+
+// loadPDFPasswords 读取并解密用户的全部 PDF 密码
+func loadPDFPasswords(userID string) (pdfPasswordBook, error) {
+	rows, err := db.Query(`SELECT bank, password FROM pdf_passwords WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	book := pdfPasswordBook{}
+	for rows.Next() {
+		var bank, sealed string
+		if err := rows.Scan(&bank, &sealed); err != nil {
+			return nil, err
+		}
+		password, err := openSecret(sealed)
+		if err != nil {
+			return nil, fmt.Errorf("PDF密码: %w", err)
+		}
+		book[bank] = append(book[bank], password)
+	}
+	return book, rows.Err()
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：/api/v1/pdf-passwords
+// ─────────────────────────────────────────
+
+func handleListPDFPasswords(c *gin.Context) {
+	rows, err := db.Query(`
+		SELECT id, bank, note, created_at FROM pdf_passwords
+		WHERE user_id = ?
+		ORDER BY bank, id
+	`, currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	passwords := []PDFPassword{}
+	for rows.Next() {
+		var p PDFPassword
+		if err := rows.Scan(&p.ID, &p.Bank, &p.Note, &p.CreatedAt); err != nil {
+			log.Printf("[bills] Scan失败: %v", err)
+			continue
+		}
+		passwords = append(passwords, p)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      passwords,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleCreatePDFPassword(c *gin.Context) {
+	if !requireEmailSecrets(c) {
+		return
+	}
+
+	var req struct {
+		Bank     string `json:"bank"`
+		Note     string `json:"note"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "密码不能为空"})
+		return
+	}
+
+	sealed, err := sealSecret(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	p := PDFPassword{
+		Bank:      strings.TrimSpace(req.Bank),
+		Note:      strings.TrimSpace(req.Note),
+		CreatedAt: time.Now().Unix(),
+	}
+	res, err := db.Exec(`INSERT INTO pdf_passwords (user_id, bank, note, password, created_at) VALUES (?, ?, ?, ?, ?)`,
+		currentUserID(c), p.Bank, p.Note, sealed, p.CreatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	p.ID, _ = res.LastInsertId()
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success":   true,
+		"data":      p,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func handleDeletePDFPassword(c *gin.Context) {
+	res, err := db.Exec(`DELETE FROM pdf_passwords WHERE id = ? AND user_id = ?`, c.Param("id"), currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "密码不存在"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "timestamp": time.Now().Unix()})
+}
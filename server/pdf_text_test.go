@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// testdata/statements/pdf 下的样例都是同一页账单，加密的样例用户密码均为 123456
+const samplePDFText = `CMB Credit Card Statement
+Statement Date 2025-06-05
+New Balance 1,234.56
+Min Payment 123.46
+Payment Due Date 2025-06-23`
+
+func readSamplePDF(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "statements", "pdf", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestExtractPDFText(t *testing.T) {
+	cases := []struct {
+		file      string
+		passwords []string
+		wantErr   bool
+	}{
+		{"plain.pdf", nil, false},
+		{"rc4_123456.pdf", []string{"123456"}, false},
+		{"rc4_123456.pdf", []string{"000000", "123456"}, false},
+		{"rc4_123456.pdf", []string{"000000"}, true},
+		{"rc4_123456.pdf", nil, true},
+		{"aes128_123456.pdf", []string{"000000", "123456"}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.file+"/"+strings.Join(tc.passwords, ","), func(t *testing.T) {
+			text, err := extractPDFText(readSamplePDF(t, tc.file), tc.passwords)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("密码不正确时应当报错，得到 %q", text)
+				}
+				if errors.Is(err, errPDFUnsupportedEncryption) {
+					t.Errorf("密码错误不应报为不支持的加密方式: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != samplePDFText {
+				t.Errorf("提取结果\n%s\n期望\n%s", text, samplePDFText)
+			}
+		})
+	}
+}
+
+// AES-256 加密的 PDF 即使密码正确也无法解密，应报为不支持的加密方式
+func TestExtractPDFTextUnsupportedEncryption(t *testing.T) {
+	_, err := extractPDFText(readSamplePDF(t, "aes256_123456.pdf"), []string{"123456"})
+	if !errors.Is(err, errPDFUnsupportedEncryption) {
+		t.Errorf("err = %v, want errPDFUnsupportedEncryption", err)
+	}
+}
+
+// 密码按顺序尝试：先该银行的，再通用的；不会用到其他银行的密码
+func TestPDFPasswordCandidates(t *testing.T) {
+	book := pdfPasswordBook{
+		"招商银行": {"cmb1", "cmb2"},
+		"中信银行": {"citic"},
+		"":     {"any"},
+	}
+	cases := []struct {
+		bank string
+		want []string
+	}{
+		{"招商银行", []string{"cmb1", "cmb2", "any"}},
+		{"工商银行", []string{"any"}},
+		{"", []string{"any"}},
+	}
+	for _, tc := range cases {
+		if got := book.candidates(tc.bank); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("candidates(%q) = %v, want %v", tc.bank, got, tc.want)
+		}
+	}
+}
+
+// chars 按给定坐标逐字展开一段文字，每个字宽 w
+func chars(s string, x, y, size, w float64) []pdf.Text {
+	var out []pdf.Text
+	for _, r := range s {
+		out = append(out, pdf.Text{S: string(r), X: x, Y: y, W: w, FontSize: size})
+		x += w
+	}
+	return out
+}
+
+func TestPDFTextLines(t *testing.T) {
+	cases := []struct {
+		name  string
+		chars []pdf.Text
+		want  []string
+	}{
+		{
+			name: "按Y从上到下排行",
+			chars: append(append(
+				chars("第二行", 50, 680, 10, 10),
+				chars("第一行", 50, 700, 10, 10)...),
+				chars("第三行", 50, 660, 10, 10)...),
+			want: []string{"第一行", "第二行", "第三行"},
+		},
+		{
+			name: "Y略有偏差的字符归为同一行，行内按X排序",
+			chars: append(
+				chars("12.34", 200, 700.4, 10, 5),
+				chars("本期应还", 50, 700, 10, 10)...),
+			want: []string{"本期应还 12.34"},
+		},
+		{
+			name: "相邻字符不补空格",
+			chars: append(
+				chars("AB", 50, 700, 10, 6),
+				chars("CD", 62.5, 700, 10, 6)...),
+			want: []string{"ABCD"},
+		},
+		{
+			name: "两列数字之间补空格",
+			chars: append(
+				chars("1,000.00", 50, 700, 10, 5),
+				chars("200.00", 95, 700, 10, 5)...),
+			want: []string{"1,000.00 200.00"},
+		},
+		{
+			name: "字宽未知时按起点距离判断",
+			chars: []pdf.Text{
+				{S: "账", X: 50, Y: 700, FontSize: 10},
+				{S: "单", X: 60, Y: 700, FontSize: 10},
+				{S: "5", X: 100, Y: 700, FontSize: 10},
+			},
+			want: []string{"账单 5"},
+		},
+		{
+			name:  "空白行丢弃",
+			chars: append(chars("   ", 50, 700, 10, 5), chars("金额", 50, 680, 10, 10)...),
+			want:  []string{"金额"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := pdfTextLines(tc.chars); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("pdfTextLines = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────
+// Web Push 订阅
+//
+// 前端（PWA）用 VAPID 公钥订阅后把 PushSubscription 交给服务器，一个浏览器一条订阅，
+// 按 endpoint 去重。使用设备令牌登记时记下设备ID：同一设备重新订阅会替换旧订阅，
+// 吊销设备时一并删除。推送服务返回订阅失效（404/410）时自动删除。
+// 提醒渠道 webpush 把提醒发到用户的全部订阅，至少一个成功即算发送成功。
+//
+// endpoint 由客户端提交，只接受主流浏览器推送服务的地址（见 pushServiceHosts），
+// 自建推送服务（如 autopush）可用环境变量 PUSH_SERVICE_HOSTS 追加域名，多个用逗号分隔。
+// ─────────────────────────────────────────
+
+// PushSubscription 一条浏览器推送订阅
+type PushSubscription struct {
+	ID            int64  `json:"id"`
+	DeviceID      string `json:"deviceId,omitempty"`
+	Endpoint      string `json:"endpoint"`
+	P256dh        string `json:"-"`
+	Auth          string `json:"-"`
+	UserAgent     string `json:"userAgent"`
+	CreatedAt     int64  `json:"createdAt"`
+	LastSuccessAt int64  `json:"lastSuccessAt,omitempty"`
+}
+
+// pushMessage 推送给 Service Worker 的内容
+type pushMessage struct {
+	Title string   `json:"title"`
+	Body  string   `json:"body"`
+	Tag   string   `json:"tag,omitempty"` // 同一待还款项的提醒互相替换
+	URL   string   `json:"url"`
+	Due   *dueItem `json:"due,omitempty"`
+}
+
+func init() {
+	registerNotifyChannel(webpushChannel{})
+}
+
+const pushSubscriptionColumns = `id, device_id, endpoint, p256dh, auth, user_agent, COALESCE(created_at, 0), last_success_at`
+
+func scanPushSubscription(r rowScanner) (PushSubscription, error) {
+	var s PushSubscription
+	err := r.Scan(&s.ID, &s.DeviceID, &s.Endpoint, &s.P256dh, &s.Auth, &s.UserAgent, &s.CreatedAt, &s.LastSuccessAt)
+	return s, err
+}
+
+func loadPushSubscriptions(userID string) ([]PushSubscription, error) {
+	rows, err := db.Query(`SELECT `+pushSubscriptionColumns+` FROM push_subscriptions WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []PushSubscription{}
+	for rows.Next() {
+		s, err := scanPushSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+// pushResult 向一个订阅发送的结果
+type pushResult struct {
+	SubscriptionID int64  `json:"subscriptionId"`
+	Endpoint       string `json:"endpoint"`
+	Sent           bool   `json:"sent"`
+	Removed        bool   `json:"removed,omitempty"` // 订阅已失效并被删除
+	Error          string `json:"error,omitempty"`
+}
+
+// pushToSubscriptions 向一组订阅发送同一条消息，失效的订阅被删除
+func pushToSubscriptions(subs []PushSubscription, msg pushMessage) ([]pushResult, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]pushResult, 0, len(subs))
+	for _, s := range subs {
+		r := pushResult{SubscriptionID: s.ID, Endpoint: s.Endpoint}
+		err := sendWebPush(s, payload)
+		switch {
+		case err == nil:
+			r.Sent = true
+			if _, err := db.Exec(`UPDATE push_subscriptions SET last_success_at = ? WHERE id = ?`, time.Now().Unix(), s.ID); err != nil {
+				log.Printf("[push] 更新订阅状态失败: %v", err)
+			}
+		case errors.Is(err, errPushGone):
+			r.Error = err.Error()
+			if _, err := db.Exec(`DELETE FROM push_subscriptions WHERE id = ?`, s.ID); err != nil {
+				log.Printf("[push] 删除失效订阅失败: %v", err)
+			} else {
+				r.Removed = true
+			}
+		default:
+			r.Error = err.Error()
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// ─────────────────────────────────────────
+// webpush 提醒渠道
+// ─────────────────────────────────────────
+
+type webpushChannel struct{}
+
+func (webpushChannel) Name() string { return "webpush" }
+
+func (webpushChannel) Send(userID string, prefs NotificationPrefs, n notification) error {
+	if vapidKey == nil {
+		return errPushDisabled
+	}
+	subs, err := loadPushSubscriptions(userID)
+	if err != nil {
+		return err
+	}
+	if len(subs) == 0 {
+		return fmt.Errorf("没有已订阅推送的设备")
+	}
+
+	msg := pushMessage{Title: n.Title, Body: n.Body, URL: "/", Due: n.Due}
+	if n.Due != nil {
+		msg.Tag = n.Due.RefKey
+	}
+	results, err := pushToSubscriptions(subs, msg)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, r := range results {
+		if r.Sent {
+			return nil
+		}
+		errs = append(errs, r.Error)
+	}
+	return fmt.Errorf("推送全部失败: %s", strings.Join(errs, "; "))
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：/api/v1/push
+// ─────────────────────────────────────────
+
+// handleGetVAPIDPublicKey GET /api/v1/push/vapid-public-key
+func handleGetVAPIDPublicKey(c *gin.Context) {
+	if vapidKey == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errPushDisabled.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      gin.H{"publicKey": vapidPublicKey()},
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleListPushSubscriptions GET /api/v1/push/subscriptions
+func handleListPushSubscriptions(c *gin.Context) {
+	subs, err := loadPushSubscriptions(currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      subs,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// pushSubscriptionRequest 即浏览器 PushSubscription.toJSON() 的结构
+type pushSubscriptionRequest struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// pushServiceHosts 浏览器推送服务的域名，endpoint 的主机名须为其中之一或其子域名
+var pushServiceHosts = []string{
+	"fcm.googleapis.com",                // Chrome、Android
+	"updates.push.services.mozilla.com", // Firefox
+	"notify.windows.com",                // Edge（wns2-*.notify.windows.com）
+	"push.apple.com",                    // Safari（web.push.apple.com）
+}
+
+// isPushServiceEndpoint endpoint 是否指向已知的推送服务
+func isPushServiceEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	allowed := pushServiceHosts
+	for _, h := range strings.Split(os.Getenv("PUSH_SERVICE_HOSTS"), ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			allowed = append(allowed[:len(allowed):len(allowed)], h)
+		}
+	}
+	for _, h := range allowed {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+func validatePushSubscription(req pushSubscriptionRequest) error {
+	u, err := url.Parse(req.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("endpoint 应为 https URL")
+	}
+	if !isPushServiceEndpoint(req.Endpoint) {
+		return fmt.Errorf("不支持的推送服务: %s", u.Hostname())
+	}
+	p256dh, err := decodeBase64URL(req.Keys.P256dh)
+	if err != nil || len(p256dh) != 65 || p256dh[0] != 4 {
+		return fmt.Errorf("keys.p256dh 应为未压缩的 P-256 公钥")
+	}
+	auth, err := decodeBase64URL(req.Keys.Auth)
+	if err != nil || len(auth) != 16 {
+		return fmt.Errorf("keys.auth 应为 16 字节")
+	}
+	return nil
+}
+
+// handleSavePushSubscription POST /api/v1/push/subscriptions
+// 请求体为 PushSubscription.toJSON()，同一 endpoint 重复登记时更新密钥。
+func handleSavePushSubscription(c *gin.Context) {
+	if vapidKey == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errPushDisabled.Error()})
+		return
+	}
+
+	var req pushSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Endpoint = strings.TrimSpace(req.Endpoint)
+	if err := validatePushSubscription(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := currentUserID(c)
+	deviceID := currentDeviceID(c)
+	now := time.Now().Unix()
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// 同一设备只保留最新的订阅
+	if deviceID != "" {
+		_, err = tx.Exec(`DELETE FROM push_subscriptions WHERE user_id = ? AND device_id = ? AND endpoint != ?`,
+			userID, deviceID, req.Endpoint)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	_, err = tx.Exec(`
+		INSERT INTO push_subscriptions (user_id, device_id, endpoint, p256dh, auth, user_agent, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(endpoint) DO UPDATE SET
+			user_id = excluded.user_id, device_id = excluded.device_id, p256dh = excluded.p256dh,
+			auth = excluded.auth, user_agent = excluded.user_agent
+	`, userID, deviceID, req.Endpoint, req.Keys.P256dh, req.Keys.Auth, truncate(c.Request.UserAgent(), 200), now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sub, err := scanPushSubscription(tx.QueryRow(`SELECT `+pushSubscriptionColumns+` FROM push_subscriptions WHERE endpoint = ?`, req.Endpoint))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      sub,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleDeletePushSubscription DELETE /api/v1/push/subscriptions
+// 请求体 {"endpoint":"..."}（浏览器取消订阅后调用）；不带 endpoint 时删除当前设备的订阅。
+func handleDeletePushSubscription(c *gin.Context) {
+	var req struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	userID := currentUserID(c)
+	var res sql.Result
+	var err error
+	switch {
+	case strings.TrimSpace(req.Endpoint) != "":
+		res, err = db.Exec(`DELETE FROM push_subscriptions WHERE user_id = ? AND endpoint = ?`, userID, strings.TrimSpace(req.Endpoint))
+	case currentDeviceID(c) != "":
+		res, err = db.Exec(`DELETE FROM push_subscriptions WHERE user_id = ? AND device_id = ?`, userID, currentDeviceID(c))
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少 endpoint"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "订阅不存在"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "timestamp": time.Now().Unix()})
+}
+
+// handleTestPush POST /api/v1/push/test
+// 向用户的全部订阅（请求体带 endpoint 时只向该订阅）发送一条测试推送，返回每个订阅的结果。
+func handleTestPush(c *gin.Context) {
+	if vapidKey == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errPushDisabled.Error()})
+		return
+	}
+
+	var req struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	subs, err := loadPushSubscriptions(currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Endpoint != "" {
+		var only []PushSubscription
+		for _, s := range subs {
+			if s.Endpoint == req.Endpoint {
+				only = append(only, s)
+			}
+		}
+		subs = only
+	}
+	if len(subs) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "没有已订阅推送的设备"})
+		return
+	}
+
+	results, err := pushToSubscriptions(subs, pushMessage{
+		Title: "推送测试",
+		Body:  "收到这条通知说明推送已配置成功，应用关闭时也能收到还款提醒。",
+		Tag:   "test",
+		URL:   "/",
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      results,
+		"timestamp": time.Now().Unix(),
+	})
+}
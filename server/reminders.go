@@ -0,0 +1,591 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────
+// 还款到期提醒
+//
+// 待还款项有两类：已入库且未还清的账单（按账单的还款日），以及还没有本期账单的卡片
+// （按卡片的账期规则推算下一个还款日，见 billingcycle 包）。
+// 用户设置提前几天提醒（默认 7/3/1 天），每个待还款项在每个提醒档位、每个渠道只发送成功一次：
+// 服务停机错过当天也会在下次检查时补发当前档位（如距还款日 5 天时补发“7 天”档），不会补发已经过去的档位。
+// 每次发送（含失败）都记入 reminder_deliveries，失败的同一档位最多重试 3 次。
+// 调度器每天 REMINDER_HOUR 点（默认 9 点，服务器本地时间）之后开始检查。
+// ─────────────────────────────────────────
+
+// NotificationPrefs 用户的提醒设置
+type NotificationPrefs struct {
+	Enabled    bool     `json:"enabled"`
+	Channels   []string `json:"channels"`   // 启用的渠道，见 notifyChannels
+	DaysBefore []int    `json:"daysBefore"` // 提前几天提醒
+	EmailTo    string   `json:"emailTo"`    // email 渠道的收件地址
+	WebhookURL string   `json:"webhookUrl"` // webhook 渠道的地址
+	UpdatedAt  int64    `json:"updatedAt"`
+}
+
+// ReminderDelivery 一次提醒发送记录
+type ReminderDelivery struct {
+	ID         int64  `json:"id"`
+	RefKey     string `json:"refKey"` // bill:<账单id> / card:<syncId> / test
+	DueDate    string `json:"dueDate"`
+	DaysBefore int    `json:"daysBefore"`
+	Channel    string `json:"channel"`
+	Title      string `json:"title"`
+	Status     string `json:"status"` // sent/failed
+	Error      string `json:"error,omitempty"`
+	CreatedAt  int64  `json:"createdAt"`
+}
+
+// dueItem 一个待还款项
+type dueItem struct {
+	RefKey     string  `json:"refKey"`
+	BillID     int64   `json:"billId,omitempty"` // 按卡片推算时为 0
+	CardSyncID string  `json:"cardSyncId"`
+	CardName   string  `json:"cardName"`
+	DueDate    string  `json:"dueDate"`
+	DaysLeft   int     `json:"daysLeft"`
+	Amount     float64 `json:"amount"`    // 账单金额，按卡片推算时为 0
+	Remaining  float64 `json:"remaining"` // 尚未还的金额
+	Currency   string  `json:"currency"`
+}
+
+const (
+	deliverySent   = "sent"
+	deliveryFailed = "failed"
+
+	// 同一档位失败后的最多尝试次数
+	maxDeliveryAttempts = 3
+	// 提醒天数的上限
+	maxReminderDays = 30
+)
+
+var defaultReminderDays = []int{7, 3, 1}
+
+func defaultNotificationPrefs() NotificationPrefs {
+	return NotificationPrefs{Enabled: true, Channels: []string{}, DaysBefore: defaultReminderDays}
+}
+
+func loadNotificationPrefs(userID string) (NotificationPrefs, error) {
+	p := defaultNotificationPrefs()
+	var enabled int
+	var channels, days string
+	err := db.QueryRow(`
+		SELECT enabled, channels, days_before, email_to, webhook_url, COALESCE(updated_at, 0)
+		FROM notification_prefs WHERE user_id = ?`, userID).
+		Scan(&enabled, &channels, &days, &p.EmailTo, &p.WebhookURL, &p.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	p.Enabled = enabled != 0
+	if err := json.Unmarshal([]byte(channels), &p.Channels); err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal([]byte(days), &p.DaysBefore); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// validateNotificationPrefs 整理并校验设置
+func validateNotificationPrefs(p NotificationPrefs) (NotificationPrefs, error) {
+	seen := map[string]bool{}
+	channels := []string{}
+	for _, ch := range p.Channels {
+		if _, ok := notifyChannels[ch]; !ok {
+			return p, fmt.Errorf("未知渠道: %s", ch)
+		}
+		if !seen[ch] {
+			seen[ch] = true
+			channels = append(channels, ch)
+		}
+	}
+	p.Channels = channels
+
+	days := []int{}
+	for _, d := range p.DaysBefore {
+		if d < 0 || d > maxReminderDays {
+			return p, fmt.Errorf("提醒天数应在 0-%d 之间", maxReminderDays)
+		}
+		if !containsInt(days, d) {
+			days = append(days, d)
+		}
+	}
+	if len(days) == 0 {
+		days = defaultReminderDays
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(days)))
+	p.DaysBefore = days
+
+	p.EmailTo = strings.TrimSpace(p.EmailTo)
+	if p.EmailTo != "" {
+		addr, err := mail.ParseAddress(p.EmailTo)
+		if err != nil {
+			return p, fmt.Errorf("邮箱格式不正确")
+		}
+		p.EmailTo = addr.Address
+	}
+	if seen["email"] && p.EmailTo == "" {
+		return p, fmt.Errorf("启用邮件提醒需要填写 emailTo")
+	}
+
+	p.WebhookURL = strings.TrimSpace(p.WebhookURL)
+	if p.WebhookURL != "" {
+		u, err := url.Parse(p.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return p, fmt.Errorf("Webhook 地址应为 http(s) URL")
+		}
+	}
+	if seen["webhook"] && p.WebhookURL == "" {
+		return p, fmt.Errorf("启用 Webhook 提醒需要填写 webhookUrl")
+	}
+	return p, nil
+}
+
+func containsInt(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ─────────────────────────────────────────
+// 待还款项
+// ─────────────────────────────────────────
+
+// upcomingDues 列出今天起 horizon 天内到期的待还款项，按还款日排序
+func upcomingDues(userID string, today time.Time, horizon int) ([]dueItem, error) {
+	from := today.Format("2006-01-02")
+	to := today.AddDate(0, 0, horizon).Format("2006-01-02")
+
+	cards := map[string]Card{}
+	for _, card := range getCardsAll(userID) {
+		cards[card.SyncID] = card
+	}
+
+	// 近两个月内有还款日的账单：未还清的进入列表，同时用来判断卡片本期账单是否已到
+	rows, err := db.Query(`SELECT `+billColumns+` FROM bill_statements WHERE user_id = ? AND due_date >= ? AND due_date <= ?`,
+		userID, today.AddDate(0, -1, 0).Format("2006-01-02"), to)
+	if err != nil {
+		return nil, err
+	}
+	var bills []BillStatement
+	for rows.Next() {
+		bs, err := scanBill(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		bills = append(bills, bs)
+	}
+	rows.Close()
+	if err := attachBillPayments(userID, bills); err != nil {
+		return nil, err
+	}
+
+	var items []dueItem
+	billedMonths := map[string]bool{} // cardSyncId + YYYY-MM
+	for _, bs := range bills {
+		billedMonths[bs.CardSyncID+bs.DueDate[:7]] = true
+		if bs.DueDate < from || bs.Status == billStatusPaid {
+			continue
+		}
+		name := bs.Bank
+		if card, ok := cards[bs.CardSyncID]; ok {
+			name = cardLabel(card)
+		}
+		items = append(items, dueItem{
+			RefKey:     "bill:" + strconv.FormatInt(bs.ID, 10),
+			BillID:     bs.ID,
+			CardSyncID: bs.CardSyncID,
+			CardName:   name,
+			DueDate:    bs.DueDate,
+			DaysLeft:   daysBetween(from, bs.DueDate),
+			Amount:     bs.Amount,
+			Remaining:  roundCents(bs.Amount - bs.PaidAmount),
+			Currency:   bs.Currency,
+		})
+	}
+
+	dueAfter, err := loadDueAfterDays(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, card := range cards {
+		next, ok := cardCycleRule(card, dueAfter).NextDueDate(today)
+		if !ok {
+			continue
+		}
+		due := next.Format("2006-01-02")
+		if due > to || billedMonths[card.SyncID+due[:7]] {
+			continue
+		}
+		items = append(items, dueItem{
+			RefKey:     "card:" + card.SyncID,
+			CardSyncID: card.SyncID,
+			CardName:   cardLabel(card),
+			DueDate:    due,
+			DaysLeft:   daysBetween(from, due),
+			Currency:   "CNY",
+		})
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].DueDate != items[j].DueDate {
+			return items[i].DueDate < items[j].DueDate
+		}
+		return items[i].RefKey < items[j].RefKey
+	})
+	return items, nil
+}
+
+// daysBetween 两个 YYYY-MM-DD 之间相差的天数
+func daysBetween(from, to string) int {
+	a, _ := time.Parse("2006-01-02", from)
+	b, _ := time.Parse("2006-01-02", to)
+	return int(b.Sub(a).Hours() / 24)
+}
+
+// cardLabel 提醒中显示的卡片名称
+func cardLabel(card Card) string {
+	label := card.Name
+	if label == "" {
+		label = card.Bank
+	}
+	if card.LastFour != "" {
+		label += " 尾号" + card.LastFour
+	}
+	return label
+}
+
+// reminderStage 当前所处的提醒档位：days 中不小于 daysLeft 的最小值；已过期或还早时返回 -1
+func reminderStage(daysLeft int, days []int) int {
+	stage := -1
+	if daysLeft < 0 {
+		return stage
+	}
+	for _, d := range days {
+		if daysLeft <= d && (stage < 0 || d < stage) {
+			stage = d
+		}
+	}
+	return stage
+}
+
+func reminderMessage(item dueItem) notification {
+	when := fmt.Sprintf("%d 天后", item.DaysLeft)
+	switch item.DaysLeft {
+	case 0:
+		when = "今天"
+	case 1:
+		when = "明天"
+	}
+	body := fmt.Sprintf("%s 的还款日是 %s（%s）。", item.CardName, item.DueDate, when)
+	if item.BillID != 0 {
+		body += fmt.Sprintf("本期应还 %.2f %s，尚需还款 %.2f %s。", item.Amount, item.Currency, item.Remaining, item.Currency)
+	} else {
+		body += "本期账单尚未获取，请留意应还金额。"
+	}
+	return notification{Title: item.CardName + " 还款提醒", Body: body, Due: &item}
+}
+
+// ─────────────────────────────────────────
+// 发送
+// ─────────────────────────────────────────
+
+// sendReminders 为一个用户发送当前应发的提醒，返回成功发送的条数
+func sendReminders(userID string, now time.Time) (int, error) {
+	prefs, err := loadNotificationPrefs(userID)
+	if err != nil {
+		return 0, err
+	}
+	if !prefs.Enabled || len(prefs.Channels) == 0 {
+		return 0, nil
+	}
+
+	horizon := 0
+	for _, d := range prefs.DaysBefore {
+		horizon = max(horizon, d)
+	}
+	items, err := upcomingDues(userID, now, horizon)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, item := range items {
+		stage := reminderStage(item.DaysLeft, prefs.DaysBefore)
+		if stage < 0 {
+			continue
+		}
+		for _, name := range prefs.Channels {
+			ch, ok := notifyChannels[name]
+			if !ok {
+				continue
+			}
+			var done, failures int
+			err := db.QueryRow(`
+				SELECT COALESCE(SUM(status = 'sent'), 0), COALESCE(SUM(status = 'failed'), 0) FROM reminder_deliveries
+				WHERE user_id = ? AND ref_key = ? AND due_date = ? AND days_before = ? AND channel = ?`,
+				userID, item.RefKey, item.DueDate, stage, name).Scan(&done, &failures)
+			if err != nil {
+				return sent, err
+			}
+			if done > 0 || failures >= maxDeliveryAttempts {
+				continue
+			}
+			if deliverNotification(userID, ch, prefs, reminderMessage(item), item.RefKey, item.DueDate, stage) == nil {
+				sent++
+			}
+		}
+	}
+	return sent, nil
+}
+
+// deliverNotification 通过一个渠道发送并记录结果
+func deliverNotification(userID string, ch NotifyChannel, prefs NotificationPrefs, n notification, refKey, dueDate string, daysBefore int) error {
+	err := ch.Send(userID, prefs, n)
+	status, errMsg := deliverySent, ""
+	if err != nil {
+		status, errMsg = deliveryFailed, err.Error()
+		log.Printf("[reminders] 用户 %s 通过 %s 发送提醒失败: %v", userID, ch.Name(), err)
+	}
+	_, dbErr := db.Exec(`
+		INSERT INTO reminder_deliveries (user_id, ref_key, due_date, days_before, channel, title, status, error, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, refKey, dueDate, daysBefore, ch.Name(), n.Title, status, errMsg, time.Now().Unix())
+	if dbErr != nil {
+		log.Printf("[reminders] 记录发送结果失败: %v", dbErr)
+	}
+	return err
+}
+
+// reminderHour 读取 REMINDER_HOUR（0-23），每天该时刻之后才发送提醒
+func reminderHour() int {
+	raw := os.Getenv("REMINDER_HOUR")
+	if raw == "" {
+		return 9
+	}
+	h, err := strconv.Atoi(raw)
+	if err != nil || h < 0 || h > 23 {
+		log.Printf("[reminders] REMINDER_HOUR 格式错误(%s)，使用默认 9 点", raw)
+		return 9
+	}
+	return h
+}
+
+// startReminderScheduler 启动提醒检查（由 main 调用）
+func startReminderScheduler() {
+	hour := reminderHour()
+	log.Printf("[reminders] 还款提醒已启动，每天 %d 点后发送", hour)
+	go func() {
+		for {
+			if now := time.Now(); now.Hour() >= hour {
+				runReminders(now)
+			}
+			time.Sleep(schedulerTick)
+		}
+	}()
+}
+
+// runReminders 为所有启用提醒的用户发送提醒
+func runReminders(now time.Time) {
+	rows, err := db.Query(`SELECT user_id FROM notification_prefs WHERE enabled = 1 AND channels != '[]'`)
+	if err != nil {
+		log.Printf("[reminders] 读取提醒设置失败: %v", err)
+		return
+	}
+	var users []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err == nil {
+			users = append(users, userID)
+		}
+	}
+	rows.Close()
+
+	for _, userID := range users {
+		n, err := sendReminders(userID, now)
+		if err != nil {
+			log.Printf("[reminders] 用户 %s 检查提醒失败: %v", userID, err)
+		}
+		if n > 0 {
+			log.Printf("[reminders] 用户 %s 发送提醒 %d 条", userID, n)
+		}
+	}
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：/api/v1/notifications
+// ─────────────────────────────────────────
+
+func availableNotifyChannels() []string {
+	names := make([]string, 0, len(notifyChannels))
+	for name := range notifyChannels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handleGetNotificationPrefs GET /api/v1/notifications/preferences
+func handleGetNotificationPrefs(c *gin.Context) {
+	prefs, err := loadNotificationPrefs(currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"preferences":       prefs,
+			"availableChannels": availableNotifyChannels(),
+		},
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleSaveNotificationPrefs PUT /api/v1/notifications/preferences
+func handleSaveNotificationPrefs(c *gin.Context) {
+	var req NotificationPrefs
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	prefs, err := validateNotificationPrefs(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	channels, _ := json.Marshal(prefs.Channels)
+	days, _ := json.Marshal(prefs.DaysBefore)
+	prefs.UpdatedAt = time.Now().Unix()
+	_, err = db.Exec(`
+		INSERT INTO notification_prefs (user_id, enabled, channels, days_before, email_to, webhook_url, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET
+			enabled = excluded.enabled, channels = excluded.channels, days_before = excluded.days_before,
+			email_to = excluded.email_to, webhook_url = excluded.webhook_url, updated_at = excluded.updated_at
+	`, currentUserID(c), boolToInt(prefs.Enabled), string(channels), string(days), prefs.EmailTo, prefs.WebhookURL, prefs.UpdatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      prefs,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleListUpcomingDues GET /api/v1/notifications/upcoming?days=30
+func handleListUpcomingDues(c *gin.Context) {
+	days := maxReminderDays
+	if n, err := strconv.Atoi(c.Query("days")); err == nil && n >= 0 && n <= 366 {
+		days = n
+	}
+	items, err := upcomingDues(currentUserID(c), time.Now(), days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if items == nil {
+		items = []dueItem{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      items,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleListReminderDeliveries GET /api/v1/notifications/deliveries?limit=50
+func handleListReminderDeliveries(c *gin.Context) {
+	limit := 50
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil && n > 0 && n <= 500 {
+		limit = n
+	}
+
+	rows, err := db.Query(`
+		SELECT id, ref_key, due_date, days_before, channel, title, status, error, created_at
+		FROM reminder_deliveries WHERE user_id = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, currentUserID(c), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []ReminderDelivery{}
+	for rows.Next() {
+		var d ReminderDelivery
+		err := rows.Scan(&d.ID, &d.RefKey, &d.DueDate, &d.DaysBefore, &d.Channel, &d.Title, &d.Status, &d.Error, &d.CreatedAt)
+		if err != nil {
+			log.Printf("[reminders] Scan失败: %v", err)
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      deliveries,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// handleTestNotification POST /api/v1/notifications/test
+// 请求体 {"channel":"email"}，按当前保存的设置发送一条测试提醒，结果记入发送记录。
+func handleTestNotification(c *gin.Context) {
+	var req struct {
+		Channel string `json:"channel"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ch, ok := notifyChannels[req.Channel]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "未知渠道: " + req.Channel})
+		return
+	}
+
+	userID := currentUserID(c)
+	prefs, err := loadNotificationPrefs(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	n := notification{Title: "还款提醒测试", Body: "这是一条测试提醒，收到说明该渠道已配置成功。"}
+	if err := deliverNotification(userID, ch, prefs, n, "test", time.Now().Format("2006-01-02"), 0); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "timestamp": time.Now().Unix()})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ─────────────────────────────────────────
+// 邮箱授权码加密
+//
+// email_config.password 和 pdf_passwords.password 用 AES-256-GCM 加密后存储，
+// 格式为 enc:v1:<密钥ID>:<base64(nonce+密文)>。
+// 密钥（32 字节，base64 编码）优先读环境变量 EMAIL_SECRET_KEY，其次读 DATA_DIR/email_secret.key。
+// 轮换密钥：把新密钥设为当前密钥，旧密钥放进 EMAIL_SECRET_KEY_PREVIOUS（逗号分隔），
+// 启动时会用当前密钥重新加密所有旧数据（包括引入加密之前的明文）。
+// 没有密钥时不读取任何授权码，账单拉取和邮箱配置、PDF 密码的保存都会被拒绝。
+// ─────────────────────────────────────────
+
+const (
+	secretPrefix      = "enc:v1:"
+	secretKeyFileName = "email_secret.key"
+)
+
+var errNoSecretKey = errors.New("服务端未配置邮箱加密密钥（EMAIL_SECRET_KEY 或 DATA_DIR/email_secret.key）")
+
+// secretKey 一把 AES-256 密钥，ID 为密钥哈希前缀，用来识别密文是哪把密钥加密的
+type secretKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+var (
+	currentSecretKey  *secretKey
+	previousSecretKey = map[string]*secretKey{}
+)
+
+// sealedColumns 存放密文的列，轮换密钥时逐一重新加密
+var sealedColumns = []struct{ table, column string }{
+	{"email_config", "password"},
+	{"pdf_passwords", "password"},
+}
+
+// initEmailSecrets 加载密钥并重新加密旧数据（由 initDB 在迁移之后调用）
+func initEmailSecrets() {
+	raw := strings.TrimSpace(os.Getenv("EMAIL_SECRET_KEY"))
+	if raw == "" {
+		data, err := os.ReadFile(filepath.Join(dataDir, secretKeyFileName))
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal("读取邮箱加密密钥失败:", err)
+		}
+		raw = strings.TrimSpace(string(data))
+	}
+	if raw == "" {
+		log.Printf("[secrets] 未配置邮箱加密密钥，账单拉取已停用。可执行 head -c 32 /dev/urandom | base64 > %s 生成",
+			filepath.Join(dataDir, secretKeyFileName))
+		return
+	}
+
+	key, err := parseSecretKey(raw)
+	if err != nil {
+		log.Fatal("邮箱加密密钥无效:", err)
+	}
+	currentSecretKey = key
+
+	for _, old := range strings.Split(os.Getenv("EMAIL_SECRET_KEY_PREVIOUS"), ",") {
+		if old = strings.TrimSpace(old); old == "" {
+			continue
+		}
+		k, err := parseSecretKey(old)
+		if err != nil {
+			log.Fatal("EMAIL_SECRET_KEY_PREVIOUS 中的密钥无效:", err)
+		}
+		previousSecretKey[k.id] = k
+	}
+
+	for _, sc := range sealedColumns {
+		if err := reencryptColumn(sc.table, sc.column); err != nil {
+			log.Fatalf("重新加密 %s.%s 失败: %v", sc.table, sc.column, err)
+		}
+	}
+}
+
+func parseSecretKey(raw string) (*secretKey, error) {
+	key, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("不是有效的 base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("长度应为 32 字节，实际 %d 字节", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &secretKey{id: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+// emailSecretsReady 是否可以读写邮箱授权码
+func emailSecretsReady() bool {
+	return currentSecretKey != nil
+}
+
+// sealSecret 用当前密钥加密
+func sealSecret(plain string) (string, error) {
+	if currentSecretKey == nil {
+		return "", errNoSecretKey
+	}
+	k := currentSecretKey
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, []byte(plain), nil)
+	return secretPrefix + k.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openSecret 解密 sealSecret 的结果，不接受明文
+func openSecret(stored string) (string, error) {
+	if currentSecretKey == nil {
+		return "", errNoSecretKey
+	}
+	rest, ok := strings.CutPrefix(stored, secretPrefix)
+	if !ok {
+		return "", errors.New("授权码未加密")
+	}
+	id, payload, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", errors.New("授权码密文格式错误")
+	}
+
+	k := currentSecretKey
+	if id != k.id {
+		if k = previousSecretKey[id]; k == nil {
+			return "", fmt.Errorf("找不到加密授权码的密钥(%s)", id)
+		}
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil || len(data) < k.aead.NonceSize() {
+		return "", errors.New("授权码密文格式错误")
+	}
+	nonce, ciphertext := data[:k.aead.NonceSize()], data[k.aead.NonceSize():]
+	plain, err := k.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("授权码解密失败")
+	}
+	return string(plain), nil
+}
+
+// reencryptColumn 把明文和旧密钥加密的值统一换成当前密钥加密
+func reencryptColumn(table, column string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(fmt.Sprintf(`SELECT id, %s FROM %s`, column, table))
+	if err != nil {
+		return err
+	}
+	stale := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var stored string
+		if err := rows.Scan(&id, &stored); err != nil {
+			rows.Close()
+			return err
+		}
+		if !strings.HasPrefix(stored, secretPrefix+currentSecretKey.id+":") {
+			stale[id] = stored
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, stored := range stale {
+		plain := stored
+		if strings.HasPrefix(stored, secretPrefix) {
+			if plain, err = openSecret(stored); err != nil {
+				return fmt.Errorf("%s(%d): %w", table, id, err)
+			}
+		}
+		sealed, err := sealSecret(plain)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET %s = ? WHERE id = ?`, table, column), sealed, id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(stale) > 0 {
+		log.Printf("[secrets] 已用当前密钥重新加密 %s.%s 中的 %d 条记录", table, column, len(stale))
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import "regexp"
+
+// ─────────────────────────────────────────
+// 账单解析器注册表
+//
+// 各银行账单措辞和排版不同，一套全局正则难以兼顾。extractBillFields 按 detectBank 的结果
+// 查找该银行注册的解析器，没有注册的银行用 genericParser。
+// 银行解析器先跑通用规则，再用自己的正则覆盖匹配到的字段，所以只需描述与通用规则不同的部分。
+// 每个解析器在 testdata/statements/<Name()>/ 下有脱敏样例邮件和 golden 结果，
+// 修改正则后运行 go test -run TestStatementParsers -update 重新生成并检查差异。
+// ─────────────────────────────────────────
+
+// StatementParser 从账单邮件中提取字段
+type StatementParser interface {
+	// Name 解析器名称，同时是测试语料的目录名
+	Name() string
+	// Parse 读取 pb.body / pb.subject，把提取到的字段写回 pb
+	Parse(pb *parsedBill)
+}
+
+// statementParsers 银行名称 → 解析器
+var statementParsers = map[string]StatementParser{}
+
+// registerStatementParser 为银行注册解析器（同一银行后注册的覆盖先注册的）
+func registerStatementParser(bank string, p StatementParser) {
+	statementParsers[bank] = p
+}
+
+// statementParserFor 查找银行的解析器，未注册时返回通用解析器
+func statementParserFor(bank string) StatementParser {
+	if p, ok := statementParsers[bank]; ok {
+		return p
+	}
+	return genericParser{}
+}
+
+// ─────────────────────────────────────────
+// 银行专用解析器
+// ─────────────────────────────────────────
+
+// fieldRegexes 各字段的定制正则，未设置或不匹配的字段保留原值。
+// 每个正则的第一个分组是字段值。
+type fieldRegexes struct {
+	amount   *regexp.Regexp
+	minPay   *regexp.Regexp
+	billDate *regexp.Regexp
+	dueDate  *regexp.Regexp
+	lastFour *regexp.Regexp
+}
+
+// apply 用匹配到的字段覆盖 pb 中已有的结果
+func (p fieldRegexes) apply(pb *parsedBill) {
+	text := pb.body
+	if v := firstGroup(p.amount, text); v != "" {
+		pb.amount = parseAmount(v)
+	}
+	if v := firstGroup(p.minPay, text); v != "" {
+		pb.minPayment = parseAmount(v)
+	}
+	if v := firstGroup(p.billDate, text); v != "" {
+		pb.billDate = normalizeDate(v)
+	}
+	if v := firstGroup(p.dueDate, text); v != "" {
+		pb.dueDate = normalizeDate(v)
+	}
+	if v := firstGroup(p.lastFour, text); v != "" && pb.fullCardNumber == "" {
+		pb.lastFourFromMsg = v
+	}
+}
+
+// bankParser 按银行措辞定制的解析器：先跑通用规则，再用 fieldRegexes 覆盖
+type bankParser struct {
+	name string
+	fieldRegexes
+}
+
+func (p bankParser) Name() string { return p.name }
+
+func (p bankParser) Parse(pb *parsedBill) {
+	genericParser{}.Parse(pb)
+	p.apply(pb)
+}
+
+// firstGroup 返回第一个分组的匹配结果（re 为空或不匹配时返回空串）
+func firstGroup(re *regexp.Regexp, s string) string {
+	if re == nil {
+		return ""
+	}
+	if m := re.FindStringSubmatch(s); len(m) > 1 {
+		return m[1]
+	}
+	return ""
+}
+
+// 日期片段：2024-05-08 / 2024/05/08 / 2024年5月8日
+const reDatePart = `(\d{4}[-/年]\d{1,2}[-/月]\d{1,2})`
+
+func init() {
+	// 招商银行：正文开头有“本期账单周期”，通用的“本期账单”会把周期里的年份当成金额；
+	// 账单日只以账单周期的结束日出现
+	registerStatementParser("招商银行", bankParser{name: "cmb", fieldRegexes: fieldRegexes{
+		amount:   regexp.MustCompile(`本期应还金额[^\d]*?([0-9,]+\.\d{2})`),
+		billDate: regexp.MustCompile(`账单周期[：:\s]*\d{4}/\d{1,2}/\d{1,2}\s*[-—~至]\s*` + reDatePart),
+	}})
+
+	// 工商银行：账单日同样只出现在账单周期中，周期用“—”连接中文日期
+	registerStatementParser("工商银行", bankParser{name: "icbc", fieldRegexes: fieldRegexes{
+		billDate: regexp.MustCompile(`账单周期[：:\s]*\d{4}年\d{1,2}月\d{1,2}日\s*[-—~至]\s*` + reDatePart),
+	}})
+
+	// 中信银行：金额是表格，表头“本期应还款金额 最低还款金额”在上一行，数值在下一行，
+	// 通用规则会把应还金额当成最低还款额
+	registerStatementParser("中信银行", bankParser{name: "citic", fieldRegexes: fieldRegexes{
+		minPay: regexp.MustCompile(`本期应还款金额\s+最低还款金额\s+[0-9,]+\.\d{2}\s+([0-9,]+\.\d{2})`),
+	}})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/mail"
+)
+
+var updateGolden = flag.Bool("update", false, "用当前解析结果重写 golden 文件")
+
+// goldenBill golden 文件中记录的解析结果
+type goldenBill struct {
+	Parser     string  `json:"parser"`
+	Bank       string  `json:"bank"`
+	LastFour   string  `json:"lastFour"`
+	HolderName string  `json:"holderName"`
+	Amount     float64 `json:"amount"`
+	Currency   string  `json:"currency"`
+	MinPayment float64 `json:"minPayment"`
+	BillDate   string  `json:"billDate"`
+	DueDate    string  `json:"dueDate"`
+
+	Amounts      []BillAmount        `json:"amounts,omitempty"` // 只记录多币种账单
+	Transactions []goldenTransaction `json:"transactions,omitempty"`
+	Repayment    *goldenRepayment    `json:"repayment,omitempty"` // 还款到账通知
+}
+
+type goldenRepayment struct {
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+	PaidAt   string  `json:"paidAt"`
+}
+
+type goldenTransaction struct {
+	TransDate string  `json:"transDate"`
+	PostDate  string  `json:"postDate"`
+	Merchant  string  `json:"merchant"`
+	Amount    float64 `json:"amount"`
+	Currency  string  `json:"currency"`
+	LastFour  string  `json:"lastFour"`
+}
+
+// TestStatementParsers 逐个解析 testdata/statements/<解析器>/*.eml，与同名 .golden.json 比较
+func TestStatementParsers(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "statements", "*", "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("没有找到样例邮件")
+	}
+
+	for _, path := range files {
+		name := filepath.Base(filepath.Dir(path)) + "/" + filepath.Base(path)
+		t.Run(name, func(t *testing.T) {
+			pb := parseEmailFile(t, path)
+
+			// 语料按解析器分目录，先确认走的是对应的解析器
+			parser := statementParserFor(pb.bank).Name()
+			if want := filepath.Base(filepath.Dir(path)); parser != want {
+				t.Fatalf("银行 %q 使用了解析器 %s，样例目录是 %s", pb.bank, parser, want)
+			}
+
+			var txns []goldenTransaction
+			for _, tx := range pb.transactions {
+				txns = append(txns, goldenTransaction{
+					TransDate: tx.TransDate,
+					PostDate:  tx.PostDate,
+					Merchant:  tx.Merchant,
+					Amount:    tx.Amount,
+					Currency:  tx.Currency,
+					LastFour:  tx.LastFour,
+				})
+			}
+
+			var amounts []BillAmount
+			if len(pb.amounts) > 1 {
+				amounts = pb.amounts
+			}
+
+			var repayment *goldenRepayment
+			if n := pb.repayment; n != nil {
+				repayment = &goldenRepayment{Amount: n.amount, Currency: n.currency, PaidAt: n.paidAt}
+			}
+
+			got, _ := json.MarshalIndent(goldenBill{
+				Parser:     parser,
+				Bank:       pb.bank,
+				LastFour:   pb.lastFourFromMsg,
+				HolderName: pb.holderName,
+				Amount:     pb.amount,
+				Currency:   pb.currency,
+				MinPayment: pb.minPayment,
+				BillDate:   pb.billDate,
+				DueDate:    pb.dueDate,
+
+				Amounts:      amounts,
+				Transactions: txns,
+				Repayment:    repayment,
+			}, "", "  ")
+			got = append(got, '\n')
+
+			goldenPath := strings.TrimSuffix(path, ".eml") + ".golden.json"
+			if *updateGolden {
+				if err := os.WriteFile(goldenPath, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("读取 golden 文件失败（可用 -update 生成）: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("解析结果与 %s 不一致\n得到:\n%s\n期望:\n%s", goldenPath, got, want)
+			}
+		})
+	}
+}
+
+// parseEmailFile 按 IMAP 拉取时的流程解析一封 .eml
+func parseEmailFile(t *testing.T, path string) *parsedBill {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr, err := mail.CreateReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb := &parsedBill{}
+	pb.subject, _ = mr.Header.Subject()
+	pb.date, _ = mr.Header.Date()
+	if from, err := mr.Header.AddressList("From"); err == nil && len(from) > 0 {
+		pb.from = from[0].Address
+	}
+
+	if err := readMailBody(pb, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	extractMailFields(pb)
+	return pb
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ─────────────────────────────────────────
+// 同步游标
+//
+// 每次写入卡片都会在 card_changes 中追加一条自增 revision 记录（同一张卡只保留最新一条）。
+// /sync 返回的 cursor 即本次已下发的最大 revision，客户端下次原样带回，
+// 服务器只返回 revision 更大的卡片。SQLite 写操作是串行提交的，revision 顺序即提交顺序，
+// 因此每次变更都恰好下发一次，不受客户端时钟影响。
+// ─────────────────────────────────────────
+
+const cursorPrefix = "r1:"
+
+// execer 同时兼容 *sql.DB 和 *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// rowQuerier 同时兼容 *sql.DB 和 *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// recordCardChange 为卡片分配新的 revision（须与卡片写入在同一事务中调用）
+func recordCardChange(ex execer, syncID string) error {
+	if _, err := ex.Exec(`DELETE FROM card_changes WHERE sync_id = ?`, syncID); err != nil {
+		return err
+	}
+	_, err := ex.Exec(`INSERT INTO card_changes (sync_id, changed_at) VALUES (?, ?)`, syncID, time.Now().Unix())
+	return err
+}
+
+// getCardsAfterRevision 返回 revision 之后变更过的卡片，以及新的游标
+func getCardsAfterRevision(userID string, since int64) ([]Card, string, error) {
+	// 在同一个读事务里取最大 revision 和卡片，避免两次查询之间有新写入
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	head, err := headRevision(tx, userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if head < since {
+		// 游标来自其他库（如恢复了旧备份），从头全量下发
+		since = 0
+	}
+
+	rows, err := tx.Query(`
+		SELECT c.id, c.sync_id, c.name, c.bank, c.card_number, c.cvv, c.expiry_date,
+		       c.cardholder_name, c.credit_limit, c.billing_day, c.payment_due_day,
+		       c.color, c.card_front_image_hash, c.card_back_image_hash, c.notes, c.iv, c.owner, c.last_four,
+		       c.is_deleted, c.created_at, c.updated_at, c.version
+		FROM cards c JOIN card_changes ch ON ch.sync_id = c.sync_id
+		WHERE c.user_id = ? AND ch.revision > ? AND ch.revision <= ?
+		ORDER BY ch.revision
+	`, userID, since, head)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	cards := []Card{}
+	for rows.Next() {
+		var card Card
+		var isDeleted int
+		err := rows.Scan(
+			&card.ID, &card.SyncID, &card.Name, &card.Bank,
+			&card.CardNumber, &card.CVV, &card.ExpiryDate,
+			&card.CardholderName, &card.CreditLimit, &card.BillingDay,
+			&card.PaymentDueDay, &card.Color, &card.CardFrontImageHash,
+			&card.CardBackImageHash, &card.Notes, &card.IV, &card.Owner, &card.LastFour,
+			&isDeleted, &card.CreatedAt, &card.UpdatedAt, &card.Version,
+		)
+		if err != nil {
+			return nil, "", err
+		}
+		card.IsDeleted = isDeleted == 1
+		cards = append(cards, card)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return cards, encodeCursor(head), nil
+}
+
+// headRevision 用户卡片当前的最大 revision
+func headRevision(q rowQuerier, userID string) (int64, error) {
+	var head int64
+	err := q.QueryRow(`
+		SELECT COALESCE(MAX(ch.revision), 0)
+		FROM card_changes ch JOIN cards c ON c.sync_id = ch.sync_id
+		WHERE c.user_id = ?
+	`, userID).Scan(&head)
+	return head, err
+}
+
+func encodeCursor(revision int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + strconv.FormatInt(revision, 10)))
+}
+
+// decodeCursor 空游标表示从头同步
+func decodeCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(raw), cursorPrefix) {
+		return 0, fmt.Errorf("无效的同步游标")
+	}
+	rev, err := strconv.ParseInt(strings.TrimPrefix(string(raw), cursorPrefix), 10, 64)
+	if err != nil || rev < 0 {
+		return 0, fmt.Errorf("无效的同步游标")
+	}
+	return rev, nil
+}
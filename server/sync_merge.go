@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ─────────────────────────────────────────
+// 字段级合并
+//
+// 每张卡片维护一个行版本号 version，以及每个字段（组）最后一次被修改时的版本号
+// field_versions。客户端提交时带上它上次看到的 baseVersion：
+//   - 服务器字段版本 <= baseVersion：该字段在客户端看到之后没被别人改过，直接采纳客户端的值
+//   - 服务器字段版本 >  baseVersion：双方都改了同一字段，保留服务器值并在 conflicts 中报告
+// 客户端可以额外提供 changedFields，只提交真正改过的字段，避免把未修改的旧值误报为冲突。
+// 不带 baseVersion 的旧客户端仍按整行 updated_at 比较（后写覆盖）。
+// 卡片的 id 由服务器分配（客户端的本地自增 id 在各账号之间会重复），客户端以 syncId 识别卡片。
+// ─────────────────────────────────────────
+
+// errCardNotOwned syncId 已属于其他账号的卡片
+var errCardNotOwned = errors.New("syncId 已被其他账号的卡片使用")
+
+// SyncConflict 同步冲突：客户端与服务器在同一字段上都有修改，需要客户端决定
+type SyncConflict struct {
+	SyncID string   `json:"syncId"`
+	Fields []string `json:"fields"` // 冲突的字段（组）名
+	Server Card     `json:"server"` // 合并后的服务器版本
+}
+
+// mergeField 可独立合并的字段（组）
+type mergeField struct {
+	name  string
+	equal func(a, b *Card) bool
+	take  func(dst, src *Card)
+}
+
+// 加密字段共用同一个 iv，必须作为一个整体合并，否则无法解密
+var mergeFields = []mergeField{
+	strField("name", func(c *Card) *string { return &c.Name }),
+	strField("bank", func(c *Card) *string { return &c.Bank }),
+	strField("expiryDate", func(c *Card) *string { return &c.ExpiryDate }),
+	strField("cardholderName", func(c *Card) *string { return &c.CardholderName }),
+	{
+		name:  "creditLimit",
+		equal: func(a, b *Card) bool { return a.CreditLimit == b.CreditLimit },
+		take:  func(dst, src *Card) { dst.CreditLimit = src.CreditLimit },
+	},
+	{
+		name:  "billingDay",
+		equal: func(a, b *Card) bool { return a.BillingDay == b.BillingDay },
+		take:  func(dst, src *Card) { dst.BillingDay = src.BillingDay },
+	},
+	{
+		name:  "paymentDueDay",
+		equal: func(a, b *Card) bool { return a.PaymentDueDay == b.PaymentDueDay },
+		take:  func(dst, src *Card) { dst.PaymentDueDay = src.PaymentDueDay },
+	},
+	strField("color", func(c *Card) *string { return &c.Color }),
+	strField("notes", func(c *Card) *string { return &c.Notes }),
+	strField("owner", func(c *Card) *string { return &c.Owner }),
+	strField("lastFour", func(c *Card) *string { return &c.LastFour }),
+	{
+		name: "encrypted",
+		equal: func(a, b *Card) bool {
+			return a.CardNumber == b.CardNumber && a.CVV == b.CVV && a.IV == b.IV &&
+				a.CardFrontImageHash == b.CardFrontImageHash && a.CardBackImageHash == b.CardBackImageHash
+		},
+		take: func(dst, src *Card) {
+			dst.CardNumber, dst.CVV, dst.IV = src.CardNumber, src.CVV, src.IV
+			dst.CardFrontImageHash, dst.CardBackImageHash = src.CardFrontImageHash, src.CardBackImageHash
+		},
+	},
+	{
+		name:  "isDeleted",
+		equal: func(a, b *Card) bool { return a.IsDeleted == b.IsDeleted },
+		take:  func(dst, src *Card) { dst.IsDeleted = src.IsDeleted },
+	},
+}
+
+func strField(name string, p func(*Card) *string) mergeField {
+	return mergeField{
+		name:  name,
+		equal: func(a, b *Card) bool { return *p(a) == *p(b) },
+		take:  func(dst, src *Card) { *p(dst) = *p(src) },
+	}
+}
+
+// mergeCard 将客户端提交的卡片合并进数据库，返回需要客户端处理的冲突（无冲突时为 nil）
+func mergeCard(userID string, incoming Card) (*SyncConflict, error) {
+	// 旧客户端内嵌的图片先转存为 blob，之后只按哈希比较
+	if err := storeInlineImages(db, userID, &incoming); err != nil {
+		return nil, err
+	}
+	if err := checkCardBlobs(userID, &incoming); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	existing, owner, fieldVersions, err := loadCardForMerge(tx, incoming.SyncID)
+	if err == sql.ErrNoRows {
+		if err := insertCardTx(tx, userID, incoming); err != nil {
+			return nil, err
+		}
+		if err := recordCardChange(tx, incoming.SyncID); err != nil {
+			return nil, err
+		}
+		return nil, tx.Commit()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 不允许覆盖其他用户的卡片
+	if owner != userID {
+		return nil, errCardNotOwned
+	}
+
+	merged := existing
+	newVersion := existing.Version + 1
+	var applied, conflicts []string
+
+	legacy := incoming.BaseVersion == 0
+	if legacy && incoming.UpdatedAt <= existing.UpdatedAt {
+		return nil, nil
+	}
+
+	for _, f := range mergeFields {
+		if f.equal(&existing, &incoming) {
+			continue
+		}
+		if !legacy && len(incoming.ChangedFields) > 0 && !containsString(incoming.ChangedFields, f.name) {
+			continue
+		}
+		if !legacy && fieldVersions[f.name] > incoming.BaseVersion {
+			conflicts = append(conflicts, f.name)
+			continue
+		}
+		f.take(&merged, &incoming)
+		fieldVersions[f.name] = newVersion
+		applied = append(applied, f.name)
+	}
+
+	if len(applied) > 0 {
+		merged.Version = newVersion
+		if legacy {
+			merged.UpdatedAt = incoming.UpdatedAt
+		} else {
+			// 使用服务器时间，避免客户端时钟偏差导致其他设备漏拉
+			merged.UpdatedAt = time.Now().Unix()
+		}
+		if err := updateCardTx(tx, merged, fieldVersions); err != nil {
+			return nil, err
+		}
+		if err := recordCardChange(tx, merged.SyncID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if len(conflicts) == 0 {
+		return nil, nil
+	}
+	return &SyncConflict{SyncID: merged.SyncID, Fields: conflicts, Server: merged}, nil
+}
+
+func loadCardForMerge(tx *sql.Tx, syncID string) (Card, string, map[string]int64, error) {
+	var card Card
+	var userID, fieldVersionsJSON string
+	var isDeleted int
+	err := tx.QueryRow(`
+		SELECT id, sync_id, name, bank, card_number, cvv, expiry_date,
+		       cardholder_name, credit_limit, billing_day, payment_due_day,
+		       color, card_front_image_hash, card_back_image_hash, notes, iv, owner, last_four,
+		       is_deleted, created_at, updated_at, version, field_versions, user_id
+		FROM cards WHERE sync_id = ?
+	`, syncID).Scan(
+		&card.ID, &card.SyncID, &card.Name, &card.Bank,
+		&card.CardNumber, &card.CVV, &card.ExpiryDate,
+		&card.CardholderName, &card.CreditLimit, &card.BillingDay,
+		&card.PaymentDueDay, &card.Color, &card.CardFrontImageHash,
+		&card.CardBackImageHash, &card.Notes, &card.IV, &card.Owner, &card.LastFour,
+		&isDeleted, &card.CreatedAt, &card.UpdatedAt, &card.Version, &fieldVersionsJSON, &userID,
+	)
+	if err != nil {
+		return card, "", nil, err
+	}
+	card.IsDeleted = isDeleted == 1
+
+	fieldVersions := map[string]int64{}
+	if fieldVersionsJSON != "" {
+		_ = json.Unmarshal([]byte(fieldVersionsJSON), &fieldVersions)
+	}
+	return card, userID, fieldVersions, nil
+}
+
+func insertCardTx(tx *sql.Tx, userID string, card Card) error {
+	fieldVersions := map[string]int64{}
+	for _, f := range mergeFields {
+		fieldVersions[f.name] = 1
+	}
+	fv, _ := json.Marshal(fieldVersions)
+
+	// id 取现有数字 id 的最大值 + 1，忽略客户端传来的 id
+	_, err := tx.Exec(`
+		INSERT INTO cards (
+			id, sync_id, name, bank, card_number, cvv, expiry_date,
+			cardholder_name, credit_limit, billing_day, payment_due_day,
+			color, card_front_image_hash, card_back_image_hash, notes, iv, owner, last_four,
+			user_id, is_deleted, created_at, updated_at, version, field_versions
+		) VALUES (
+			(SELECT CAST(COALESCE(MAX(CAST(id AS INTEGER)), 0) + 1 AS TEXT) FROM cards),
+			?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1, ?
+		)
+	`,
+		card.SyncID, card.Name, card.Bank, card.CardNumber,
+		card.CVV, card.ExpiryDate, card.CardholderName, card.CreditLimit,
+		card.BillingDay, card.PaymentDueDay, card.Color, card.CardFrontImageHash,
+		card.CardBackImageHash, card.Notes, card.IV, card.Owner, card.LastFour,
+		userID, boolToInt(card.IsDeleted), card.CreatedAt, card.UpdatedAt, string(fv),
+	)
+	return err
+}
+
+// cardIDBySyncID 服务器分配给卡片的 id
+func cardIDBySyncID(userID, syncID string) (json.Number, error) {
+	var id string
+	err := db.QueryRow(`SELECT id FROM cards WHERE sync_id = ? AND user_id = ?`, syncID, userID).Scan(&id)
+	return json.Number(id), err
+}
+
+func updateCardTx(tx *sql.Tx, card Card, fieldVersions map[string]int64) error {
+	fv, _ := json.Marshal(fieldVersions)
+	_, err := tx.Exec(`
+		UPDATE cards SET
+			name = ?, bank = ?, card_number = ?, cvv = ?, expiry_date = ?,
+			cardholder_name = ?, credit_limit = ?, billing_day = ?, payment_due_day = ?,
+			color = ?, card_front_image_hash = ?, card_back_image_hash = ?, notes = ?, iv = ?,
+			owner = ?, last_four = ?, is_deleted = ?, updated_at = ?,
+			version = ?, field_versions = ?
+		WHERE sync_id = ?
+	`,
+		card.Name, card.Bank, card.CardNumber, card.CVV, card.ExpiryDate,
+		card.CardholderName, card.CreditLimit, card.BillingDay, card.PaymentDueDay,
+		card.Color, card.CardFrontImageHash, card.CardBackImageHash, card.Notes, card.IV,
+		card.Owner, card.LastFour, boolToInt(card.IsDeleted), card.UpdatedAt,
+		card.Version, string(fv), card.SyncID,
+	)
+	return err
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
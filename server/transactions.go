@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ─────────────────────────────────────────
+// 账单交易明细
+//
+// 账单邮件里通常附有本期每一笔交易。genericParser 在提取汇总字段的同时提取明细：
+// HTML 账单优先读带“交易日/金额”表头的表格，没有这样的表格时逐行匹配正文
+// （纯文本账单和 PDF 文字层都是一笔一行）。明细与账单一起入库，同一封邮件重新拉取时按本次解析结果整体替换。
+// 只有月/日的交易日期按账单日推算年份（月份大于账单月的属于上一年）。
+// ─────────────────────────────────────────
+
+// BillTransaction 账单中的一笔交易
+type BillTransaction struct {
+	ID        int64   `json:"id"`
+	BillID    int64   `json:"billId"`
+	TransDate string  `json:"transDate"` // 交易日 YYYY-MM-DD
+	PostDate  string  `json:"postDate"`  // 记账日 YYYY-MM-DD（账单未列出时为空）
+	Merchant  string  `json:"merchant"`  // 商户/交易摘要
+	Amount    float64 `json:"amount"`    // 消费为正，退款和还款为负
+	Currency  string  `json:"currency"`
+	LastFour  string  `json:"lastFour"` // 交易卡号尾号（账单未列出时为空）
+	Category  string  `json:"category"` // 消费分类代码（读取时按规则计算，见 categories.go）
+}
+
+// 明细表格各列的表头，按优先级排列
+var (
+	txnDateLabels     = []string{"交易日期", "交易日"}
+	txnPostLabels     = []string{"记账日期", "记账日", "入账日期", "入账日"}
+	txnMerchantLabels = []string{"交易摘要", "交易描述", "交易说明", "商户名称", "商户", "摘要", "描述"}
+	txnAmountLabels   = []string{"交易金额", "金额", "入账金额", "人民币金额", "清算金额"}
+	txnCurrencyLabels = []string{"交易币种", "币种", "货币"}
+	txnCardLabels     = []string{"卡号末四位", "卡号后四位", "卡号末4位", "卡号后4位", "末四位", "卡号"}
+)
+
+const (
+	reTxnDatePart   = `\d{4}[-/.]\d{1,2}[-/.]\d{1,2}|\d{1,2}[-/]\d{1,2}`
+	reTxnAmountPart = `[-－]?[0-9][0-9,]*\.\d{2}`
+	reCurrencyPart  = `CNY|RMB|USD|HKD|EUR|GBP|JPY|MOP|TWD|SGD|AUD|CAD`
+)
+
+var (
+	// 正文中的一笔交易：交易日 [记账日] 摘要 [币种] 金额 [币种] [卡号尾号]
+	reTxnLine = regexp.MustCompile(`^(` + reTxnDatePart + `)\s+(?:(` + reTxnDatePart + `)\s+)?(.+?)\s+` +
+		`(?:(` + reCurrencyPart + `)\s*)?(` + reTxnAmountPart + `)(?:\s*(` + reCurrencyPart + `))?(?:\s+(\d{4}))?$`)
+	reTxnDate     = regexp.MustCompile(`^(?:` + reTxnDatePart + `)$`)
+	reTxnAmount   = regexp.MustCompile(`(` + reTxnAmountPart + `)`)
+	reTxnCurrency = regexp.MustCompile(`(` + reCurrencyPart + `)`)
+	reTxnLastFour = regexp.MustCompile(`(\d{4})\s*$`)
+)
+
+// ─────────────────────────────────────────
+// 提取
+// ─────────────────────────────────────────
+
+// extractTransactions 从表格或正文中提取交易明细（重复解析时覆盖上一次的结果）
+func extractTransactions(pb *parsedBill) {
+	pb.transactions = nil
+	for _, t := range pb.tables {
+		pb.transactions = append(pb.transactions, tableTransactions(t, pb.billDate)...)
+	}
+	if len(pb.transactions) > 0 {
+		return
+	}
+	for _, line := range strings.Split(pb.body, "\n") {
+		m := reTxnLine.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		currency := m[4]
+		if currency == "" {
+			currency = m[6]
+		}
+		pb.transactions = append(pb.transactions, BillTransaction{
+			TransDate: resolveTxnDate(m[1], pb.billDate),
+			PostDate:  resolveTxnDate(m[2], pb.billDate),
+			Merchant:  strings.TrimSpace(m[3]),
+			Amount:    parseTxnAmount(m[5]),
+			Currency:  normalizeCurrency(currency),
+			LastFour:  m[7],
+		})
+	}
+}
+
+// tableTransactions 按表头定位各列，读取表头之后的每一行；日期或金额读不出的行（小计等）跳过
+func tableTransactions(t htmlTable, billDate string) []BillTransaction {
+	for h, header := range t.rows {
+		dateCol := headerColumn(header, txnDateLabels)
+		amountCol := headerColumn(header, txnAmountLabels)
+		if dateCol < 0 || amountCol < 0 {
+			continue
+		}
+		postCol := headerColumn(header, txnPostLabels)
+		merchantCol := headerColumn(header, txnMerchantLabels)
+		currencyCol := headerColumn(header, txnCurrencyLabels)
+		cardCol := headerColumn(header, txnCardLabels)
+
+		var txns []BillTransaction
+		for _, row := range t.rows[h+1:] {
+			date := cellAt(row, dateCol)
+			amount := firstGroup(reTxnAmount, cellAt(row, amountCol))
+			if !reTxnDate.MatchString(date) || amount == "" {
+				continue
+			}
+			currency := firstGroup(reTxnCurrency, cellAt(row, currencyCol))
+			if currency == "" {
+				currency = firstGroup(reTxnCurrency, cellAt(row, amountCol))
+			}
+			txns = append(txns, BillTransaction{
+				TransDate: resolveTxnDate(date, billDate),
+				PostDate:  resolveTxnDate(cellAt(row, postCol), billDate),
+				Merchant:  cellAt(row, merchantCol),
+				Amount:    parseTxnAmount(amount),
+				Currency:  normalizeCurrency(currency),
+				LastFour:  firstGroup(reTxnLastFour, cellAt(row, cardCol)),
+			})
+		}
+		return txns
+	}
+	return nil
+}
+
+// headerColumn 返回表头中以 labels 之一开头的单元格所在列，找不到时返回 -1
+func headerColumn(header []htmlCell, labels []string) int {
+	for _, label := range labels {
+		for _, cell := range header {
+			if strings.HasPrefix(cell.text, label) {
+				return cell.col
+			}
+		}
+	}
+	return -1
+}
+
+// cellAt 返回覆盖第 col 列的单元格文字
+func cellAt(row []htmlCell, col int) string {
+	if col < 0 {
+		return ""
+	}
+	for _, cell := range row {
+		if cell.col <= col && col < cell.col+cell.span {
+			return cell.text
+		}
+	}
+	return ""
+}
+
+// resolveTxnDate 统一为 YYYY-MM-DD；只有月/日时按账单日推算年份
+func resolveTxnDate(s, billDate string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return ""
+	}
+	parts := strings.FieldsFunc(s, func(r rune) bool { return r == '-' || r == '/' || r == '.' })
+	if len(parts) == 3 {
+		return normalizeDate(strings.Join(parts, "-"))
+	}
+	if len(parts) != 2 {
+		return ""
+	}
+	month, err1 := strconv.Atoi(parts[0])
+	day, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return ""
+	}
+
+	ref, err := time.Parse("2006-01-02", billDate)
+	if err != nil {
+		ref = time.Now()
+	}
+	year := ref.Year()
+	if time.Month(month) > ref.Month() {
+		year--
+	}
+	return fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+}
+
+func parseTxnAmount(s string) float64 {
+	s = strings.ReplaceAll(s, "－", "-")
+	if rest, ok := strings.CutPrefix(s, "-"); ok {
+		return -parseAmount(rest)
+	}
+	return parseAmount(s)
+}
+
+// normalizeCurrency 统一币种代码，未标明时为人民币
+func normalizeCurrency(s string) string {
+	switch s = strings.ToUpper(strings.TrimSpace(s)); s {
+	case "", "RMB":
+		return "CNY"
+	}
+	return s
+}
+
+// ─────────────────────────────────────────
+// 存储
+// ─────────────────────────────────────────
+
+// saveBillTransactions 写入一张账单的明细
+func saveBillTransactions(tx *sql.Tx, userID string, billID int64, txns []BillTransaction) error {
+	for _, t := range txns {
+		_, err := tx.Exec(`
+			INSERT INTO bill_transactions (bill_id, user_id, trans_date, post_date, merchant, amount, currency, last_four)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			billID, userID, t.TransDate, t.PostDate, t.Merchant, t.Amount, t.Currency, t.LastFour)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ─────────────────────────────────────────
+// HTTP Handler：GET /api/v1/bills/:id/transactions
+// ─────────────────────────────────────────
+
+func handleGetBillTransactions(c *gin.Context) {
+	userID := currentUserID(c)
+
+	var billID int64
+	var cardSyncID string
+	err := db.QueryRow(`SELECT id, card_sync_id FROM bill_statements WHERE id = ? AND user_id = ?`,
+		c.Param("id"), userID).Scan(&billID, &cardSyncID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "账单不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	cat, err := loadCategorizer(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, bill_id, trans_date, post_date, merchant, amount, currency, last_four
+		FROM bill_transactions
+		WHERE bill_id = ? AND user_id = ?
+		ORDER BY trans_date, id
+	`, billID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	txns := []BillTransaction{}
+	for rows.Next() {
+		var t BillTransaction
+		err := rows.Scan(&t.ID, &t.BillID, &t.TransDate, &t.PostDate, &t.Merchant, &t.Amount, &t.Currency, &t.LastFour)
+		if err != nil {
+			log.Printf("[bills] Scan失败: %v", err)
+			continue
+		}
+		t.Category = cat.classify(t.Merchant)
+		txns = append(txns, t)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"billId":       billID,
+			"cardSyncId":   cardSyncID,
+			"transactions": txns,
+		},
+		"timestamp": time.Now().Unix(),
+	})
+}
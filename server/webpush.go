@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// ─────────────────────────────────────────
+// Web Push 协议
+//
+// 服务器身份用 VAPID（RFC 8292）：一把 P-256 密钥，私钥（32 字节，base64url）优先读环境变量
+// VAPID_PRIVATE_KEY，其次读 DATA_DIR/vapid_private.key，都没有时自动生成并写入该文件。
+// 前端用公钥（GET /api/v1/push/vapid-public-key）订阅，换了密钥之后旧订阅全部失效，需要重新订阅。
+// VAPID_SUBJECT 为联系方式（mailto: 或 https: 地址），未设置时取 mailto:SMTP_FROM，两者都没有时启动时给出警告。
+//
+// 消息体按 RFC 8291 用 aes128gcm（RFC 8188）加密：服务器每次生成临时 ECDH 密钥，
+// 与浏览器订阅中的 p256dh 公钥协商，再结合订阅的 auth 密钥派生内容密钥，整条消息放在一个记录里。
+// ─────────────────────────────────────────
+
+const (
+	vapidKeyFileName = "vapid_private.key"
+
+	// 推送服务接受的消息体上限为 4096 字节，扣除头部（86）、填充分隔符（1）和 GCM 标签（16）
+	maxPushPayload = 4096 - 86 - 1 - 16
+	// 推送服务暂存离线消息的时长（秒）
+	pushTTL = 24 * 60 * 60
+)
+
+var errPushDisabled = errors.New("服务端 Web Push 未启用（VAPID 密钥不可用）")
+
+// vapidKey 服务器的 VAPID 密钥，为空表示未启用 Web Push
+var vapidKey *ecdsa.PrivateKey
+
+// initVAPIDKeys 加载或生成 VAPID 密钥（由 initDB 调用）
+func initVAPIDKeys() {
+	raw := strings.TrimSpace(os.Getenv("VAPID_PRIVATE_KEY"))
+	path := filepath.Join(dataDir, vapidKeyFileName)
+	if raw == "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("[webpush] 读取 VAPID 密钥失败，Web Push 已停用: %v", err)
+			return
+		}
+		raw = strings.TrimSpace(string(data))
+	}
+
+	if raw == "" {
+		priv, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			log.Printf("[webpush] 生成 VAPID 密钥失败，Web Push 已停用: %v", err)
+			return
+		}
+		raw = base64.RawURLEncoding.EncodeToString(priv.Bytes())
+		if err := os.WriteFile(path, []byte(raw+"\n"), 0600); err != nil {
+			log.Printf("[webpush] 保存 VAPID 密钥失败，Web Push 已停用: %v", err)
+			return
+		}
+		log.Printf("[webpush] 已生成 VAPID 密钥: %s", path)
+	}
+
+	key, err := parseVAPIDKey(raw)
+	if err != nil {
+		log.Fatal("VAPID 密钥无效:", err)
+	}
+	vapidKey = key
+	if vapidSubject() == "" {
+		log.Printf("[webpush] 未设置 VAPID_SUBJECT（或 SMTP_FROM），Apple 等推送服务会拒绝不带联系方式的推送")
+	}
+}
+
+// parseVAPIDKey 由 base64url 编码的私钥标量构造签名密钥
+func parseVAPIDKey(raw string) (*ecdsa.PrivateKey, error) {
+	d, err := decodeBase64URL(raw)
+	if err != nil {
+		return nil, fmt.Errorf("不是有效的 base64url: %w", err)
+	}
+	priv, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, err
+	}
+	pub := priv.PublicKey().Bytes() // 0x04 || X || Y
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(pub[1:33]),
+			Y:     new(big.Int).SetBytes(pub[33:65]),
+		},
+		D: new(big.Int).SetBytes(d),
+	}, nil
+}
+
+// vapidPublicKey 未压缩格式的公钥（base64url），即前端订阅时的 applicationServerKey
+func vapidPublicKey() string {
+	if vapidKey == nil {
+		return ""
+	}
+	pub := make([]byte, 65)
+	pub[0] = 4
+	vapidKey.X.FillBytes(pub[1:33])
+	vapidKey.Y.FillBytes(pub[33:65])
+	return base64.RawURLEncoding.EncodeToString(pub)
+}
+
+func vapidSubject() string {
+	if s := strings.TrimSpace(os.Getenv("VAPID_SUBJECT")); s != "" {
+		return s
+	}
+	if from := strings.TrimSpace(os.Getenv("SMTP_FROM")); from != "" {
+		return "mailto:" + from
+	}
+	return ""
+}
+
+// vapidAuthorization 生成推送请求的 Authorization 头：ES256 签名的 JWT，aud 为推送服务的源
+func vapidAuthorization(endpoint string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	claims := map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(12 * time.Hour).Unix(),
+	}
+	if sub := vapidSubject(); sub != "" {
+		claims["sub"] = sub
+	}
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, vapidKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	jwt := unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+	return "vapid t=" + jwt + ", k=" + vapidPublicKey(), nil
+}
+
+// ─────────────────────────────────────────
+// 消息加密（RFC 8291）
+// ─────────────────────────────────────────
+
+// encryptPushPayload 用订阅的 p256dh 公钥和 auth 密钥加密消息，返回 aes128gcm 格式的请求体
+func encryptPushPayload(p256dh, authSecret, payload []byte) ([]byte, error) {
+	asPriv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encryptPushPayloadWith(asPriv, salt, p256dh, authSecret, payload)
+}
+
+func encryptPushPayloadWith(asPriv *ecdh.PrivateKey, salt, p256dh, authSecret, payload []byte) ([]byte, error) {
+	if len(payload) > maxPushPayload {
+		return nil, fmt.Errorf("推送内容过长（%d 字节，上限 %d）", len(payload), maxPushPayload)
+	}
+	uaPub, err := ecdh.P256().NewPublicKey(p256dh)
+	if err != nil {
+		return nil, fmt.Errorf("订阅公钥无效: %w", err)
+	}
+	ecdhSecret, err := asPriv.ECDH(uaPub)
+	if err != nil {
+		return nil, err
+	}
+	asPub := asPriv.PublicKey().Bytes()
+
+	// IKM = HKDF(auth, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public)
+	keyInfo := append([]byte("WebPush: info\x00"), p256dh...)
+	keyInfo = append(keyInfo, asPub...)
+	ikm, err := hkdfBytes(ecdhSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdfBytes(ikm, salt, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdfBytes(ikm, salt, []byte("Content-Encoding: nonce\x00"), 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 唯一的记录也是最后一个记录，填充分隔符为 0x02
+	plaintext := append(append([]byte{}, payload...), 2)
+
+	// 头部：salt(16) || rs(4) || idlen(1) || keyid（服务器临时公钥）
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(4096))
+	body.WriteByte(byte(len(asPub)))
+	body.Write(asPub)
+	body.Write(gcm.Seal(nil, nonce, plaintext, nil))
+	return body.Bytes(), nil
+}
+
+// hkdfBytes HKDF-SHA256 派生 n 字节
+func hkdfBytes(secret, salt, info []byte, n int) ([]byte, error) {
+	out := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// decodeBase64URL 解码 base64url，兼容带填充和标准 base64 字母表的写法
+func decodeBase64URL(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "=")
+	s = strings.NewReplacer("+", "-", "/", "_").Replace(s)
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// ─────────────────────────────────────────
+// 发送
+// ─────────────────────────────────────────
+
+// errPushGone 订阅已失效（推送服务返回 404/410），调用方应删除该订阅
+var errPushGone = errors.New("推送订阅已失效")
+
+var pushClient = &http.Client{
+	Timeout: notifyTimeout,
+	Transport: &http.Transport{
+		DialContext:         publicDialer(),
+		TLSHandshakeTimeout: notifyTimeout,
+	},
+}
+
+// sendWebPush 向一个订阅发送加密消息
+func sendWebPush(sub PushSubscription, payload []byte) error {
+	if vapidKey == nil {
+		return errPushDisabled
+	}
+	if !isPushServiceEndpoint(sub.Endpoint) {
+		return fmt.Errorf("不支持的推送服务")
+	}
+	p256dh, err := decodeBase64URL(sub.P256dh)
+	if err != nil {
+		return fmt.Errorf("订阅公钥无效: %w", err)
+	}
+	authSecret, err := decodeBase64URL(sub.Auth)
+	if err != nil {
+		return fmt.Errorf("订阅 auth 无效: %w", err)
+	}
+	body, err := encryptPushPayload(p256dh, authSecret, payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := vapidAuthorization(sub.Endpoint, time.Now())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(pushTTL))
+	req.Header.Set("Urgency", "high")
+
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errPushGone
+	case resp.StatusCode/100 != 2:
+		// 响应内容只记日志，不返回给用户
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		log.Printf("[webpush] 推送服务返回 %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		return fmt.Errorf("推送服务返回 HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustDecodeBase64URL(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := decodeBase64URL(s)
+	if err != nil {
+		t.Fatalf("解码 %q 失败: %v", s, err)
+	}
+	return b
+}
+
+// RFC 8291 附录 A 的示例：固定服务器临时密钥和 salt 时，加密结果应与 RFC 给出的消息完全一致
+func TestEncryptPushPayloadRFC8291(t *testing.T) {
+	asPriv, err := ecdh.P256().NewPrivateKey(mustDecodeBase64URL(t, "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := mustDecodeBase64URL(t, "DGv6ra1nlYgDCS1FRnbzlw")
+	uaPublic := mustDecodeBase64URL(t, "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4")
+	authSecret := mustDecodeBase64URL(t, "BTBZMqHH6r4Tts7J_aSIgg")
+	plaintext := []byte("When I grow up, I want to be a watermelon")
+
+	got, err := encryptPushPayloadWith(asPriv, salt, uaPublic, authSecret, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if enc := base64.RawURLEncoding.EncodeToString(got); enc != want {
+		t.Errorf("加密结果\n got %s\nwant %s", enc, want)
+	}
+}
+
+func TestEncryptPushPayloadTooLarge(t *testing.T) {
+	asPriv, _ := ecdh.P256().GenerateKey(rand.Reader)
+	ua, _ := ecdh.P256().GenerateKey(rand.Reader)
+	_, err := encryptPushPayloadWith(asPriv, make([]byte, 16), ua.PublicKey().Bytes(), make([]byte, 16), make([]byte, maxPushPayload+1))
+	if err == nil {
+		t.Error("超过上限的推送内容应当报错")
+	}
+}
+
+// vapidAuthorization 生成的 JWT 应能用 k= 中的公钥验签，aud 为推送服务的源
+func TestVAPIDAuthorization(t *testing.T) {
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := parseVAPIDKey(base64.RawURLEncoding.EncodeToString(priv.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := vapidKey
+	vapidKey = key
+	defer func() { vapidKey = saved }()
+	t.Setenv("VAPID_SUBJECT", "mailto:admin@example.com")
+
+	now := time.Unix(1700000000, 0)
+	header, err := vapidAuthorization("https://fcm.googleapis.com/fcm/send/abc:def", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwt, pub, ok := strings.Cut(strings.TrimPrefix(header, "vapid t="), ", k=")
+	if !strings.HasPrefix(header, "vapid t=") || !ok {
+		t.Fatalf("Authorization 头格式不对: %s", header)
+	}
+	if pub != vapidPublicKey() {
+		t.Errorf("k = %s, want %s", pub, vapidPublicKey())
+	}
+
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("JWT 应有 3 段: %s", jwt)
+	}
+	var hdr map[string]string
+	if err := json.Unmarshal(mustDecodeBase64URL(t, parts[0]), &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr["alg"] != "ES256" || hdr["typ"] != "JWT" {
+		t.Errorf("JWT 头 = %v", hdr)
+	}
+	var claims struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(mustDecodeBase64URL(t, parts[1]), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Aud != "https://fcm.googleapis.com" {
+		t.Errorf("aud = %q", claims.Aud)
+	}
+	if claims.Exp != now.Add(12*time.Hour).Unix() {
+		t.Errorf("exp = %d", claims.Exp)
+	}
+	if claims.Sub != "mailto:admin@example.com" {
+		t.Errorf("sub = %q", claims.Sub)
+	}
+
+	// 签名为 r || s 各 32 字节，用 k= 中的未压缩公钥验证
+	raw := mustDecodeBase64URL(t, pub)
+	verifyKey := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(raw[1:33]),
+		Y:     new(big.Int).SetBytes(raw[33:65]),
+	}
+	sig := mustDecodeBase64URL(t, parts[2])
+	if len(sig) != 64 {
+		t.Fatalf("签名长度 = %d", len(sig))
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(verifyKey, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Error("JWT 签名验证失败")
+	}
+}
+
+func TestIsPushServiceEndpoint(t *testing.T) {
+	t.Setenv("PUSH_SERVICE_HOSTS", "push.example.org")
+	cases := []struct {
+		endpoint string
+		want     bool
+	}{
+		{"https://fcm.googleapis.com/fcm/send/abc", true},
+		{"https://updates.push.services.mozilla.com/wpush/v2/abc", true},
+		{"https://wns2-sg2p.notify.windows.com/w/?token=abc", true},
+		{"https://web.push.apple.com/abc", true},
+		{"https://push.example.org/abc", true},
+		{"http://fcm.googleapis.com/fcm/send/abc", false},
+		{"https://evilfcm.googleapis.com.attacker.net/abc", false},
+		{"https://127.0.0.1/abc", false},
+		{"https://169.254.169.254/latest/meta-data", false},
+	}
+	for _, tc := range cases {
+		if got := isPushServiceEndpoint(tc.endpoint); got != tc.want {
+			t.Errorf("isPushServiceEndpoint(%q) = %v, want %v", tc.endpoint, got, tc.want)
+		}
+	}
+}